@@ -0,0 +1,354 @@
+package main
+
+// Archives of harvested records.  Records are written straight into the archive as they are
+// harvested, without being written to intermediate files.  An archive which was interrupted can be
+// recovered up to the last time it was flushed, so that a resumed harvest can keep writing to it.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Supported archive formats
+const (
+	ZipArchive   string = "zip"
+	TarGzArchive string = "tar.gz"
+)
+
+// The suffix of archives which are still being written
+const partialArchiveSuffix string = ".partial"
+
+// An archive of harvested records.
+type RecordArchive interface {
+	// Adds a record file to the archive
+	Add(name string, modTime time.Time, content string) error
+
+	// Writes the records added so far to the partial file, and returns the size of the file.  The
+	// archive can be recovered up to this size with RecoverRecordArchive.
+	Flush() (int64, error)
+
+	// Returns the filename of the archive once it is finalised
+	Filename() string
+
+	// Finalises the archive
+	Close() error
+}
+
+// Returns the filename extension of an archive format, or an error if the format is not supported.
+func ArchiveExtension(format string) (string, error) {
+	switch format {
+	case ZipArchive:
+		return ".zip", nil
+	case TarGzArchive, "tgz":
+		return ".tar.gz", nil
+	default:
+		return "", fmt.Errorf("unsupported archive format '%s': use %s or %s", format, ZipArchive, TarGzArchive)
+	}
+}
+
+// Creates a new archive with the base name.  If an archive with that name already exists, a
+// numbered name is used instead.  The archive is written to a partial file which is renamed once
+// the archive is finalised.
+func NewRecordArchive(format string, base string) (RecordArchive, error) {
+	ext, err := ArchiveExtension(format)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := base + ext
+	for n := 1; fileExists(filename) || fileExists(filename+partialArchiveSuffix); n++ {
+		filename = fmt.Sprintf("%s.%d%s", base, n, ext)
+	}
+
+	file, err := os.Create(filename + partialArchiveSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	af := archiveFile{file, filename}
+	if ext == ".tar.gz" {
+		gz := gzip.NewWriter(file)
+		return &tarGzRecordArchive{af, gz, tar.NewWriter(gz)}, nil
+	}
+	return &zipRecordArchive{af, zip.NewWriter(file)}, nil
+}
+
+// Reopens the partial file of an archive which was not finalised, keeping the records written
+// before the size returned by Flush.  Anything written after that size is dropped.  An archive
+// which was finalised after it was flushed, as happens when a harvest is stopped, is reopened as a
+// partial archive.
+func RecoverRecordArchive(format string, filename string, size int64) (RecordArchive, error) {
+	ext, err := ArchiveExtension(format)
+	if err != nil {
+		return nil, err
+	}
+
+	partial := filename + partialArchiveSuffix
+	if !fileExists(partial) && fileExists(filename) {
+		if err := os.Rename(filename, partial); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Truncate(partial, size); err != nil {
+		return nil, err
+	}
+
+	if ext == ".tar.gz" {
+		// Each flush ends a gzip member, so records can be added in a new member
+		file, err := os.OpenFile(partial, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return nil, err
+		}
+		gz := gzip.NewWriter(file)
+		return &tarGzRecordArchive{archiveFile{file, filename}, gz, tar.NewWriter(gz)}, nil
+	}
+	return recoverZipRecordArchive(filename)
+}
+
+// Removes the partial files of archives in a directory which were never finalised, as happens when
+// a harvest is interrupted.  The partial file of the archive keep, if given, is not removed.
+func RemovePartialArchives(dir string, keep string) error {
+	partials, err := filepath.Glob(filepath.Join(dir, "*"+partialArchiveSuffix))
+	if err != nil {
+		return err
+	}
+	for _, partial := range partials {
+		if (keep != "") && (partial == keep+partialArchiveSuffix) {
+			continue
+		}
+		if err := os.Remove(partial); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if a path of the manifest refers to a record within an archive.
+func IsArchivedPath(path string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if strings.HasSuffix(elem, ".zip") || strings.HasSuffix(elem, ".tar.gz") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a file exists
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// The file of an archive
+type archiveFile struct {
+	file     *os.File
+	filename string
+}
+
+func (af archiveFile) Filename() string {
+	return af.filename
+}
+
+// Closes the file and renames the partial file to the final filename.  The error of the archive
+// writer is returned, if there is one.
+func (af archiveFile) finalise(err error) error {
+	if err2 := af.file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(af.filename+partialArchiveSuffix, af.filename)
+}
+
+// Returns the size of the partial file
+func (af archiveFile) size() (int64, error) {
+	return fileSize(af.file)
+}
+
+// ---------------------------------------------------------------------------------------------
+// Zip archives
+//      Records are compressed before they are added, so that the local header of each record
+//      holds its sizes.  The records of a partial archive can then be read without the central
+//      directory, which is only written when the archive is finalised.
+
+type zipRecordArchive struct {
+	archiveFile
+	zw *zip.Writer
+}
+
+// The signature and size of the local header of a zip file entry
+const (
+	zipLocalHeaderSignature uint32 = 0x04034b50
+	zipLocalHeaderLen       int    = 30
+)
+
+// Recovers a partial zip archive by copying the records of the partial file into a new partial
+// file.  The partial file is replaced once the records have been copied.
+func recoverZipRecordArchive(filename string) (RecordArchive, error) {
+	partial := filename + partialArchiveSuffix
+	src, err := os.Open(partial)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	tmpFilename := filename + ".tmp" + partialArchiveSuffix
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	za := &zipRecordArchive{archiveFile{file, filename}, zip.NewWriter(file)}
+	if err := za.copyRecords(bufio.NewReader(src)); err != nil {
+		file.Close()
+		os.Remove(tmpFilename)
+		return nil, fmt.Errorf("%s: %s", partial, err.Error())
+	}
+	if err := za.zw.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpFilename, partial); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return za, nil
+}
+
+// Adds the records read from the local headers and compressed content of a partial archive
+func (za *zipRecordArchive) copyRecords(r io.Reader) error {
+	for {
+		lh := make([]byte, zipLocalHeaderLen)
+		if _, err := io.ReadFull(r, lh); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if binary.LittleEndian.Uint32(lh) != zipLocalHeaderSignature {
+			return fmt.Errorf("expected a local file header")
+		}
+
+		hdr := &zip.FileHeader{
+			Flags:              binary.LittleEndian.Uint16(lh[6:]),
+			Method:             binary.LittleEndian.Uint16(lh[8:]),
+			ModifiedTime:       binary.LittleEndian.Uint16(lh[10:]),
+			ModifiedDate:       binary.LittleEndian.Uint16(lh[12:]),
+			CRC32:              binary.LittleEndian.Uint32(lh[14:]),
+			CompressedSize64:   uint64(binary.LittleEndian.Uint32(lh[18:])),
+			UncompressedSize64: uint64(binary.LittleEndian.Uint32(lh[22:])),
+		}
+		name := make([]byte, binary.LittleEndian.Uint16(lh[26:]))
+		hdr.Extra = make([]byte, binary.LittleEndian.Uint16(lh[28:]))
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		} else if _, err := io.ReadFull(r, hdr.Extra); err != nil {
+			return err
+		}
+		hdr.Name = string(name)
+
+		w, err := za.zw.CreateRaw(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, int64(hdr.CompressedSize64)); err != nil {
+			return err
+		}
+	}
+}
+
+func (za *zipRecordArchive) Add(name string, modTime time.Time, content string) error {
+	compressed := new(bytes.Buffer)
+	fw, err := flate.NewWriter(compressed, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	io.WriteString(fw, content)
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	hdr := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE([]byte(content)),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: uint64(len(content)),
+	}
+	hdr.SetModTime(modTime)
+
+	w, err := za.zw.CreateRaw(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(compressed.Bytes())
+	return err
+}
+
+func (za *zipRecordArchive) Flush() (int64, error) {
+	if err := za.zw.Flush(); err != nil {
+		return 0, err
+	}
+	return za.size()
+}
+
+func (za *zipRecordArchive) Close() error {
+	return za.finalise(za.zw.Close())
+}
+
+// ---------------------------------------------------------------------------------------------
+// Tar.gz archives
+
+type tarGzRecordArchive struct {
+	archiveFile
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (ta *tarGzRecordArchive) Add(name string, modTime time.Time, content string) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := ta.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.WriteString(ta.tw, content)
+	return err
+}
+
+// Ends the gzip member, so that the partial file can be read up to this point.  The records added
+// after it are written to a new member.
+func (ta *tarGzRecordArchive) Flush() (int64, error) {
+	if err := ta.tw.Flush(); err != nil {
+		return 0, err
+	}
+	if err := ta.gz.Close(); err != nil {
+		return 0, err
+	}
+	ta.gz.Reset(ta.file)
+
+	return ta.size()
+}
+
+func (ta *tarGzRecordArchive) Close() error {
+	err := ta.tw.Close()
+	if err2 := ta.gz.Close(); err == nil {
+		err = err2
+	}
+	return ta.finalise(err)
+}
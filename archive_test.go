@@ -0,0 +1,181 @@
+package main
+
+import (
+    "testing"
+    "time"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "archive/zip"
+    "archive/tar"
+    "compress/gzip"
+    "io"
+    "strings"
+)
+
+func TestZipRecordArchive(t *testing.T) {
+    dir, err := ioutil.TempDir("", "archive")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    writeTestArchive(t, ZipArchive, filepath.Join(dir, "01"))
+
+    zr, err := zip.OpenReader(filepath.Join(dir, "01.zip"))
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer zr.Close()
+
+    if (len(zr.File) != 2) || (zr.File[0].Name != "01/a.xml") {
+        t.Errorf("Unexpected files in archive: %v", zr.File)
+    }
+
+    // A second archive with the same name is numbered
+    writeTestArchive(t, ZipArchive, filepath.Join(dir, "01"))
+    if _, err := os.Stat(filepath.Join(dir, "01.1.zip")) ; err != nil {
+        t.Error(err)
+    }
+}
+
+func TestTarGzRecordArchive(t *testing.T) {
+    dir, err := ioutil.TempDir("", "archive")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    writeTestArchive(t, TarGzArchive, filepath.Join(dir, "01"))
+
+    file, err := os.Open(filepath.Join(dir, "01.tar.gz"))
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    gz, err := gzip.NewReader(file)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    tr := tar.NewReader(gz)
+    names := ""
+    for hdr, err := tr.Next() ; err == nil ; hdr, err = tr.Next() {
+        names += hdr.Name + " "
+    }
+    if (names != "01/a.xml 01/b.xml ") {
+        t.Errorf("Unexpected files in archive: %s", names)
+    }
+}
+
+// Test that an archive which was killed after it was flushed keeps the records before the flush
+func TestRecoverRecordArchive(t *testing.T) {
+    dir, err := ioutil.TempDir("", "archive")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    for _, format := range []string{ ZipArchive, TarGzArchive } {
+        archive, err := NewRecordArchive(format, filepath.Join(dir, "01"))
+        if (err != nil) {
+            t.Fatal(err)
+        }
+        archive.Add("01/a.xml", time.Now(), "<a/>")
+        archive.Add("01/b.xml", time.Now(), "<b/>")
+        size, err := archive.Flush()
+        if (err != nil) {
+            t.Fatal(err)
+        }
+        archive.Add("01/c.xml", time.Now(), "<c/>")
+        archive.Flush()
+        if (format == TarGzArchive) {
+            // Archives are also finalised when the harvest is stopped
+            archive.Close()
+        }
+
+        archive, err = RecoverRecordArchive(format, archive.Filename(), size)
+        if (err != nil) {
+            t.Fatalf("%s: %s", format, err)
+        }
+        archive.Add("01/d.xml", time.Now(), "<d/>")
+        if err := archive.Close() ; err != nil {
+            t.Fatal(err)
+        }
+
+        if names := readTestArchiveNames(t, archive.Filename()) ; names != "01/a.xml 01/b.xml 01/d.xml" {
+            t.Errorf("%s: unexpected files in archive: %s", format, names)
+        }
+        if partials, _ := filepath.Glob(filepath.Join(dir, "*" + partialArchiveSuffix)) ; len(partials) != 0 {
+            t.Errorf("%s: unexpected partial files: %v", format, partials)
+        }
+    }
+}
+
+func TestIsArchivedPath(t *testing.T) {
+    if !IsArchivedPath("01.zip/01/a.xml") || !IsArchivedPath("01.1.tar.gz/01/a.xml") {
+        t.Error("Expected paths in archives to be archived")
+    }
+    if IsArchivedPath("01/a.xml") {
+        t.Error("Expected paths in directories to not be archived")
+    }
+}
+
+func writeTestArchive(t *testing.T, format string, base string) {
+    archive, err := NewRecordArchive(format, base)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    archive.Add("01/a.xml", time.Now(), "<a/>")
+    archive.Add("01/b.xml", time.Now(), "<b/>")
+    if err := archive.Close() ; err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Returns the names of the files of an archive, checking that each can be read
+func readTestArchiveNames(t *testing.T, filename string) string {
+    names := []string{}
+    if strings.HasSuffix(filename, ".zip") {
+        zr, err := zip.OpenReader(filename)
+        if (err != nil) {
+            t.Fatal(err)
+        }
+        defer zr.Close()
+
+        for _, f := range zr.File {
+            r, err := f.Open()
+            if (err != nil) {
+                t.Fatal(err)
+            }
+            if _, err := io.Copy(ioutil.Discard, r) ; err != nil {
+                t.Errorf("%s: %s", f.Name, err)
+            }
+            r.Close()
+            names = append(names, f.Name)
+        }
+        return strings.Join(names, " ")
+    }
+
+    file, err := os.Open(filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    gz, err := gzip.NewReader(file)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    tr := tar.NewReader(gz)
+    hdr, err := tr.Next()
+    for ; err == nil ; hdr, err = tr.Next() {
+        names = append(names, hdr.Name)
+    }
+    if (err != io.EOF) {
+        t.Error(err)
+    }
+    return strings.Join(names, " ")
+}
@@ -0,0 +1,124 @@
+package main
+
+// Change detection.  Records are compared using a hash of their canonical content, so that records
+// which have not changed since they were last harvested are not written again.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The kinds of changes written to the changeset
+const (
+	NewChange     string = "new"
+	ChangedChange string = "changed"
+	DeletedChange string = "deleted"
+)
+
+// Returns the SHA-256 hash of the canonical form of the XML content as a hex string.  In the
+// canonical form, elements and attributes are identified by their namespace URI rather than their
+// prefix, attributes are sorted, runs of whitespace in text are collapsed and comments, processing
+// instructions and namespace declarations are dropped.  If the content is not well formed, the
+// content itself is hashed.
+func ContentHash(content string) string {
+	h := sha256.New()
+	if err := writeCanonicalXml(h, content); err != nil {
+		h.Reset()
+		io.WriteString(h, content)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Writes the canonical form of the XML content.
+func writeCanonicalXml(h hash.Hash, content string) error {
+	dec := xml.NewDecoder(strings.NewReader(content))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			fmt.Fprintf(h, "<{%s}%s", t.Name.Space, t.Name.Local)
+
+			attrs := make([]string, 0, len(t.Attr))
+			for _, attr := range t.Attr {
+				if (attr.Name.Space == "xmlns") || ((attr.Name.Space == "") && (attr.Name.Local == "xmlns")) {
+					continue
+				}
+				attrs = append(attrs, fmt.Sprintf("{%s}%s=%q", attr.Name.Space, attr.Name.Local, attr.Value))
+			}
+			sort.Strings(attrs)
+			for _, attr := range attrs {
+				io.WriteString(h, " "+attr)
+			}
+			io.WriteString(h, ">")
+		case xml.EndElement:
+			fmt.Fprintf(h, "</{%s}%s>", t.Name.Space, t.Name.Local)
+		case xml.CharData:
+			if text := strings.Join(strings.Fields(string(t)), " "); text != "" {
+				xml.EscapeText(h, []byte(text))
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------
+// Changeset
+//      A file of the records which have been added, changed or deleted by a harvest.  Each line is
+//      the kind of change, the identifier and the path of the file, separated by tabs.
+
+type Changeset struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+// Creates a new changeset, replacing the file if it exists.
+func CreateChangeset(filename string) (*Changeset, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Changeset{file, bufio.NewWriter(file)}, nil
+}
+
+// Opens a changeset, adding to the changes already in the file.  This is used when a harvest is
+// resumed.
+func AppendChangeset(filename string) (*Changeset, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Changeset{file, bufio.NewWriter(file)}, nil
+}
+
+// Adds a change to the changeset
+func (cs *Changeset) Add(change string, id string, path string) error {
+	_, err := fmt.Fprintf(cs.w, "%s\t%s\t%s\n", change, id, path)
+	return err
+}
+
+// Writes any changes which have not been written to the file
+func (cs *Changeset) Flush() error {
+	return cs.w.Flush()
+}
+
+// Writes any changes and closes the file
+func (cs *Changeset) Close() error {
+	err := cs.w.Flush()
+	if err2 := cs.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestContentHashIsCanonical(t *testing.T) {
+    base := ContentHash(`<?xml version="1.0"?><a:doc xmlns:a="urn:x" id="1" lang="en"><a:title>Some  title</a:title></a:doc>`)
+
+    for _, same := range []string{
+        `<doc xmlns="urn:x" lang="en" id="1"><title>Some title</title></doc>`,
+        "<b:doc xmlns:b=\"urn:x\" id=\"1\" lang=\"en\">\n    <b:title>\n        Some title\n    </b:title>\n</b:doc>\n",
+        `<a:doc xmlns:a="urn:x" id="1" lang="en"><!-- comment --><a:title>Some title</a:title></a:doc>`,
+    } {
+        if hash := ContentHash(same) ; hash != base {
+            t.Errorf("Expected same hash for %s", same)
+        }
+    }
+
+    for _, different := range []string{
+        `<doc xmlns="urn:y" lang="en" id="1"><title>Some title</title></doc>`,
+        `<doc xmlns="urn:x" lang="en" id="2"><title>Some title</title></doc>`,
+        `<doc xmlns="urn:x" lang="en" id="1"><title>Another title</title></doc>`,
+    } {
+        if hash := ContentHash(different) ; hash == base {
+            t.Errorf("Expected different hash for %s", different)
+        }
+    }
+}
+
+func TestContentHashOfMalformedContent(t *testing.T) {
+    if (ContentHash("<doc>") == ContentHash("<doc><")) {
+        t.Error("Expected malformed content to be hashed as is")
+    }
+    if (ContentHash("<doc>") != ContentHash("<doc>")) {
+        t.Error("Expected hash of malformed content to be stable")
+    }
+}
+
+func TestChangesetAppendsWhenResumed(t *testing.T) {
+    dir, err := ioutil.TempDir("", "changes")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "changes.txt")
+    for i, openFn := range []func(string) (*Changeset, error) { CreateChangeset, AppendChangeset } {
+        cs, err := openFn(filename)
+        if (err != nil) {
+            t.Fatal(err)
+        }
+        cs.Add(NewChange, fmt.Sprintf("rec:%d", i + 1), "rec.xml")
+        if err := cs.Close() ; err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    data, _ := ioutil.ReadFile(filename)
+    if expected := "new\trec:1\trec.xml\nnew\trec:2\trec.xml\n" ; string(data) != expected {
+        t.Errorf("Expected %q, got %q", expected, string(data))
+    }
+
+    // Creating the changeset replaces the changes
+    cs, _ := CreateChangeset(filename)
+    cs.Close()
+    if data, _ := ioutil.ReadFile(filename) ; len(data) != 0 {
+        t.Errorf("Expected an empty changeset, got %q", string(data))
+    }
+}
@@ -0,0 +1,159 @@
+package main
+
+// Harvest checkpoints.  These record the progress of a harvest after each page, so that a
+// harvest which has been interrupted can be resumed from the last completed page.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The filename of the checkpoint within the harvest directory
+const CheckpointFilename string = "checkpoint.json"
+
+// The progress of a harvest.
+type Checkpoint struct {
+	// The original query
+	Url         string     `json:"url"`
+	Prefix      string     `json:"prefix"`
+	Set         string     `json:"set"`
+	From        *time.Time `json:"from,omitempty"`
+	Until       *time.Time `json:"until,omitempty"`
+	Granularity string     `json:"granularity,omitempty"`
+	FirstResult int        `json:"firstResult"`
+	MaxResults  int        `json:"maxResults"`
+	Incremental bool       `json:"incremental,omitempty"`
+
+	// The output format and file of the harvest.  The file is empty for the directory layout.
+	Output     string `json:"output,omitempty"`
+	OutputFile string `json:"outputFile,omitempty"`
+
+	// The size of the output file at the checkpoint.  The file is truncated to this size when the
+	// harvest is resumed, as the records after it are harvested again.
+	OutputSize int64 `json:"outputSize,omitempty"`
+
+	// The layout template of the directory layout, if one was given
+	Layout string `json:"layout,omitempty"`
+
+	// The number of files in each directory, and the format of the archives of the directory
+	// layout if records are archived
+	MaxDirSize int    `json:"maxDirSize,omitempty"`
+	Archive    string `json:"archive,omitempty"`
+
+	// The changeset of the directory layout, if one is being written
+	ChangesFile string `json:"changesFile,omitempty"`
+
+	// The sizes of the manifest and changeset of the directory layout at the checkpoint, and the
+	// archive being written and its size.  These are truncated to their sizes when the harvest is
+	// resumed, in the same way as the output file.
+	ManifestSize int64  `json:"manifestSize,omitempty"`
+	ChangesSize  int64  `json:"changesSize,omitempty"`
+	ArchiveFile  string `json:"archiveFile,omitempty"`
+	ArchiveSize  int64  `json:"archiveSize,omitempty"`
+
+	// The resumption token of the next page to harvest and the number of results before it.  The
+	// token is empty if the first page has not been completed.
+	ResumptionToken string `json:"resumptionToken"`
+	Results         int    `json:"results"`
+
+	// The state of the harvest command at the start of the next page
+	RecordCount   int       `json:"recordCount"`
+	LastDirId     int       `json:"lastDirId"`
+	LastDatestamp time.Time `json:"lastDatestamp"`
+
+	// The counts of the changes to the records of the directory layout
+	NewCount       int `json:"newCount"`
+	ChangedCount   int `json:"changedCount"`
+	UnchangedCount int `json:"unchangedCount"`
+
+	Updated time.Time `json:"updated"`
+}
+
+// Returns the filename of the checkpoint in a harvest directory.
+func CheckpointFile(dir string) string {
+	return filepath.Join(dir, CheckpointFilename)
+}
+
+// Reads a checkpoint from a file.
+func ReadCheckpoint(filename string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := new(Checkpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Writes the checkpoint to a file.  The file is replaced atomically, so that a crash while
+// writing does not lose the previous checkpoint.
+func (cp *Checkpoint) Save(filename string) error {
+	cp.Updated = time.Now().UTC()
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// Truncates a file to its size at the checkpoint.  Files which do not exist are ignored, as they
+// were not written before the harvest was interrupted.
+func TruncateToCheckpoint(filename string, size int64) error {
+	if (filename == "") || !fileExists(filename) {
+		return nil
+	}
+	return os.Truncate(filename, size)
+}
+
+// Returns the size of a file, or 0 if it does not exist.
+func FileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Returns the list arguments for resuming the harvest.  If the resumption token has expired, the
+// original query is issued again, and the records which were already harvested are listed again.
+func (cp *Checkpoint) ListArgs() ListIdentifierArgs {
+	return ListIdentifierArgs{
+		Set:                 cp.Set,
+		From:                cp.From,
+		Until:               cp.Until,
+		Granularity:         cp.Granularity,
+		ResumptionToken:     cp.ResumptionToken,
+		FallbackFirstResult: cp.FirstResult,
+		FallbackMaxResults:  cp.MaxResults,
+	}
+}
+
+// Returns the first and maximum number of results still to harvest.
+func (cp *Checkpoint) RemainingResults() (int, int) {
+	firstResult := cp.FirstResult - cp.Results
+	harvested := cp.Results - cp.FirstResult
+	if firstResult < 0 {
+		firstResult = 0
+	}
+	if harvested < 0 {
+		harvested = 0
+	}
+
+	maxResults := cp.MaxResults
+	if maxResults != -1 {
+		maxResults -= harvested
+	}
+	return firstResult, maxResults
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCheckpointRemainingResults(t *testing.T) {
+    for _, test := range []struct {
+        first, max, results     int
+        expFirst, expMax        int
+    } {
+        { 0, 100000, 0, 0, 100000 },
+        { 0, 100000, 400, 0, 99600 },
+        { 500, 1000, 400, 100, 1000 },
+        { 500, 1000, 800, 0, 700 },
+        { 0, -1, 400, 0, -1 },
+    } {
+        cp := &Checkpoint{FirstResult: test.first, MaxResults: test.max, Results: test.results}
+        if first, max := cp.RemainingResults() ; (first != test.expFirst) || (max != test.expMax) {
+            t.Errorf("%v: expected (%d, %d) but got (%d, %d)", test, test.expFirst, test.expMax, first, max)
+        }
+    }
+}
+
+func TestCheckpointListArgs(t *testing.T) {
+    from := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+    last := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+
+    cp := &Checkpoint{Set: "a", From: &from, LastDatestamp: last}
+    if args := cp.ListArgs() ; (args.ResumptionToken != "") || !args.From.Equal(from) {
+        t.Errorf("Expected the original query before the first page was completed, got %v", args)
+    }
+
+    cp.ResumptionToken = "page2"
+    if args := cp.ListArgs() ; (args.ResumptionToken != "page2") || !args.From.Equal(from) || (args.Set != "a") {
+        t.Errorf("Expected to resume from page2 or the original query, got %v", args)
+    }
+}
+
+// Test that the original query is issued again when the resumption token has expired
+func TestCheckpointListArgsFallback(t *testing.T) {
+    from := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+    cp := &Checkpoint{From: &from, FirstResult: 500, MaxResults: 1000, Results: 800, ResumptionToken: "page9"}
+    cp.LastDatestamp = time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+    if args := cp.ListArgs() ; !args.From.Equal(from) || (args.FallbackFirstResult != 500) || (args.FallbackMaxResults != 1000) {
+        t.Errorf("Expected the first 500 and maximum 1000 results of the original query, got %v", args)
+    }
+    if _, max := cp.RemainingResults() ; max != 700 {
+        t.Errorf("Expected 700 remaining results, got %d", max)
+    }
+}
@@ -4,9 +4,9 @@
 package oaipmh
 
 import (
+    "context"
     "io"
     "io/ioutil"
-    "bufio"
     "bytes"
     "log"
     "encoding/xml"
@@ -43,6 +43,33 @@ type ListArgs struct {
     Set             string
     From            *time.Time
     Until           *time.Time
+
+    // The granularity used to send From and Until to the provider.  Either DayGranularity or
+    // SecondGranularity.  Defaults to SecondGranularity.
+    Granularity     string
+}
+
+
+// Returns the arguments as request parameters
+func (la ListArgs) values() url.Values {
+    vals := url.Values{
+        "metadataPrefix": {la.Prefix},
+    }
+    layout := time.RFC3339
+    if (la.Granularity == DayGranularity) {
+        layout = "2006-01-02"
+    }
+
+    if (la.From != nil) {
+        vals.Add("from", la.From.UTC().Format(layout))
+    }
+    if (la.Until != nil) {
+        vals.Add("until", la.Until.UTC().Format(layout))
+    }
+    if (la.Set != "") {
+        vals.Set("set", la.Set)
+    }
+    return vals
 }
 
 
@@ -62,6 +89,15 @@ const (
     ReqRespBodyDebug            = iota
 )
 
+// Receives a copy of each successful response from the provider, along with the request that
+// was made.  This can be used to keep a record of the responses, say in a WARC file.
+type ResponseRecorder interface {
+
+    // Records a response.  The body is the entire body of the response.  If an error is returned,
+    // the request fails with that error.
+    RecordResponse(req *http.Request, resp *http.Response, body []byte) error
+}
+
 // An OAI-PMH client
 type Client struct {
     // Sets the debug level
@@ -70,25 +106,146 @@ type Client struct {
     // Use the GET method instead of POST
     UseGet          bool
 
+    // The policy for retrying failed requests
+    Retry           RetryPolicy
+
+    // The User-Agent sent with each request.  If empty, the default of the HTTP client is used.
+    UserAgent       string
+
+    // Additional headers sent with each request
+    Header          http.Header
+
+    // If set, receives each successful response.  Responses are read in full before being decoded.
+    Recorder        ResponseRecorder
+
     url             *url.URL
+    httpClient      *http.Client
+    timeout         time.Duration
+}
+
+// An option which can be passed to NewClient
+type ClientOption   func(c *Client)
+
+// Use the HTTP client for making requests
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+    return func(c *Client) {
+        c.httpClient = httpClient
+    }
+}
+
+// Sets the timeout of each request.  This includes reading the response body.
+func WithTimeout(timeout time.Duration) ClientOption {
+    return func(c *Client) {
+        c.timeout = timeout
+    }
+}
+
+// Sets the User-Agent sent with each request
+func WithUserAgent(userAgent string) ClientOption {
+    return func(c *Client) {
+        c.UserAgent = userAgent
+    }
+}
+
+// Adds a header which is sent with each request
+func WithHeader(name string, value string) ClientOption {
+    return func(c *Client) {
+        c.Header.Add(name, value)
+    }
 }
 
 // Creates a new client to a particular provider.  Returns either the client or an
-// error if the URL is invalid
-func NewClient(providerUrl string) (*Client, error) {
+// error if the URL is invalid.
+func NewClient(providerUrl string, opts ...ClientOption) (*Client, error) {
     u, err := url.ParseRequestURI(providerUrl)
     if (err != nil) {
         return nil, err
     }
 
-    return &Client{NoDebug, false, u}, nil
+    c := &Client{
+        Debug: NoDebug,
+        UseGet: false,
+        Retry: DefaultRetryPolicy,
+        Header: make(http.Header),
+        url: u,
+        httpClient: http.DefaultClient,
+    }
+    for _, opt := range opts {
+        opt(c)
+    }
+
+    // Copy the HTTP client so that a client passed in by the caller is not modified
+    if (c.timeout > 0) {
+        hc := *c.httpClient
+        hc.Timeout = c.timeout
+        c.httpClient = &hc
+    }
+
+    return c, nil
 }
 
 // Fetches an OAI-PMH request and stores it within the provider response variable.  Returns
-// an error if there was an error.
+// an error if there was an error.  Failed requests are retried according to the retry policy.
 func (c *Client) Fetch(verb string, vals url.Values, res *OaipmhResponse) error {
+    return c.FetchContext(context.Background(), verb, vals, res)
+}
+
+// Like Fetch, but the request and any retries are abandoned when the context is cancelled.
+func (c *Client) FetchContext(ctx context.Context, verb string, vals url.Values, res *OaipmhResponse) error {
+    responseBody, err := c.open(ctx, verb, vals)
+    if (err != nil) {
+        return err
+    }
+    defer responseBody.Close()
+
+    // Marshal the response into the provided 'res'
+    *res = OaipmhResponse{}
+    dec := xml.NewDecoder(responseBody)
+    err = dec.Decode(res)
+    if err != nil {
+        if (ctx.Err() != nil) {
+            return ctx.Err()
+        }
+        return err
+    }
+
+    // If there's an OAI-PMH error, return that as a normal error.
+    if res.Error != nil {
+        return EOaipmhError{res.Error.Code, res.Error.Message}
+    }
+
+    return nil
+}
+
+// Sends an OAI-PMH request and returns the body of the successful response.  Failed requests
+// are retried according to the retry policy.  The body must be closed by the caller.
+func (c *Client) open(ctx context.Context, verb string, vals url.Values) (io.ReadCloser, error) {
     vals.Set("verb", verb)
 
+    attempts := c.Retry.attempts()
+    for attempt := 1; ; attempt++ {
+        body, err := c.openOnce(ctx, vals)
+        if (err == nil) || (attempt >= attempts) || !c.Retry.retryable(err) || (ctx.Err() != nil) {
+            return body, err
+        }
+
+        backoff := c.Retry.backoff(attempt, err)
+        if (c.Debug >= ReqDebug) {
+            log.Printf(">> retry: %s failed (%s), attempt %d of %d in %s\n", verb, err.Error(), attempt + 1, attempts, backoff)
+        }
+
+        timer := time.NewTimer(backoff)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// Makes a single attempt at sending an OAI-PMH request.
+func (c *Client) openOnce(ctx context.Context, vals url.Values) (io.ReadCloser, error) {
     if (c.Debug >= ReqDebug) {
         if c.UseGet {
             log.Printf(">> GET %s\n", c.url.String() + "?" + vals.Encode())
@@ -103,19 +260,17 @@ func (c *Client) Fetch(verb string, vals url.Values, res *OaipmhResponse) error
     }
 
     // Post the form
-    var resp *http.Response
-    var err error
-
-    if c.UseGet {
-        urlWithParams, _ := url.Parse(c.url.String())
-        urlWithParams.RawQuery = vals.Encode()
-
-        resp, err = http.Get(urlWithParams.String())
-    } else {
-        resp, err = http.PostForm(c.url.String(), vals)
+    req, err := c.newRequest(vals)
+    if err != nil {
+        return nil, err
     }
+
+    resp, err := c.httpClient.Do(req.WithContext(ctx))
     if err != nil {
-        return err
+        if (ctx.Err() != nil) {
+            return nil, ctx.Err()
+        }
+        return nil, transportError{err}
     }
 
     if (c.Debug >= ReqRespDebug) {
@@ -124,73 +279,199 @@ func (c *Client) Fetch(verb string, vals url.Values, res *OaipmhResponse) error
 
     // Expect a 200 response
     if resp.StatusCode != 200 {
-        return fmt.Errorf("HTTP error: %v\n", resp.Status)
-    }    
+        resp.Body.Close()
+        return nil, newHttpError(resp)
+    }
 
-    // Get response body
-    responseBody := c.readResponseBody(resp)
-    defer responseBody.Close()
+    if (c.Recorder != nil) {
+        err := c.recordResponse(req, resp)
+        if (err != nil) && (ctx.Err() != nil) {
+            return nil, ctx.Err()
+        } else if (err != nil) {
+            return nil, err
+        }
+    }
 
-    // Marshal the response into the provided 'res'
-    dec := xml.NewDecoder(responseBody)
-    err = dec.Decode(res)
-    if err != nil {
-        return err
+    return c.readResponseBody(resp), nil
+}
+
+// Reads the body of the response and passes it to the recorder.  The body of the response is
+// replaced with the body that was read.
+func (c *Client) recordResponse(req *http.Request, resp *http.Response) error {
+    body, err := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if (err != nil) {
+        return transportError{err}
     }
 
-    // If there's an OAI-PMH error, return that as a normal error.
-    if res.Error != nil {
-        return EOaipmhError{res.Error.Code, res.Error.Message}
+    resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+    return c.Recorder.RecordResponse(req, resp, body)
+}
+
+// Builds the HTTP request with the parameters and configured headers
+func (c *Client) newRequest(vals url.Values) (*http.Request, error) {
+    var req *http.Request
+    var err error
+
+    if c.UseGet {
+        urlWithParams, _ := url.Parse(c.url.String())
+        urlWithParams.RawQuery = vals.Encode()
+
+        req, err = http.NewRequest("GET", urlWithParams.String(), nil)
+    } else {
+        req, err = http.NewRequest("POST", c.url.String(), strings.NewReader(vals.Encode()))
+        if (err == nil) {
+            req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        }
+    }
+    if (err != nil) {
+        return nil, err
     }
 
-    return nil
+    for name, hvals := range c.Header {
+        for _, hval := range hvals {
+            req.Header.Add(name, hval)
+        }
+    }
+    if (c.UserAgent != "") {
+        req.Header.Set("User-Agent", c.UserAgent)
+    }
+
+    return req, nil
 }
 
-// Returns the body of the response.  If debugging is enabled, the response is first
-// buffered, then dumped to the log.  The response will be closed by the caller
+// Returns the body of the response.  If debugging is enabled, the body is dumped to the log
+// line by line as it is read.  The response will be closed by the caller
 func (c *Client) readResponseBody(res *http.Response) io.ReadCloser {
     if !(c.Debug >= ReqRespBodyDebug) {
         return res.Body
     }
 
-    defer res.Body.Close()
-
-    // Read the response to a buffer
-    respBuffer := new(bytes.Buffer)
-    respBuffer.ReadFrom(res.Body)
+    return &loggingBody{body: res.Body}
+}
 
-    respBytes := respBuffer.Bytes()
+// A response body which dumps each line to the log as it is read.
+type loggingBody struct {
+    body        io.ReadCloser
+    line        []byte
+}
 
-    // Dump the response to the log
-    scanner := bufio.NewScanner(bytes.NewBuffer(respBytes))
-    for scanner.Scan() {
-        log.Printf("<< body: %s\n", scanner.Text())
+func (lb *loggingBody) Read(p []byte) (int, error) {
+    n, err := lb.body.Read(p)
+    lb.line = append(lb.line, p[:n]...)
+    for i := bytes.IndexByte(lb.line, '\n') ; i >= 0 ; i = bytes.IndexByte(lb.line, '\n') {
+        log.Printf("<< body: %s\n", strings.TrimRight(string(lb.line[:i]), "\r"))
+        lb.line = lb.line[i + 1:]
     }
+    return n, err
+}
 
-    // And return it as a buffer that can be consumed by the client
-    return ioutil.NopCloser(bytes.NewBuffer(respBytes))
+func (lb *loggingBody) Close() error {
+    if (len(lb.line) > 0) {
+        log.Printf("<< body: %s\n", string(lb.line))
+        lb.line = nil
+    }
+    return lb.body.Close()
 }
 
-// Returns the list of sets
+// Returns the list of sets.  This will fetch every page of sets from the provider.
 func (c *Client) ListSets() ([]OaipmhSet, error) {
+    return c.ListSetsContext(context.Background())
+}
+
+// Like ListSets, but stops fetching pages when the context is cancelled.
+func (c *Client) ListSetsContext(ctx context.Context) ([]OaipmhSet, error) {
+    ls, err := c.IterateSetsContext(ctx)
+    if (err != nil) {
+        return nil, err
+    }
+
+    sets := make([]OaipmhSet, 0)
+    for err = ls.Next(); err == nil; err = ls.Next() {
+        set, _ := ls.Set()
+        sets = append(sets, *set)
+    }
+
+    if _, isNoMore := err.(ENoMore) ; !isNoMore {
+        return nil, err
+    }
+    return sets, nil
+}
+
+// Returns an iterator over the list of sets
+func (c *Client) IterateSets() (*ListSetsIterator, error) {
+    return c.IterateSetsContext(context.Background())
+}
+
+// Like IterateSets, but the iterator stops fetching pages when the context is cancelled.
+func (c *Client) IterateSetsContext(ctx context.Context) (*ListSetsIterator, error) {
+    ls := &ListSetsIterator{ client: c, ctx: ctx, listSize: -1 }
+    err := ls.fetch(url.Values{})
+    if (err != nil) {
+        return nil, err
+    }
+
+    return ls, nil
+}
+
+// Returns the identity of the provider
+func (c *Client) Identify() (*OaipmhIdentify, error) {
+    return c.IdentifyContext(context.Background())
+}
+
+// Like Identify, but the request is abandoned when the context is cancelled.
+func (c *Client) IdentifyContext(ctx context.Context) (*OaipmhIdentify, error) {
+    res := &OaipmhResponse{}
+    err := c.FetchContext(ctx, "Identify", url.Values{}, res)
+    if (err != nil) {
+        return nil, err
+    } else if (res.Identify == nil) {
+        return nil, fmt.Errorf("Response did not contain an Identify element")
+    }
+
+    return res.Identify, nil
+}
+
+// Returns the list of metadata formats supported by the provider.  If identifier is not
+// empty, only the formats that are available for that record are returned.
+func (c *Client) ListMetadataFormats(identifier string) ([]Format, error) {
+    return c.ListMetadataFormatsContext(context.Background(), identifier)
+}
+
+// Like ListMetadataFormats, but the request is abandoned when the context is cancelled.
+func (c *Client) ListMetadataFormatsContext(ctx context.Context, identifier string) ([]Format, error) {
+    vals := url.Values{}
+    if (identifier != "") {
+        vals.Set("identifier", identifier)
+    }
+
     res := &OaipmhResponse{}
-    err := c.Fetch("ListSets", url.Values{}, res)
+    err := c.FetchContext(ctx, "ListMetadataFormats", vals, res)
     if (err != nil) {
         return nil, err
+    } else if (res.ListMetadataFormats == nil) {
+        return nil, fmt.Errorf("Response did not contain a ListMetadataFormats element")
     }
 
-    return res.ListSets.Sets, nil
+    return res.ListMetadataFormats.Formats, nil
 }
 
 // Returns a record
 func (c *Client) GetRecord(prefix string, id string) (*OaipmhRecord, error) {
+    return c.GetRecordContext(context.Background(), prefix, id)
+}
+
+// Like GetRecord, but the request is abandoned when the context is cancelled.
+func (c *Client) GetRecordContext(ctx context.Context, prefix string, id string) (*OaipmhRecord, error) {
     res := &OaipmhResponse{}
-    err := c.Fetch("GetRecord", url.Values{
+    err := c.FetchContext(ctx, "GetRecord", url.Values{
         "metadataPrefix": { prefix },
         "identifier": { id },
     }, res)
     if (err != nil) {
         return nil, err
+    } else if (res.GetRecord == nil) {
+        return nil, fmt.Errorf("Response did not contain a GetRecord element")
     }
 
     return &(res.GetRecord.Record), nil
@@ -198,22 +479,14 @@ func (c *Client) GetRecord(prefix string, id string) (*OaipmhRecord, error) {
 
 // Returns a list of identifiers
 func (c *Client) ListIdentifiers(listArgs ListArgs) (*ListIdentifierIterator, error) {
-    vals := url.Values{
-        "metadataPrefix": {listArgs.Prefix},
-    }
-    if (listArgs.From != nil) {
-        vals.Add("from", listArgs.From.UTC().Format(time.RFC3339))
-    }
-    if (listArgs.Until != nil) {
-        vals.Add("until", listArgs.Until.UTC().Format(time.RFC3339))
-    }
-    if (listArgs.Set != "") {
-        vals.Set("set", listArgs.Set)
-    }
+    return c.ListIdentifiersContext(context.Background(), listArgs)
+}
 
+// Like ListIdentifiers, but the iterator stops fetching pages when the context is cancelled.
+func (c *Client) ListIdentifiersContext(ctx context.Context, listArgs ListArgs) (*ListIdentifierIterator, error) {
     // Get the initial set
-    li := &ListIdentifierIterator{ client: c }
-    err := li.fetch(vals)
+    li := &ListIdentifierIterator{ client: c, ctx: ctx, listSize: -1 }
+    err := li.fetch(listArgs.values())
     if (err != nil) {
         return nil, err
     }
@@ -223,22 +496,30 @@ func (c *Client) ListIdentifiers(listArgs ListArgs) (*ListIdentifierIterator, er
 
 // Returns a list of records
 func (c *Client) ListRecords(listArgs ListArgs) (*ListRecordsIterator, error) {
-    vals := url.Values{
-        "metadataPrefix": {listArgs.Prefix},
-    }
-    if (listArgs.From != nil) {
-        vals.Add("from", listArgs.From.UTC().Format(time.RFC3339))
-    }
-    if (listArgs.Until != nil) {
-        vals.Add("until", listArgs.Until.UTC().Format(time.RFC3339))
-    }
-    if (listArgs.Set != "") {
-        vals.Set("set", listArgs.Set)
-    }
+    return c.ListRecordsContext(context.Background(), listArgs)
+}
 
+// Like ListRecords, but the iterator stops fetching pages when the context is cancelled.
+func (c *Client) ListRecordsContext(ctx context.Context, listArgs ListArgs) (*ListRecordsIterator, error) {
     // Get the initial set
-    lr := &ListRecordsIterator{ client: c }
-    err := lr.fetch(vals)
+    lr := &ListRecordsIterator{ client: c, ctx: ctx, listSize: -1 }
+    err := lr.fetch(listArgs.values())
+    if (err != nil) {
+        return nil, err
+    }
+
+    return lr, nil
+}
+
+// Resumes a list of records from a resumption token returned by a previous ListRecords request.
+func (c *Client) ResumeListRecords(resToken string) (*ListRecordsIterator, error) {
+    return c.ResumeListRecordsContext(context.Background(), resToken)
+}
+
+// Like ResumeListRecords, but the iterator stops fetching pages when the context is cancelled.
+func (c *Client) ResumeListRecordsContext(ctx context.Context, resToken string) (*ListRecordsIterator, error) {
+    lr := &ListRecordsIterator{ client: c, ctx: ctx, listSize: -1 }
+    err := lr.fetch(url.Values{ "resumptionToken": {resToken} })
     if (err != nil) {
         return nil, err
     }
@@ -264,6 +545,19 @@ type RecordIterator interface {
     // Returns the current record.  Either returns the record, or an error if there was a
     // problem retrieving the record.  The record may be retrieved on demand if necessary.
     Record()        (*OaipmhRecord, error)
+
+    // Returns the complete list size advertised by the provider, or -1 if the provider has
+    // not advertised it.
+    CompleteListSize() int
+}
+
+// Implemented by iterators which page through a list using resumption tokens.  A listing can be
+// resumed from the page token, provided the token has not expired.
+type PagedIterator interface {
+
+    // Returns the resumption token used to fetch the current page, or the empty string if the
+    // current page is the first page.
+    PageToken() string
 }
 
 // -----------------------------------------------------------------------------------------
@@ -272,7 +566,10 @@ type RecordIterator interface {
 // An iterator for a list identifiers response
 type ListIdentifierIterator struct {
     client          *Client
+    ctx             context.Context
     resToken        string
+    pageToken       string
+    listSize        int
     pos             int             // Position will be 1 ahead of current header
     headers         []OaipmhHeader
 }
@@ -312,6 +609,17 @@ func (li *ListIdentifierIterator) Record() (*OaipmhRecord, error) {
     return nil, fmt.Errorf("Records are not fetched")
 }
 
+// Returns the complete list size advertised by the provider, or -1 if the provider has
+// not advertised it.
+func (li *ListIdentifierIterator) CompleteListSize() int {
+    return li.listSize
+}
+
+// Returns the resumption token used to fetch the current page.
+func (li *ListIdentifierIterator) PageToken() string {
+    return li.pageToken
+}
+
 // Loads the iterator with new values
 func (li *ListIdentifierIterator) fetchNext() error {
     return li.fetch(url.Values{ "resumptionToken": {li.resToken} })
@@ -321,7 +629,7 @@ func (li *ListIdentifierIterator) fetchNext() error {
 func (li *ListIdentifierIterator) fetch(val url.Values) error {
     res := &OaipmhResponse{}
 
-    err := li.client.Fetch("ListIdentifiers", val, res)
+    err := li.client.FetchContext(li.ctx, "ListIdentifiers", val, res)
 
     if (err != nil) {
         return err
@@ -332,7 +640,11 @@ func (li *ListIdentifierIterator) fetch(val url.Values) error {
     // Set the new state
     li.pos = 0
     li.headers = liRes.Headers
-    li.resToken = liRes.ResumptionToken
+    li.pageToken = val.Get("resumptionToken")
+    li.resToken = liRes.ResumptionToken.String()
+    if size := liRes.ResumptionToken.ListSize() ; size != -1 {
+        li.listSize = size
+    }
 
     return nil
 }
@@ -343,7 +655,10 @@ func (li *ListIdentifierIterator) fetch(val url.Values) error {
 // An iterator for a list records response
 type ListRecordsIterator struct {
     client          *Client
+    ctx             context.Context
     resToken        string
+    pageToken       string
+    listSize        int
     pos             int
     records         []OaipmhRecord
 }
@@ -387,6 +702,17 @@ func (lr *ListRecordsIterator) Record() (*OaipmhRecord, error) {
     }
 }
 
+// Returns the complete list size advertised by the provider, or -1 if the provider has
+// not advertised it.
+func (lr *ListRecordsIterator) CompleteListSize() int {
+    return lr.listSize
+}
+
+// Returns the resumption token used to fetch the current page.
+func (lr *ListRecordsIterator) PageToken() string {
+    return lr.pageToken
+}
+
 // Loads the iterator with new values
 func (lr *ListRecordsIterator) fetchNext() error {
     return lr.fetch(url.Values{ "resumptionToken": {lr.resToken} })
@@ -396,7 +722,7 @@ func (lr *ListRecordsIterator) fetchNext() error {
 func (lr *ListRecordsIterator) fetch(val url.Values) error {
     res := &OaipmhResponse{}
 
-    err := lr.client.Fetch("ListRecords", val, res)
+    err := lr.client.FetchContext(lr.ctx, "ListRecords", val, res)
 
     if (err != nil) {
         return err
@@ -407,7 +733,89 @@ func (lr *ListRecordsIterator) fetch(val url.Values) error {
     // Set the new state
     lr.pos = 0
     lr.records = lrRes.Records
-    lr.resToken = lrRes.ResumptionToken
+    lr.pageToken = val.Get("resumptionToken")
+    lr.resToken = lrRes.ResumptionToken.String()
+    if size := lrRes.ResumptionToken.ListSize() ; size != -1 {
+        lr.listSize = size
+    }
+
+    return nil
+}
+
+// -----------------------------------------------------------------------------------------
+// ListSets iterator
+
+// An iterator for a list sets response
+type ListSetsIterator struct {
+    client          *Client
+    ctx             context.Context
+    resToken        string
+    listSize        int
+    pos             int
+    sets            []OaipmhSet
+}
+
+// Returns the next set, if one is present.  If no more sets are present, the second
+// return value will be a ENoMore result.  Otherwise, the error will be something else.
+func (ls *ListSetsIterator) Next() error {
+    if (ls.pos >= len(ls.sets)) {
+        if (ls.resToken == "") {
+            return ENoMore{}
+        }
+
+        err := ls.fetchNext()
+        if (err != nil) {
+            return err
+        } else {
+            return ls.Next()
+        }
+    } else {
+        ls.pos++
+        return nil
+    }
+}
+
+// Returns the current set.  If Next() returns nil, this is guaranteed to be set.
+func (ls *ListSetsIterator) Set() (*OaipmhSet, error) {
+    if (ls.pos > 0) {
+        return &(ls.sets[ls.pos - 1]), nil
+    } else {
+        return nil, fmt.Errorf("Next() was not called first")
+    }
+}
+
+// Returns the complete list size advertised by the provider, or -1 if the provider has
+// not advertised it.
+func (ls *ListSetsIterator) CompleteListSize() int {
+    return ls.listSize
+}
+
+// Loads the iterator with new values
+func (ls *ListSetsIterator) fetchNext() error {
+    return ls.fetch(url.Values{ "resumptionToken": {ls.resToken} })
+}
+
+// Fetch the next set of sets
+func (ls *ListSetsIterator) fetch(val url.Values) error {
+    res := &OaipmhResponse{}
+
+    err := ls.client.FetchContext(ls.ctx, "ListSets", val, res)
+
+    if (err != nil) {
+        return err
+    } else if (res.ListSets == nil) {
+        return fmt.Errorf("Response did not contain a ListSets element")
+    }
+
+    lsRes := res.ListSets
+
+    // Set the new state
+    ls.pos = 0
+    ls.sets = lsRes.Sets
+    ls.resToken = lsRes.ResumptionToken.String()
+    if size := lsRes.ResumptionToken.ListSize() ; size != -1 {
+        ls.listSize = size
+    }
 
     return nil
 }
@@ -0,0 +1,240 @@
+package oaipmh
+
+import (
+    "testing"
+    "context"
+    "fmt"
+    "time"
+    "net/http"
+    "net/http/httptest"
+)
+
+
+// Starts a test provider which responds to ListSets with two pages of sets.
+func newPagedSetsProvider() *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        req.ParseForm()
+
+        var body string
+        if (req.Form.Get("resumptionToken") == "") {
+            body = `<set><setSpec>a</setSpec><setName>A</setName></set>
+                    <set><setSpec>b</setSpec><setName>B</setName></set>
+                    <resumptionToken completeListSize="3" cursor="0">page2</resumptionToken>`
+        } else {
+            body = `<set><setSpec>c</setSpec><setName>C</setName></set>
+                    <resumptionToken completeListSize="3" cursor="2"></resumptionToken>`
+        }
+
+        fmt.Fprintf(rw, `<?xml version="1.0" encoding="UTF-8"?>
+            <OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+                <responseDate>2017-01-01T00:00:00Z</responseDate>
+                <request verb="ListSets">http://localhost/</request>
+                <ListSets>%s</ListSets>
+            </OAI-PMH>`, body)
+    }))
+}
+
+func TestListSetsFollowsResumptionTokens(t *testing.T) {
+    server := newPagedSetsProvider()
+    defer server.Close()
+
+    c, err := NewClient(server.URL)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    sets, err := c.ListSets()
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    specs := ""
+    for _, set := range sets {
+        specs += set.Spec
+    }
+    if (specs != "abc") {
+        t.Errorf("Expected sets 'abc' but got '%s'", specs)
+    }
+}
+
+func TestListSetsIteratorListSize(t *testing.T) {
+    server := newPagedSetsProvider()
+    defer server.Close()
+
+    c, _ := NewClient(server.URL)
+    ls, err := c.IterateSets()
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    if (ls.CompleteListSize() != 3) {
+        t.Errorf("Expected complete list size of 3 but got %d", ls.CompleteListSize())
+    }
+}
+
+func TestStreamRecordsReadsOnePageAtATime(t *testing.T) {
+    requests := 0
+    server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        req.ParseForm()
+        requests++
+
+        var body string
+        if (req.Form.Get("resumptionToken") == "") {
+            body = `<record><header><identifier>a</identifier></header><metadata><md><record>x</record></md></metadata></record>
+                    <record><header status="deleted"><identifier>b</identifier></header></record>
+                    <resumptionToken completeListSize="3" cursor="0">page2</resumptionToken>`
+        } else {
+            body = `<record><header><identifier>c</identifier></header><metadata><md/></metadata></record>`
+        }
+
+        fmt.Fprintf(rw, `<?xml version="1.0" encoding="UTF-8"?>
+            <OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+                <responseDate>2017-01-01T00:00:00Z</responseDate>
+                <request verb="ListRecords">http://localhost/</request>
+                <ListRecords>%s</ListRecords>
+            </OAI-PMH>`, body)
+    }))
+    defer server.Close()
+
+    c, _ := NewClient(server.URL)
+    sr, err := c.StreamRecords(ListArgs{Prefix: "oai_dc"})
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer sr.Close()
+
+    ids := ""
+    for err = sr.Next() ; err == nil ; err = sr.Next() {
+        rec, _ := sr.Record()
+        ids += rec.Header.Identifier
+
+        if (rec.Header.Identifier == "a") && (rec.Content.Xml != "<md><record>x</record></md>") {
+            t.Errorf("Unexpected content of record a: %s", rec.Content.Xml)
+        } else if (rec.Header.Identifier == "b") && (requests != 1) {
+            t.Errorf("Expected the second page to be requested after the first was read")
+        }
+    }
+
+    if _, isNoMore := err.(ENoMore) ; !isNoMore {
+        t.Fatal(err)
+    } else if (ids != "abc") {
+        t.Errorf("Expected records 'abc' but got '%s'", ids)
+    } else if (requests != 2) {
+        t.Errorf("Expected 2 requests but got %d", requests)
+    } else if (sr.CompleteListSize() != 3) {
+        t.Errorf("Expected complete list size of 3 but got %d", sr.CompleteListSize())
+    }
+}
+
+func TestStreamRecordsReturnsOaipmhErrors(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        fmt.Fprint(rw, `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/"><error code="noRecordsMatch">None</error></OAI-PMH>`)
+    }))
+    defer server.Close()
+
+    c, _ := NewClient(server.URL)
+    if _, err := c.StreamRecords(ListArgs{Prefix: "oai_dc"}) ; err == nil {
+        t.Error("Expected an error")
+    } else if oaiErr, isOaiErr := err.(EOaipmhError) ; !isOaiErr || (oaiErr.Code != "noRecordsMatch") {
+        t.Errorf("Expected noRecordsMatch but got %v", err)
+    }
+}
+
+func TestFetchRetriesRetryableStatuses(t *testing.T) {
+    requests := 0
+    server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        requests++
+        if (requests < 3) {
+            rw.Header().Set("Retry-After", "0")
+            http.Error(rw, "Busy", http.StatusServiceUnavailable)
+            return
+        }
+        fmt.Fprint(rw, `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/"><ListSets></ListSets></OAI-PMH>`)
+    }))
+    defer server.Close()
+
+    c, _ := NewClient(server.URL)
+    c.Retry.BaseBackoff = time.Millisecond
+
+    if _, err := c.ListSets() ; err != nil {
+        t.Fatal(err)
+    } else if (requests != 3) {
+        t.Errorf("Expected 3 requests but got %d", requests)
+    }
+
+    // Give up once the maximum number of attempts is reached
+    requests = 0
+    c.Retry.MaxAttempts = 2
+    if _, err := c.ListSets() ; err == nil {
+        t.Error("Expected an error")
+    } else if httpErr, isHttpErr := err.(EHttpError) ; !isHttpErr || (httpErr.StatusCode != 503) {
+        t.Errorf("Expected a 503 HTTP error but got %v", err)
+    } else if (requests != 2) {
+        t.Errorf("Expected 2 requests but got %d", requests)
+    }
+}
+
+func TestFetchContextCancelsRequest(t *testing.T) {
+    unblock := make(chan struct{})
+    server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        select {
+        case <-req.Context().Done():
+        case <-unblock:
+        }
+    }))
+    defer server.Close()
+    defer close(unblock)
+
+    c, _ := NewClient(server.URL)
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+
+    started := time.Now()
+    if _, err := c.ListSetsContext(ctx) ; err != context.DeadlineExceeded {
+        t.Errorf("Expected the deadline to be exceeded but got %v", err)
+    } else if time.Since(started) > 5 * time.Second {
+        t.Errorf("Expected the request to be cancelled promptly")
+    }
+}
+
+func TestRetryBackoff(t *testing.T) {
+    rp := RetryPolicy{MaxAttempts: 10, BaseBackoff: time.Second, MaxBackoff: 5 * time.Second, RespectRetryAfter: true}
+
+    for attempt, exp := range []time.Duration{ time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second } {
+        if b := rp.backoff(attempt + 1, transportError{nil}) ; b != exp {
+            t.Errorf("Attempt %d: expected backoff %s but got %s", attempt + 1, exp, b)
+        }
+    }
+
+    if b := rp.backoff(1, EHttpError{503, "503", 30 * time.Second}) ; b != 30 * time.Second {
+        t.Errorf("Expected Retry-After to be respected but got %s", b)
+    }
+}
+
+func TestClientOptions(t *testing.T) {
+    var userAgent, apiKey string
+    server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+        userAgent, apiKey = req.Header.Get("User-Agent"), req.Header.Get("X-Api-Key")
+        fmt.Fprint(rw, `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/"><ListSets></ListSets></OAI-PMH>`)
+    }))
+    defer server.Close()
+
+    httpClient := &http.Client{}
+    c, _ := NewClient(server.URL, WithHTTPClient(httpClient), WithTimeout(5 * time.Second),
+        WithUserAgent("test/1.0"), WithHeader("X-Api-Key", "secret"))
+
+    for _, useGet := range []bool{ false, true } {
+        c.UseGet = useGet
+        if _, err := c.ListSets() ; err != nil {
+            t.Fatal(err)
+        }
+
+        if (userAgent != "test/1.0") || (apiKey != "secret") {
+            t.Errorf("Expected User-Agent and X-Api-Key headers but got '%s' and '%s'", userAgent, apiKey)
+        }
+    }
+
+    if (httpClient.Timeout != 0) {
+        t.Error("Expected the HTTP client passed in to be left unmodified")
+    }
+}
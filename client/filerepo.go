@@ -87,6 +87,13 @@ func (fr *FileRepository) Sets() ([]Set, error) {
 
 // Reads the record from a set.  This simply iterates over all the files in a set directory.
 func (fr *FileRepository) ListRecords(set string, from time.Time, to time.Time) (RecordCursor, error) {
+    // Only select records with a datestamp between from and to inclusive.  Datestamps are
+    // only published to the nearest second, so compare them at that granularity.
+    filter := func(rec *Record) bool {
+        date := rec.Date.Truncate(time.Second)
+        return !date.Before(from) && !date.After(to)
+    }
+
     // If no set is specific, scan all the sets
     if (set == "") {
         sets, err := fr.Sets()
@@ -96,21 +103,23 @@ func (fr *FileRepository) ListRecords(set string, from time.Time, to time.Time)
 
         allRecords := make([]*Record, 0)
         for _, aset := range sets {
-            recs, err := fr.scanRecordsFromDir(aset.Spec, func(rec *Record) bool { return true })
+            recs, err := fr.scanRecordsFromDir(aset.Spec, filter)
             if (err != nil) {
                 return nil, err
             }
             allRecords = append(allRecords, recs...)
         }
 
+        SortRecords(allRecords)
         return &SliceRecordCursor{allRecords, 0}, nil
 
     } else {
-        recs, err := fr.scanRecordsFromDir(set, func(rec *Record) bool { return true })
+        recs, err := fr.scanRecordsFromDir(set, filter)
         if (err != nil) {
             return nil, err
         }
 
+        SortRecords(recs)
         return &SliceRecordCursor{recs, 0}, nil
     }
 }
@@ -248,6 +257,11 @@ func (c *SliceRecordCursor) Pos() int {
     return c.Pointer
 }
 
+// Returns the total number of records.
+func (c *SliceRecordCursor) Size() int {
+    return len(c.Records)
+}
+
 // Returns the current record, or nil if the cursor is at an invalid position.
 func (c *SliceRecordCursor) Record() *Record {
     if (c.posValid(c.Pointer)) {
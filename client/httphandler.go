@@ -11,13 +11,29 @@ import (
     "fmt"
     "strings"
     "strconv"
-
-    "github.com/nu7hatch/gouuid"
 )
 
 // Handler verb
 type handlerVerb    func(req *http.Request) (OaipmhResponsePayload, error)
 
+// The arguments accepted by a verb.  Arguments not listed here are illegal.
+type verbArgs struct {
+    // Arguments which must be present
+    Required        []string
+
+    // Arguments which may be present
+    Optional        []string
+
+    // An argument which, when present, must be the only argument
+    Exclusive       string
+}
+
+// Datestamp granularities
+const (
+    DayGranularity      string  = "YYYY-MM-DD"
+    SecondGranularity   string  = "YYYY-MM-DDThh:mm:ssZ"
+)
+
 // A OAI-PMH handler.  This can be used to host a repository as a OAI-PMH provider.
 //
 type Handler struct {
@@ -27,8 +43,16 @@ type Handler struct {
     // The supported verbs.  This simplifies the dispatching of requests.
     verbs           map[string]handlerVerb
 
-    // The set of active resumption tokens mapped to IDs
-    resumptionToks  map[string]*ResumptionToken
+    // The arguments accepted by each verb.
+    verbArgs        map[string]verbArgs
+
+    // The store of active resumption tokens
+    ResumptionTokens    ResumptionTokenStore
+
+    // When set, the handler issues stateless resumption tokens signed with this key instead
+    // of storing cursors in ResumptionTokens.  Handlers sharing the same key and repository
+    // can continue each other's listings.
+    TokenKey            []byte
 }
 
 // Creates a new handler
@@ -36,7 +60,8 @@ func NewHandler(repo Repository) *Handler {
     h := &Handler{
         Repository: repo,
         verbs: make(map[string]handlerVerb),
-        resumptionToks: make(map[string]*ResumptionToken),
+        verbArgs: make(map[string]verbArgs),
+        ResumptionTokens: NewMemoryResumptionTokenStore(DefaultResumptionTokenTTL),
     }
 
     // Set the verbs
@@ -47,6 +72,19 @@ func NewHandler(repo Repository) *Handler {
     h.verbs["listrecords"] = h.listRecords
     h.verbs["getrecord"] = h.getRecord
 
+    // Set the verb arguments
+    listArgs := verbArgs{
+        Required: []string{"metadataPrefix"},
+        Optional: []string{"from", "until", "set"},
+        Exclusive: "resumptionToken",
+    }
+    h.verbArgs["listmetadataformats"] = verbArgs{Optional: []string{"identifier"}}
+    h.verbArgs["listsets"] = verbArgs{Exclusive: "resumptionToken"}
+    h.verbArgs["identify"] = verbArgs{}
+    h.verbArgs["listidentifiers"] = listArgs
+    h.verbArgs["listrecords"] = listArgs
+    h.verbArgs["getrecord"] = verbArgs{Required: []string{"identifier", "metadataPrefix"}}
+
     return h
 }
 
@@ -98,7 +136,45 @@ func (h *Handler) dispatch(verb string, req *http.Request) (OaipmhResponsePayloa
         }, nil
     }
 
-    return verbHandler(req)
+    if err := h.checkArgs(h.verbArgs[strings.ToLower(verb)], req) ; err != nil {
+        return err, nil
+    }
+
+    // OAI-PMH errors raised by the verb are returned as the response payload
+    payload, err := verbHandler(req)
+    if oaipmhErr, isOaipmhErr := err.(*OaipmhError) ; isOaipmhErr {
+        return oaipmhErr, nil
+    }
+    return payload, err
+}
+
+// Checks that the arguments of the request are legal for the verb.  Returns a badArgument
+// error if they are not.
+func (h *Handler) checkArgs(args verbArgs, req *http.Request) *OaipmhError {
+    for name, vals := range req.Form {
+        if (name == "verb") {
+            continue
+        }
+
+        if (len(vals) > 1) {
+            return badArgument("Argument '%s' was repeated", name)
+        } else if (name == args.Exclusive) {
+            if (len(req.Form) > 2) {
+                return badArgument("Argument '%s' must be the only argument", name)
+            }
+            return nil
+        } else if !containsString(args.Required, name) && !containsString(args.Optional, name) {
+            return badArgument("Illegal argument '%s'", name)
+        }
+    }
+
+    for _, name := range args.Required {
+        if (req.Form.Get(name) == "") {
+            return badArgument("Missing required argument '%s'", name)
+        }
+    }
+
+    return nil
 }
 
 // Identify the repository
@@ -109,7 +185,7 @@ func (h *Handler) identify(req *http.Request) (OaipmhResponsePayload, error) {
         ProtocolVer: "2.0",
         EarliestDatestamp: MinTime.In(time.UTC).Format(time.RFC3339),
         DeletedRecord: "transient",
-        Granularity: "YYYY-MM-DDThh:mm:ssZ",
+        Granularity: SecondGranularity,
         AdminEmail: "",
     }, nil
 }
@@ -117,7 +193,17 @@ func (h *Handler) identify(req *http.Request) (OaipmhResponsePayload, error) {
 
 // Lists the metadata formats
 func (h *Handler) listMetadataFormats(req *http.Request) (OaipmhResponsePayload, error) {
-    // Returns the slice of sets from the repository
+    // Check that the record exists if one was specified
+    if id := req.Form.Get("identifier") ; id != "" {
+        record, err := h.Repository.Record(id)
+        if (err != nil) {
+            return nil, err
+        } else if (record == nil) {
+            return nil, idDoesNotExist(id)
+        }
+    }
+
+    // Returns the slice of formats from the repository
     formats := h.Repository.Formats()
 
     return &OaipmhListMetadataFormats{
@@ -125,8 +211,13 @@ func (h *Handler) listMetadataFormats(req *http.Request) (OaipmhResponsePayload,
     }, nil
 }
 
-// List the metadata sets
+// List the metadata sets.  All the sets are returned in a single response, so any resumption token
+// is one that was never issued.
 func (h *Handler) listSets(req *http.Request) (OaipmhResponsePayload, error) {
+    if (req.Form.Get("resumptionToken") != "") {
+        return nil, badResumptionToken()
+    }
+
     sets, err := h.Repository.Sets()
     if (err != nil) {
         return nil, err
@@ -145,19 +236,24 @@ func (h *Handler) listSets(req *http.Request) (OaipmhResponsePayload, error) {
 
 // List metadata identifiers
 func (h *Handler) listIdentifiers(req *http.Request) (OaipmhResponsePayload, error) {
-    cursor, err := h.getCursorForListVerb(req)
+    cursor, query, err := h.getCursorForListVerb(req)
     if (err != nil) {
         return nil, err
     }
 
     // List the records.
+    startPos := cursor.Pos()
     recs, _ := NextNRecords(cursor, 100)
     headers := make([]OaipmhHeader, len(recs))
     for i, rec := range recs {
         headers[i] = RecordToOaipmhHeader(rec)
     }
 
-    resumptionToken, _ := h.storeCursorState(cursor)
+    resumptionToken, err := h.storeCursorState(cursor, query, startPos, recs)
+    if (err != nil) {
+        return nil, err
+    }
+
     return &OaipmhListIdentifiers{
         Headers: headers,
         ResumptionToken: resumptionToken,
@@ -166,12 +262,13 @@ func (h *Handler) listIdentifiers(req *http.Request) (OaipmhResponsePayload, err
 
 // List metadata records
 func (h *Handler) listRecords(req *http.Request) (OaipmhResponsePayload, error) {
-    cursor, err := h.getCursorForListVerb(req)
+    cursor, query, err := h.getCursorForListVerb(req)
     if (err != nil) {
         return nil, err
     }
 
     // List the records.
+    startPos := cursor.Pos()
     recs, _ := NextNRecords(cursor, 100)
     records := make([]OaipmhRecord, len(recs))
     for i, rec := range recs {
@@ -181,7 +278,11 @@ func (h *Handler) listRecords(req *http.Request) (OaipmhResponsePayload, error)
         }
     }
 
-    resumptionToken, _ := h.storeCursorState(cursor)
+    resumptionToken, err := h.storeCursorState(cursor, query, startPos, recs)
+    if (err != nil) {
+        return nil, err
+    }
+
     return &OaipmhListRecords{
         Records: records,
         ResumptionToken: resumptionToken,
@@ -192,6 +293,10 @@ func (h *Handler) listRecords(req *http.Request) (OaipmhResponsePayload, error)
 func (h *Handler) getRecord(req *http.Request) (OaipmhResponsePayload, error) {
     id := req.Form.Get("identifier")
 
+    if err := h.checkFormat(req.Form.Get("metadataPrefix")) ; err != nil {
+        return nil, err
+    }
+
     record, err := h.Repository.Record(id)
     if (err != nil) {
         return nil, err
@@ -207,43 +312,127 @@ func (h *Handler) getRecord(req *http.Request) (OaipmhResponsePayload, error) {
             }, nil
         }
     } else {
-        return &OaipmhError{
-            Code: "idDoesNotExist",
-            Message: "Metadata with ID '" + id + "' does not exist",
-        }, nil
+        return nil, idDoesNotExist(id)
     }
 }
 
-// Get a cursor for a list verb.
-func (h *Handler) getCursorForListVerb(req *http.Request) (RecordCursor, error) {
-    var cursor RecordCursor
-    var err error
+// Checks that the metadata prefix is one managed by the repository.  Returns a
+// cannotDisseminateFormat error if it is not.
+func (h *Handler) checkFormat(prefix string) error {
+    for _, format := range h.Repository.Formats() {
+        if (format.Prefix == prefix) {
+            return nil
+        }
+    }
 
+    return &OaipmhError{
+        Code: "cannotDisseminateFormat",
+        Message: "Metadata format '" + prefix + "' is not supported by this repository",
+    }
+}
+
+// Get a cursor for a list verb, along with the query used to produce it.  Returns a
+// noRecordsMatch error if the list is empty.
+func (h *Handler) getCursorForListVerb(req *http.Request) (RecordCursor, *listQuery, error) {
     if (req.Form.Get("resumptionToken") != "") {
-        cursor = h.loadCursorState(req.Form.Get("resumptionToken"))
-    } else {
-        set := req.Form.Get("set")
-        cursor, err = h.Repository.ListRecords(set, MinTime, time.Now())
-        if (err != nil) {
-            return nil, err
+        if (h.TokenKey != nil) {
+            return h.loadStatelessCursor(req.Form.Get("resumptionToken"))
+        }
+
+        cursor := h.loadCursorState(req.Form.Get("resumptionToken"))
+        if (cursor == nil) {
+            return nil, nil, badResumptionToken()
         }
+        return cursor, nil, nil
+    }
+
+    from, until, err := parseDateRangeArgs(req.Form.Get("from"), req.Form.Get("until"))
+    if (err != nil) {
+        return nil, nil, err
     }
 
-    return cursor, nil
+    query := &listQuery{
+        Set: req.Form.Get("set"),
+        Prefix: req.Form.Get("metadataPrefix"),
+        From: from,
+        Until: until,
+    }
+    if err := h.checkFormat(query.Prefix) ; err != nil {
+        return nil, nil, err
+    }
+
+    cursor, err := h.Repository.ListRecords(query.Set, query.From, query.Until)
+    if (err != nil) {
+        return nil, nil, err
+    } else if (!cursor.HasRecord()) {
+        return nil, nil, &OaipmhError{
+            Code: "noRecordsMatch",
+            Message: "No records match the request",
+        }
+    }
+
+    return cursor, query, nil
 }
 
-// Store the cursor state and returns a resumption token if required.
-func (h *Handler) storeCursorState(cursor RecordCursor) (string, bool) {
-    if (cursor.HasRecord()) {
-        rt := NewResumptionToken(cursor)
-        h.resumptionToks[rt.ID] = rt
-        return fmt.Sprintf("%s/%d", rt.ID, cursor.Pos()), true
-    } else {
-        return "", false
+// Rebuilds the cursor from a stateless resumption token.
+func (h *Handler) loadStatelessCursor(resumptionToken string) (RecordCursor, *listQuery, error) {
+    st, err := decodeStatelessToken(resumptionToken, h.TokenKey)
+    if (err != nil) {
+        return nil, nil, badResumptionToken()
+    }
+
+    if err := h.checkFormat(st.Prefix) ; err != nil {
+        return nil, nil, err
     }
+
+    cursor, err := h.Repository.ListRecords(st.Set, st.From, st.Until)
+    if (err != nil) {
+        return nil, nil, err
+    }
+
+    skipPastRecord(cursor, st.LastDate, st.LastID)
+    return cursor, &st.listQuery, nil
 }
 
-// Load cursor state.  Returns nil if no resumption token was found.
+// Store the cursor state and returns a resumption token if required.  Returns nil if the
+// list was returned in a single page.  The query and records returned in this page are used
+// to build stateless tokens, and startPos is the position of the first record of this page.
+func (h *Handler) storeCursorState(cursor RecordCursor, query *listQuery, startPos int, recs []*Record) (*OaipmhResumptionToken, error) {
+    resToken := &OaipmhResumptionToken{Cursor: startPos}
+    if sizedCursor, isSized := cursor.(SizedRecordCursor) ; isSized {
+        resToken.CompleteListSize = sizedCursor.Size()
+    }
+
+    // The last page of a list spanning multiple pages has an empty resumption token
+    if (!cursor.HasRecord()) {
+        if (startPos > 0) {
+            return resToken, nil
+        }
+        return nil, nil
+    }
+
+    if (h.TokenKey != nil) && (query != nil) && (len(recs) > 0) {
+        last := recs[len(recs) - 1]
+        st := &statelessToken{*query, last.Date, last.ID}
+        token, err := st.Encode(h.TokenKey)
+        if (err != nil) {
+            return nil, err
+        }
+        resToken.Token = token
+        return resToken, nil
+    }
+
+    rt, err := h.ResumptionTokens.Put(cursor)
+    if (err != nil) {
+        return nil, err
+    }
+
+    resToken.Token = fmt.Sprintf("%s/%d", rt.ID, cursor.Pos())
+    resToken.ExpirationDate = rt.Expires.In(time.UTC).Format("2006-01-02T15:04:05Z")
+    return resToken, nil
+}
+
+// Load cursor state.  Returns nil if the resumption token is unknown or has expired.
 func (h *Handler) loadCursorState(resumptionToken string) RecordCursor {
     var id string
     var pos int
@@ -253,35 +442,101 @@ func (h *Handler) loadCursorState(resumptionToken string) RecordCursor {
         return nil
     }
     id = toks[0]
-    pos, _ = strconv.Atoi(toks[1])
+    pos, err := strconv.Atoi(toks[1])
+    if (err != nil) {
+        return nil
+    }
 
-    cursor := h.resumptionToks[id].Cursor
-    if (cursor == nil) {
+    rt := h.ResumptionTokens.Take(id)
+    if (rt == nil) {
         return nil
     }
-    defer delete(h.resumptionToks, id)
+    cursor := rt.Cursor
 
-    cursor.SetPos(pos)
+    if (!cursor.SetPos(pos)) {
+        return nil
+    }
 
     return cursor
 }
 
 // ------------------------------------------------------------------------------
-// Resumption token
+// Argument parsing
+
+// Parses the from and until arguments of a list verb.  Missing arguments default to MinTime
+// and the current time.  Returns a badArgument error if either datestamp is malformed, if
+// the granularities differ or if from is later than until.
+func parseDateRangeArgs(fromArg string, untilArg string) (from time.Time, until time.Time, err error) {
+    var fromGran, untilGran string
+
+    from, until = MinTime, time.Now()
+    if (fromArg != "") {
+        if from, fromGran, err = parseDatestampArg(fromArg) ; err != nil {
+            return
+        }
+    }
+    if (untilArg != "") {
+        if until, untilGran, err = parseDatestampArg(untilArg) ; err != nil {
+            return
+        }
+
+        // Until is inclusive, so a day datestamp includes everything until the end of the day
+        if (untilGran == DayGranularity) {
+            until = until.Add(24 * time.Hour - time.Second)
+        }
+    }
+
+    if (fromGran != "") && (untilGran != "") && (fromGran != untilGran) {
+        err = badArgument("The from and until arguments have different granularities")
+    } else if (until.Before(from)) {
+        err = badArgument("The from argument is later than the until argument")
+    }
+    return
+}
 
-type ResumptionToken struct {
-    // The token ID
-    ID          string
+// Parses a datestamp argument.  Returns the time and the granularity of the datestamp, or a
+// badArgument error if the datestamp is malformed.
+func parseDatestampArg(val string) (time.Time, string, error) {
+    if t, err := time.Parse("2006-01-02", val) ; err == nil {
+        return t, DayGranularity, nil
+    } else if t, err := time.Parse("2006-01-02T15:04:05Z", val) ; err == nil {
+        return t, SecondGranularity, nil
+    } else {
+        return time.Time{}, "", badArgument("Malformed datestamp '%s'", val)
+    }
+}
+
+// Returns a badArgument error
+func badArgument(format string, args ...interface{}) *OaipmhError {
+    return &OaipmhError{
+        Code: "badArgument",
+        Message: fmt.Sprintf(format, args...),
+    }
+}
 
-    // The time the token was created
-    Created     time.Time
+// Returns a badResumptionToken error
+func badResumptionToken() *OaipmhError {
+    return &OaipmhError{
+        Code: "badResumptionToken",
+        Message: "The resumption token is invalid or has expired",
+    }
+}
 
-    // The cursor
-    Cursor      RecordCursor
+// Returns an idDoesNotExist error
+func idDoesNotExist(id string) *OaipmhError {
+    return &OaipmhError{
+        Code: "idDoesNotExist",
+        Message: "Metadata with ID '" + id + "' does not exist",
+    }
 }
 
-// Creates a new resumption token
-func NewResumptionToken(cursor RecordCursor) *ResumptionToken {
-    id, _ := uuid.NewV4()
-    return &ResumptionToken{id.String(), time.Now(), cursor}
+// Returns true if the string is in the slice
+func containsString(strs []string, str string) bool {
+    for _, s := range strs {
+        if (s == str) {
+            return true
+        }
+    }
+    return false
 }
+
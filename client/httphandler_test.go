@@ -0,0 +1,222 @@
+package oaipmh
+
+import (
+    "testing"
+    "time"
+    "strings"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "encoding/xml"
+)
+
+
+// An in-memory repository used for testing.
+type testRepository []*Record
+
+func (tr testRepository) Sets() ([]Set, error) {
+    return []Set{ Set{"set1", "set1", ""} }, nil
+}
+
+func (tr testRepository) Formats() []Format {
+    return []Format{ DefaultFormat }
+}
+
+func (tr testRepository) ListRecords(set string, from time.Time, to time.Time) (RecordCursor, error) {
+    recs := make([]*Record, 0)
+    for _, rec := range tr {
+        if !rec.Date.Before(from) && !rec.Date.After(to) {
+            recs = append(recs, rec)
+        }
+    }
+    return &SliceRecordCursor{recs, 0}, nil
+}
+
+func (tr testRepository) Record(id string) (*Record, error) {
+    for _, rec := range tr {
+        if (rec.ID == id) {
+            return rec, nil
+        }
+    }
+    return nil, nil
+}
+
+func newTestRepository(count int) testRepository {
+    repo := make(testRepository, count)
+    for i := range repo {
+        repo[i] = &Record{
+            ID: "rec" + string(rune('a' + i)),
+            Date: time.Date(2015, 1, 1 + i, 0, 0, 0, 0, time.UTC),
+            Set: "set1",
+            Content: func() (string, error) { return "<a/>", nil },
+        }
+    }
+    return repo
+}
+
+// Sends a request to the handler and returns the decoded response.
+func serveTestRequest(t *testing.T, h http.Handler, vals url.Values) *OaipmhResponse {
+    req := httptest.NewRequest("GET", "/?" + vals.Encode(), nil)
+    rw := httptest.NewRecorder()
+    h.ServeHTTP(rw, req)
+
+    if (rw.Code != 200) {
+        t.Fatalf("Expected status 200 but got %d: %s", rw.Code, rw.Body.String())
+    }
+
+    res := &OaipmhResponse{}
+    if err := xml.NewDecoder(strings.NewReader(rw.Body.String())).Decode(res) ; err != nil {
+        t.Fatal(err)
+    }
+    return res
+}
+
+func assertErrorCode(t *testing.T, res *OaipmhResponse, code string) {
+    if (code == "") && (res.Error != nil) {
+        t.Errorf("Expected no error but got %s", res.Error.Error())
+    } else if (code != "") && ((res.Error == nil) || (res.Error.Code != code)) {
+        t.Errorf("Expected error %s but got %v", code, res.Error)
+    }
+}
+
+func TestHandlerArgumentErrors(t *testing.T) {
+    h := NewHandler(newTestRepository(5))
+
+    for _, tc := range []struct {
+        vals    url.Values
+        code    string
+    }{
+        { url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"iso19139"}}, "" },
+        { url.Values{"verb": {"ListRecords"}}, "badArgument" },
+        { url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}}, "cannotDisseminateFormat" },
+        { url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"iso19139"}, "from": {"2015-13-01"}}, "badArgument" },
+        { url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"iso19139"}, "from": {"2015-01-01"}, "until": {"2015-01-02T00:00:00Z"}}, "badArgument" },
+        { url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"iso19139"}, "from": {"2015-01-03"}, "until": {"2015-01-02"}}, "badArgument" },
+        { url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"iso19139"}, "from": {"2016-01-01"}}, "noRecordsMatch" },
+        { url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"iso19139"}, "bogus": {"x"}}, "badArgument" },
+        { url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {"nothing/1"}}, "badResumptionToken" },
+        { url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {"nothing/1"}, "set": {"set1"}}, "badArgument" },
+        { url.Values{"verb": {"GetRecord"}, "identifier": {"reca"}, "metadataPrefix": {"iso19139"}}, "" },
+        { url.Values{"verb": {"GetRecord"}, "identifier": {"reca"}, "metadataPrefix": {"oai_dc"}}, "cannotDisseminateFormat" },
+        { url.Values{"verb": {"GetRecord"}, "identifier": {"reca"}}, "badArgument" },
+        { url.Values{"verb": {"ListMetadataFormats"}, "identifier": {"missing"}}, "idDoesNotExist" },
+        { url.Values{"verb": {"ListSets"}}, "" },
+        { url.Values{"verb": {"ListSets"}, "resumptionToken": {"nothing/1"}}, "badResumptionToken" },
+    } {
+        res := serveTestRequest(t, h, tc.vals)
+        assertErrorCode(t, res, tc.code)
+    }
+}
+
+func TestHandlerDateRange(t *testing.T) {
+    h := NewHandler(newTestRepository(5))
+
+    res := serveTestRequest(t, h, url.Values{
+        "verb": {"ListIdentifiers"},
+        "metadataPrefix": {"iso19139"},
+        "from": {"2015-01-02"},
+        "until": {"2015-01-04"},
+    })
+    assertErrorCode(t, res, "")
+
+    if n := len(res.ListIdentifiers.Headers) ; n != 3 {
+        t.Errorf("Expected 3 headers but got %d", n)
+    }
+}
+
+func TestHandlerResumptionTokens(t *testing.T) {
+    h := NewHandler(newTestRepository(250))
+
+    vals := url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"iso19139"}}
+    count, pages := 0, 0
+    for {
+        res := serveTestRequest(t, h, vals)
+        assertErrorCode(t, res, "")
+
+        count += len(res.ListIdentifiers.Headers)
+        pages++
+
+        rt := res.ListIdentifiers.ResumptionToken
+        if (rt == nil) {
+            t.Fatal("Expected a resumption token")
+        } else if (rt.CompleteListSize != 250) || (rt.Cursor != (pages - 1) * 100) {
+            t.Errorf("Expected completeListSize 250 and cursor %d but got %d and %d", (pages - 1) * 100, rt.CompleteListSize, rt.Cursor)
+        }
+
+        if (rt.Token == "") {
+            break
+        } else if (rt.ExpirationDate == "") {
+            t.Error("Expected resumption token to have an expiration date")
+        }
+        vals = url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {rt.Token}}
+    }
+
+    if (count != 250) || (pages != 3) {
+        t.Errorf("Expected 250 records over 3 pages but got %d records over %d pages", count, pages)
+    }
+}
+
+func TestHandlerSinglePageHasNoResumptionToken(t *testing.T) {
+    h := NewHandler(newTestRepository(50))
+
+    res := serveTestRequest(t, h, url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"iso19139"}})
+    assertErrorCode(t, res, "")
+
+    if (res.ListIdentifiers.ResumptionToken != nil) {
+        t.Error("Expected no resumption token")
+    }
+}
+
+func TestHandlerExpiredResumptionToken(t *testing.T) {
+    h := NewHandler(newTestRepository(150))
+    h.ResumptionTokens = NewMemoryResumptionTokenStore(-1 * time.Second)
+
+    res := serveTestRequest(t, h, url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"iso19139"}})
+    assertErrorCode(t, res, "")
+
+    res = serveTestRequest(t, h, url.Values{"verb": {"ListRecords"}, "resumptionToken": {res.ListRecords.ResumptionToken.Token}})
+    assertErrorCode(t, res, "badResumptionToken")
+}
+
+func TestHandlerStatelessResumptionTokens(t *testing.T) {
+    repo := newTestRepository(250)
+    key := []byte("secret")
+
+    // Alternate between two handlers to simulate replicas behind a load balancer
+    handlers := []*Handler{ NewHandler(repo), NewHandler(repo) }
+    for _, h := range handlers {
+        h.TokenKey = key
+    }
+
+    vals := url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"iso19139"}, "from": {"2015-01-02"}}
+    ids := make(map[string]bool)
+    for page := 0 ; ; page++ {
+        res := serveTestRequest(t, handlers[page % 2], vals)
+        assertErrorCode(t, res, "")
+
+        for _, header := range res.ListIdentifiers.Headers {
+            if ids[header.Identifier] {
+                t.Errorf("Identifier %s returned twice", header.Identifier)
+            }
+            ids[header.Identifier] = true
+        }
+
+        rt := res.ListIdentifiers.ResumptionToken
+        if (rt.String() == "") {
+            break
+        }
+        vals = url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {rt.Token}}
+    }
+
+    if (len(ids) != 249) {
+        t.Errorf("Expected 249 records but got %d", len(ids))
+    }
+
+    // Tokens signed with another key must be rejected
+    other := NewHandler(repo)
+    other.TokenKey = []byte("another secret")
+
+    res := serveTestRequest(t, handlers[0], url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"iso19139"}})
+    res = serveTestRequest(t, other, url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {res.ListIdentifiers.ResumptionToken.Token}})
+    assertErrorCode(t, res, "badResumptionToken")
+}
@@ -61,6 +61,10 @@ type OaipmhError struct {
     Message         string                  `xml:",chardata"`
 }
 
+func (e *OaipmhError) Error() string {
+    return e.Code + ": " + e.Message
+}
+
 // Payload for returning the identity of this repository
 type OaipmhIdentify struct {
     XMLName         xml.Name                `xml:"Identify"`
@@ -83,20 +87,46 @@ type OaipmhListMetadataFormats struct {
 type OaipmhListSets struct {
     XMLName         xml.Name                `xml:"ListSets"`
     Sets            []OaipmhSet             `xml:"set"`
+    ResumptionToken *OaipmhResumptionToken  `xml:"resumptionToken,omitempty"`
 }
 
 // Payload for listing identifiers
 type OaipmhListIdentifiers struct {
     XMLName         xml.Name                `xml:"ListIdentifiers"`
     Headers         []OaipmhHeader          `xml:"header"`
-    ResumptionToken string                  `xml:"resumptionToken,omitempty"`
+    ResumptionToken *OaipmhResumptionToken  `xml:"resumptionToken,omitempty"`
 }
 
 // Payload for listing records
 type OaipmhListRecords struct {
     XMLName         xml.Name                `xml:"ListRecords"`
     Records         []OaipmhRecord          `xml:"record"`
-    ResumptionToken string                  `xml:"resumptionToken,omitempty"`
+    ResumptionToken *OaipmhResumptionToken  `xml:"resumptionToken,omitempty"`
+}
+
+// Resumption token
+type OaipmhResumptionToken struct {
+    Token           string                  `xml:",chardata"`
+    ExpirationDate  string                  `xml:"expirationDate,attr,omitempty"`
+    CompleteListSize int                    `xml:"completeListSize,attr,omitempty"`
+    Cursor          int                     `xml:"cursor,attr"`
+}
+
+// Returns the token value, or the empty string if there is no resumption token
+func (rt *OaipmhResumptionToken) String() string {
+    if (rt == nil) {
+        return ""
+    }
+    return rt.Token
+}
+
+// Returns the complete list size, or -1 if there is no resumption token or the size is
+// not known
+func (rt *OaipmhResumptionToken) ListSize() int {
+    if (rt == nil) || (rt.CompleteListSize <= 0) {
+        return -1
+    }
+    return rt.CompleteListSize
 }
 
 // Header
@@ -4,6 +4,7 @@
 package oaipmh
 
 import (
+    "sort"
     "time"
 )
 
@@ -27,7 +28,8 @@ type Repository interface {
     //      from    The time to start listing records from, or MIN_TIME if not specified.
     //      to      The time to end listing records from, or time.Now() if not specified.
     // The returned cursor is to be positioned at the first record (i.e. calling Record() without
-    // calling Next() should return the first record).
+    // calling Next() should return the first record).  Records must be ordered by date, then by
+    // ID, and the ordering must be stable across calls as stateless resumption tokens rely on it.
     ListRecords(set string, from time.Time, to time.Time) (RecordCursor, error)
 
     // Returns a single record.
@@ -53,6 +55,14 @@ type RecordCursor interface {
     Record() *Record
 }
 
+// A record cursor which knows the total number of records it will return.
+type SizedRecordCursor interface {
+    RecordCursor
+
+    // Returns the total number of records.
+    Size() int
+}
+
 // Returns the next N records from a cursor.  Returns true if there are more records to return.
 func NextNRecords(cursor RecordCursor, n int) (records []*Record, hasmore bool) {
     if (n == 0) {
@@ -73,6 +83,17 @@ func NextNRecords(cursor RecordCursor, n int) (records []*Record, hasmore bool)
 }
 
 
+// Sorts records by date, then by ID, as required by Repository.ListRecords.
+func SortRecords(recs []*Record) {
+    sort.Slice(recs, func(i, j int) bool {
+        if recs[i].Date.Equal(recs[j].Date) {
+            return recs[i].ID < recs[j].ID
+        }
+        return recs[i].Date.Before(recs[j].Date)
+    })
+}
+
+
 // Metadata formats
 type Format struct {
     Prefix      string          `xml:"metadataPrefix"`
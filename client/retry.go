@@ -0,0 +1,140 @@
+// Retrying of failed requests.
+//
+
+package oaipmh
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// An error indicating that the provider responded with a non-200 status code
+type EHttpError struct {
+    StatusCode      int
+    Status          string
+
+    // The delay requested by the provider in the Retry-After header, or 0 if none was given
+    RetryAfter      time.Duration
+}
+
+func (e EHttpError) Error() string {
+    return fmt.Sprintf("HTTP error: %v", e.Status)
+}
+
+// Builds an EHttpError from a response
+func newHttpError(resp *http.Response) EHttpError {
+    return EHttpError{resp.StatusCode, resp.Status, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+// Parses the value of a Retry-After header, which is either a number of seconds or a HTTP
+// date.  Returns 0 if the value is missing or invalid.
+func parseRetryAfter(val string, now time.Time) time.Duration {
+    if (val == "") {
+        return 0
+    }
+
+    if secs, err := strconv.Atoi(val) ; err == nil {
+        if (secs < 0) {
+            return 0
+        }
+        return time.Duration(secs) * time.Second
+    } else if t, err := http.ParseTime(val) ; err == nil {
+        if (t.Before(now)) {
+            return 0
+        }
+        return t.Sub(now)
+    }
+    return 0
+}
+
+
+// The policy used by the client for retrying failed requests.  Requests which fail with a
+// transport error or a retryable status code are retried after a backoff which doubles with
+// each attempt.
+type RetryPolicy struct {
+    // The maximum number of attempts made for each request, including the first.  Values less
+    // than 1 are treated as 1.
+    MaxAttempts         int
+
+    // The backoff before the first retry
+    BaseBackoff         time.Duration
+
+    // The maximum backoff between retries
+    MaxBackoff          time.Duration
+
+    // The HTTP status codes which will be retried
+    RetryableStatuses   []int
+
+    // Use the delay requested by the provider in the Retry-After header instead of the
+    // backoff.  This delay is not limited by MaxBackoff.
+    RespectRetryAfter   bool
+}
+
+// A retry policy which does not retry requests
+var NoRetryPolicy RetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// The retry policy used by new clients
+var DefaultRetryPolicy RetryPolicy = RetryPolicy{
+    MaxAttempts:        5,
+    BaseBackoff:        1 * time.Second,
+    MaxBackoff:         1 * time.Minute,
+    RetryableStatuses:  []int{ 500, 502, 503, 504 },
+    RespectRetryAfter:  true,
+}
+
+// Returns the maximum number of attempts
+func (rp RetryPolicy) attempts() int {
+    if (rp.MaxAttempts < 1) {
+        return 1
+    }
+    return rp.MaxAttempts
+}
+
+// Returns true if the error can be retried
+func (rp RetryPolicy) retryable(err error) bool {
+    switch e := err.(type) {
+    case EHttpError:
+        for _, status := range rp.RetryableStatuses {
+            if (status == e.StatusCode) {
+                return true
+            }
+        }
+        return false
+    case transportError:
+        return true
+    default:
+        return false
+    }
+}
+
+// Returns the delay before making the next attempt, given the number of attempts made so far
+// and the error of the last attempt.
+func (rp RetryPolicy) backoff(attempt int, err error) time.Duration {
+    if httpErr, isHttpErr := err.(EHttpError) ; isHttpErr && rp.RespectRetryAfter && (httpErr.RetryAfter > 0) {
+        return httpErr.RetryAfter
+    }
+
+    backoff := rp.BaseBackoff
+    for i := 1; i < attempt; i++ {
+        backoff *= 2
+        if (rp.MaxBackoff > 0) && (backoff >= rp.MaxBackoff) {
+            break
+        }
+    }
+
+    if (rp.MaxBackoff > 0) && (backoff > rp.MaxBackoff) {
+        backoff = rp.MaxBackoff
+    }
+    return backoff
+}
+
+// An error raised while sending the request or receiving the response
+type transportError struct {
+    err     error
+}
+
+func (e transportError) Error() string {
+    return e.err.Error()
+}
@@ -0,0 +1,92 @@
+// Stateless resumption tokens.  These tokens carry the original list query and the position
+// of the last record returned, allowing any handler sharing the signing key to continue the
+// listing without keeping state in memory.
+//
+
+package oaipmh
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "strings"
+    "time"
+)
+
+// Error returned when a stateless token cannot be decoded
+var errBadStatelessToken = errors.New("Invalid stateless resumption token")
+
+
+// The arguments of a list verb request
+type listQuery struct {
+    Set             string              `json:"s,omitempty"`
+    Prefix          string              `json:"p"`
+    From            time.Time           `json:"f"`
+    Until           time.Time           `json:"u"`
+}
+
+// The state held by a stateless resumption token
+type statelessToken struct {
+    listQuery
+
+    // The datestamp and ID of the last record returned
+    LastDate        time.Time           `json:"d"`
+    LastID          string              `json:"i"`
+}
+
+// Encodes and signs the token
+func (st *statelessToken) Encode(key []byte) (string, error) {
+    payload, err := json.Marshal(st)
+    if (err != nil) {
+        return "", err
+    }
+
+    enc := base64.RawURLEncoding
+    return enc.EncodeToString(payload) + "." + enc.EncodeToString(signToken(payload, key)), nil
+}
+
+// Decodes a stateless token, verifying the signature
+func decodeStatelessToken(token string, key []byte) (*statelessToken, error) {
+    parts := strings.Split(token, ".")
+    if (len(parts) != 2) {
+        return nil, errBadStatelessToken
+    }
+
+    enc := base64.RawURLEncoding
+    payload, err := enc.DecodeString(parts[0])
+    if (err != nil) {
+        return nil, errBadStatelessToken
+    }
+    sig, err := enc.DecodeString(parts[1])
+    if (err != nil) || !hmac.Equal(sig, signToken(payload, key)) {
+        return nil, errBadStatelessToken
+    }
+
+    st := &statelessToken{}
+    if err := json.NewDecoder(bytes.NewReader(payload)).Decode(st) ; err != nil {
+        return nil, errBadStatelessToken
+    }
+    return st, nil
+}
+
+// Returns the signature of the token payload
+func signToken(payload []byte, key []byte) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write(payload)
+    return mac.Sum(nil)
+}
+
+// Moves the cursor past the record with the given datestamp and ID.  This relies on the
+// cursor returning records ordered by datestamp, then ID.
+func skipPastRecord(cursor RecordCursor, lastDate time.Time, lastID string) {
+    for cursor.HasRecord() {
+        rec := cursor.Record()
+        if rec.Date.After(lastDate) || (rec.Date.Equal(lastDate) && (rec.ID > lastID)) {
+            return
+        }
+        cursor.Next()
+    }
+}
@@ -0,0 +1,212 @@
+// Streaming decoder for ListRecords responses
+//
+
+package oaipmh
+
+import (
+    "context"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/url"
+)
+
+// Returns a list of records which is decoded one record at a time from the response.  Unlike
+// ListRecords, only the current record is held in memory.
+func (c *Client) StreamRecords(listArgs ListArgs) (*StreamingRecordsIterator, error) {
+    return c.StreamRecordsContext(context.Background(), listArgs)
+}
+
+// Like StreamRecords, but the iterator stops reading records when the context is cancelled.
+func (c *Client) StreamRecordsContext(ctx context.Context, listArgs ListArgs) (*StreamingRecordsIterator, error) {
+    return c.startStream(ctx, listArgs.values())
+}
+
+// Resumes a streamed list of records from a resumption token returned by a previous ListRecords
+// request.
+func (c *Client) ResumeStreamRecords(resToken string) (*StreamingRecordsIterator, error) {
+    return c.ResumeStreamRecordsContext(context.Background(), resToken)
+}
+
+// Like ResumeStreamRecords, but the iterator stops reading records when the context is cancelled.
+func (c *Client) ResumeStreamRecordsContext(ctx context.Context, resToken string) (*StreamingRecordsIterator, error) {
+    return c.startStream(ctx, url.Values{ "resumptionToken": {resToken} })
+}
+
+// Requests the first page of a stream and reads up to the first record, so that errors returned
+// by the provider are reported when the stream is started.
+func (c *Client) startStream(ctx context.Context, vals url.Values) (*StreamingRecordsIterator, error) {
+    sr := &StreamingRecordsIterator{ client: c, ctx: ctx, listSize: -1 }
+    err := sr.open(vals)
+    if (err != nil) {
+        return nil, err
+    }
+
+    sr.pending, err = sr.nextRecord()
+    if (err != nil) {
+        sr.Close()
+        return nil, err
+    } else if (sr.pending == nil) {
+        sr.Close()
+    }
+
+    return sr, nil
+}
+
+// -----------------------------------------------------------------------------------------
+// Streaming ListRecords iterator
+
+// An iterator for a list records response which decodes each record as it is read from the
+// response body.  The next page is only requested once the body of the current page has been
+// exhausted.  Requests for each page are retried according to the retry policy of the client,
+// but an error while reading a page is returned as is, since the records read so far cannot
+// be taken back.
+//
+// The iterator must be closed if it is not read to the end.
+type StreamingRecordsIterator struct {
+    client          *Client
+    ctx             context.Context
+    body            io.ReadCloser
+    dec             *xml.Decoder
+    resToken        string
+    pageToken       string
+    listSize        int
+    record          *OaipmhRecord
+    pending         *OaipmhRecord
+}
+
+// Returns the next record, if one is present.  If no more records are present, the second
+// return value will be a ENoMore result.  Otherwise, the error will be something else.
+func (sr *StreamingRecordsIterator) Next() error {
+    if (sr.pending != nil) {
+        sr.record, sr.pending = sr.pending, nil
+        return nil
+    }
+
+    for {
+        if (sr.dec == nil) {
+            if (sr.resToken == "") {
+                return ENoMore{}
+            }
+
+            err := sr.open(url.Values{ "resumptionToken": {sr.resToken} })
+            if (err != nil) {
+                return err
+            }
+        }
+
+        rec, err := sr.nextRecord()
+        if (err != nil) {
+            sr.Close()
+            return err
+        } else if (rec != nil) {
+            sr.record = rec
+            return nil
+        }
+
+        // The page has been exhausted
+        sr.Close()
+    }
+}
+
+// Returns the current header.  If Next() returns nil, this is guaranteed to be set.
+func (sr *StreamingRecordsIterator) Header() (*OaipmhHeader, error) {
+    if (sr.record != nil) {
+        return &(sr.record.Header), nil
+    } else {
+        return nil, fmt.Errorf("Next() was not called first")
+    }
+}
+
+// Returns the current record.  Either returns the record, or an error if there was a
+// problem retrieving the record.  The record may be retrieved on demand if necessary.
+func (sr *StreamingRecordsIterator) Record() (*OaipmhRecord, error) {
+    if (sr.record != nil) {
+        return sr.record, nil
+    } else {
+        return nil, fmt.Errorf("Next() was not called first")
+    }
+}
+
+// Returns the complete list size advertised by the provider, or -1 if the provider has
+// not advertised it.  As the resumption token appears after the records, this is only known
+// once the first page has been read.
+func (sr *StreamingRecordsIterator) CompleteListSize() int {
+    return sr.listSize
+}
+
+// Returns the resumption token used to fetch the current page.
+func (sr *StreamingRecordsIterator) PageToken() string {
+    return sr.pageToken
+}
+
+// Closes the body of the current page.
+func (sr *StreamingRecordsIterator) Close() error {
+    if (sr.body == nil) {
+        return nil
+    }
+
+    err := sr.body.Close()
+    sr.body = nil
+    sr.dec = nil
+    return err
+}
+
+// Requests a page of records
+func (sr *StreamingRecordsIterator) open(val url.Values) error {
+    body, err := sr.client.open(sr.ctx, "ListRecords", val)
+    if (err != nil) {
+        return err
+    }
+
+    sr.body = body
+    sr.dec = xml.NewDecoder(body)
+    sr.resToken = ""
+    sr.pageToken = val.Get("resumptionToken")
+    return nil
+}
+
+// Reads the next record from the current page.  Returns nil if there are no more records
+// on the page.  The resumption token is recorded as it is encountered.
+func (sr *StreamingRecordsIterator) nextRecord() (*OaipmhRecord, error) {
+    for {
+        tok, err := sr.dec.Token()
+        if (err == io.EOF) {
+            return nil, nil
+        } else if (err != nil) {
+            if (sr.ctx.Err() != nil) {
+                return nil, sr.ctx.Err()
+            }
+            return nil, err
+        }
+
+        start, isStart := tok.(xml.StartElement)
+        if !isStart {
+            continue
+        }
+
+        switch start.Name.Local {
+        case "record":
+            rec := new(OaipmhRecord)
+            if err := sr.dec.DecodeElement(rec, &start) ; err != nil {
+                return nil, err
+            }
+            return rec, nil
+        case "resumptionToken":
+            token := new(OaipmhResumptionToken)
+            if err := sr.dec.DecodeElement(token, &start) ; err != nil {
+                return nil, err
+            }
+            sr.resToken = token.String()
+            if size := token.ListSize() ; size != -1 {
+                sr.listSize = size
+            }
+        case "error":
+            oaiErr := new(OaipmhError)
+            if err := sr.dec.DecodeElement(oaiErr, &start) ; err != nil {
+                return nil, err
+            }
+            return nil, EOaipmhError{oaiErr.Code, oaiErr.Message}
+        }
+    }
+}
@@ -0,0 +1,125 @@
+// Storage of resumption tokens issued by the HTTP handler.
+//
+
+package oaipmh
+
+import (
+    "sync"
+    "time"
+
+    "github.com/nu7hatch/gouuid"
+)
+
+// The default length of time a resumption token remains valid.
+var DefaultResumptionTokenTTL time.Duration = 1 * time.Hour
+
+
+// A store of resumption tokens.  Implementations must be safe to use from multiple
+// goroutines.
+type ResumptionTokenStore interface {
+
+    // Stores the cursor and returns a new resumption token which can be used to retrieve
+    // it again.
+    Put(cursor RecordCursor) (*ResumptionToken, error)
+
+    // Removes and returns the resumption token with the given ID.  Returns nil if no such
+    // token exists or if the token has expired.
+    Take(id string) *ResumptionToken
+}
+
+// ------------------------------------------------------------------------------
+// Resumption token
+
+type ResumptionToken struct {
+    // The token ID
+    ID          string
+
+    // The time the token was created
+    Created     time.Time
+
+    // The time the token expires
+    Expires     time.Time
+
+    // The cursor
+    Cursor      RecordCursor
+}
+
+// Creates a new resumption token which will expire after the given duration
+func NewResumptionToken(cursor RecordCursor, ttl time.Duration) *ResumptionToken {
+    id, _ := uuid.NewV4()
+    now := time.Now()
+    return &ResumptionToken{id.String(), now, now.Add(ttl), cursor}
+}
+
+// Returns true if the token has expired
+func (rt *ResumptionToken) Expired(now time.Time) bool {
+    return now.After(rt.Expires)
+}
+
+// ------------------------------------------------------------------------------
+// In-memory resumption token store
+
+// A resumption token store which keeps the tokens in memory.  Expired tokens are
+// evicted whenever a new token is stored.
+type MemoryResumptionTokenStore struct {
+    // The length of time a token remains valid
+    TTL         time.Duration
+
+    mutex       sync.Mutex
+    tokens      map[string]*ResumptionToken
+}
+
+// Creates a new in-memory resumption token store
+func NewMemoryResumptionTokenStore(ttl time.Duration) *MemoryResumptionTokenStore {
+    return &MemoryResumptionTokenStore{
+        TTL: ttl,
+        tokens: make(map[string]*ResumptionToken),
+    }
+}
+
+// Stores the cursor and returns a new resumption token
+func (ms *MemoryResumptionTokenStore) Put(cursor RecordCursor) (*ResumptionToken, error) {
+    rt := NewResumptionToken(cursor, ms.TTL)
+
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    ms.evictExpired(rt.Created)
+    ms.tokens[rt.ID] = rt
+    return rt, nil
+}
+
+// Removes and returns the resumption token with the given ID
+func (ms *MemoryResumptionTokenStore) Take(id string) *ResumptionToken {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    rt, hasRt := ms.tokens[id]
+    if (!hasRt) {
+        return nil
+    }
+    delete(ms.tokens, id)
+
+    if (rt.Expired(time.Now())) {
+        return nil
+    }
+    return rt
+}
+
+// Returns the number of tokens in the store, including those which have expired but have
+// not been evicted yet.
+func (ms *MemoryResumptionTokenStore) Len() int {
+    ms.mutex.Lock()
+    defer ms.mutex.Unlock()
+
+    return len(ms.tokens)
+}
+
+// Removes all the expired tokens.  Must be called with the mutex held.
+func (ms *MemoryResumptionTokenStore) evictExpired(now time.Time) {
+    for id, rt := range ms.tokens {
+        if (rt.Expired(now)) {
+            delete(ms.tokens, id)
+        }
+    }
+}
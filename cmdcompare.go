@@ -78,7 +78,7 @@ func (sc *CompareCommand) expectedLister() PresenceLister {
     } else {
         listArgs := sc.genListIdentifierArgsFromCommandLine()
         return func(callback func(urn string, isLive bool) bool) error {
-            return sc.Ctx.Session.ListIdentifiers(listArgs, *(sc.firstResult), *(sc.maxResults), func(hr *HeaderResult) bool {
+            return sc.Ctx.Session.ListIdentifiers(sc.Ctx.RunContext, listArgs, *(sc.firstResult), *(sc.maxResults), func(hr *HeaderResult) bool {
                 return callback(hr.Identifier(), !hr.Deleted)
             })
         }
@@ -94,7 +94,7 @@ func (sc *CompareCommand) comparisonLister() PresenceLister {
     } else {
         listArgs := sc.genListIdentifierArgsFromCommandLine()
         return func(callback func(urn string, isLive bool) bool) error {
-            return sc.OtherSession.ListIdentifiers(listArgs, *(sc.firstResult), *(sc.maxResults), func(hr *HeaderResult) bool {
+            return sc.OtherSession.ListIdentifiers(sc.Ctx.RunContext, listArgs, *(sc.firstResult), *(sc.maxResults), func(hr *HeaderResult) bool {
                 return callback(hr.Identifier(), !hr.Deleted)
             })
         }
@@ -133,13 +133,13 @@ func (sc *CompareCommand) UrnPresentInBothProviders(urn string) {
 
     // Compare both records if in comparison mode
     if *sc.compareContent {
-        thisRec, err := sc.Ctx.Session.GetRecord(urn)
+        thisRec, err := sc.Ctx.Session.GetRecord(sc.Ctx.RunContext, urn)
         if err != nil {
             fmt.Println("E ", urn)
             sc.errors++
         }
 
-        otherRec, err := sc.OtherSession.GetRecord(urn)
+        otherRec, err := sc.OtherSession.GetRecord(sc.Ctx.RunContext, urn)
         if err != nil {
             fmt.Println("E ", urn)
             sc.errors++
@@ -176,7 +176,11 @@ func (sc *CompareCommand) Run(args []string) {
     // Connect to the other OAIPMH session
     sc.OtherProvider = sc.Ctx.Config.LookupProvider(args[0])
     if (sc.OtherProvider != nil) {
-        sc.OtherSession = NewOaipmhSession(sc.OtherProvider.Url, *prefix)
+        otherSession, err := sc.OtherProvider.NewSession(*prefix)
+        if (err != nil) {
+            Die("Could not log into provider %s: %s", args[0], err.Error())
+        }
+        sc.OtherSession = otherSession
     } else {
         Die("Could not log into provider %s", args[0])
     }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ---------------------------------------------------------------------------------------------------
+// Formats command
+//      Lists the metadata formats supported by the provider.
+
+type FormatsCommand struct {
+	Ctx        *Context
+	identifier *string
+}
+
+func (fc *FormatsCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	fc.identifier = fs.String("i", "", "Only list formats available for this record identifier")
+	return fs
+}
+
+func (fc *FormatsCommand) Run(args []string) {
+	formats, err := fc.Ctx.Session.ListMetadataFormats(fc.Ctx.RunContext, *(fc.identifier))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "oaipmh: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	for _, format := range formats {
+		fmt.Printf("%s\n", format.Prefix)
+		fmt.Printf("   Schema:     %s\n", format.Schema)
+		fmt.Printf("   Namespace:  %s\n", format.Namespace)
+	}
+}
@@ -87,7 +87,7 @@ func (gc *GetCommand) displayRecord(id string) {
         fmt.Printf("%s\n", *(gc.separator))
     }
 
-    resp, err := gc.Ctx.Session.GetRecord(id)
+    resp, err := gc.Ctx.Session.GetRecord(gc.Ctx.RunContext, id)
     if (err == nil) {
         if *(gc.test) {
             fmt.Printf("+ %s\n", resp.Header.Identifier)
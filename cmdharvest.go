@@ -4,30 +4,46 @@ package main
 import (
     "fmt"
     "os"
-    "os/exec"
     "path"
     "flag"
     "time"
     "path/filepath"
     "log"
+    "strings"
+
+    "github.com/lmika/oaipmh/client"
 )
 
 
 // ---------------------------------------------------------------------------------------------------
 // Harvest commands
-//      Extract the records from a provider and store them in a directory.
+//      Extract the records from a provider and store them in a directory, or in a file of
+//      one of the output formats.
 
 type HarvestCommand struct {
     Ctx                 *Context
     dryRun              *bool
     listAndGet          *bool
+    partitionBy         *string
+    prefixList          *string
+    prefixes            []string
     compressDirs        *bool
+    archiveFormat       *string
+    outputFormat        *string
     setName             *string
     beforeDate          *string
     afterDate           *string
     fromFile            *string
+    incrementalDir      *string
+    applyDeletions      *bool
+    tombstoneDir        *string
+    resumeDir           *string
+    failuresFile        *string
     filenameFilter      *string
     filenameFilterAst   RSExprAst
+    layoutTemplate      *string
+    layout              *OutputLayout
+    outputDir           *string
     firstResult         *int
     maxResults          *int
     maxDirSize          *int
@@ -35,6 +51,33 @@ type HarvestCommand struct {
     dirPrefix           string
     recordCount         int
     lastDirId           int
+    progress            *ProgressReporter
+    errorCount          int
+    unavailableCount    int
+    deletedCount        int
+    failures            *FailureLog
+
+    // Counts of the changes to the records of the directory layout, and the file they are written to
+    newCount            int
+    changedCount        int
+    unchangedCount      int
+    changesFile         *string
+    changeset           *Changeset
+    sink                RecordSink
+    outputFile          string
+    manifest            *Manifest
+    archive             RecordArchive
+    archiveSize         int64
+    lastDatestamp       time.Time
+
+    // The checkpoint of a ListRecords harvest, and the number of results before it was resumed
+    checkpoint          *Checkpoint
+    resumedResults      int
+
+    // The state of an incremental harvest, and the granularity supported by the provider
+    state               *HarvestState
+    stateFile           string
+    granularity         string
 }
 
 // Get list identifier arguments
@@ -52,23 +95,70 @@ func (lc *HarvestCommand) genListIdentifierArgsFromCommandLine() ListIdentifierA
         Set: set,
         From: parseDateString(*(lc.afterDate)),
         Until: parseDateString(*(lc.beforeDate)),
+        Granularity: lc.granularity,
+    }
+
+    // Incremental harvests start from the high-water mark unless a date is given
+    if (lc.state != nil) && (args.From == nil) {
+        args.From = lc.state.From()
     }
 
     return args
 }
 
+// Returns the metadata prefix used to identify the harvest in the harvest state.  This is the list
+// of prefixes when harvesting more than one.
+func (lc *HarvestCommand) prefixName() string {
+    if (len(lc.prefixes) > 0) {
+        return strings.Join(lc.prefixes, ",")
+    }
+    return lc.Ctx.Session.Prefix()
+}
+
+// Returns the layout of the records.  Unless a layout is given, records are stored in numbered
+// directories, or directly in the directory of an incremental harvest.  When harvesting more than
+// one prefix, the formats of a record are stored side by side.
+func (lc *HarvestCommand) outputLayout() *OutputLayout {
+    template := *(lc.layoutTemplate)
+    if (template == "") {
+        template = DefaultLayout
+        if (lc.state != nil) {
+            template = DefaultIncrementalLayout
+        }
+        if (len(lc.prefixes) > 0) {
+            template = strings.TrimSuffix(template, ".xml") + ".{prefix}.xml"
+        }
+    }
+
+    layout, err := ParseOutputLayout(template)
+    if (err != nil) {
+        log.Fatal(err)
+    } else if (len(lc.prefixes) > 0) && !layout.Has("prefix") {
+        log.Fatal("The layout must include {prefix} when harvesting several prefixes")
+    }
+    return layout
+}
+
+// Returns the key of the record in the manifest.  When harvesting more than one prefix, this is
+// the identifier followed by a space and the prefix.
+func (lc *HarvestCommand) manifestKey(res *RecordResult) string {
+    if (len(lc.prefixes) > 0) {
+        return res.Identifier() + " " + res.Prefix
+    }
+    return res.Identifier()
+}
+
 // Returns the name of directory given the directory ID
 func (lc *HarvestCommand) dirName(dirId int) string {
     return fmt.Sprintf("%s/%02d", lc.dirPrefix, dirId)
 }
 
 // Saves the record
-func (lc *HarvestCommand) saveRecordToDir(dirId int, res *RecordResult) {
-    dir := lc.dirName(dirId)
-
+func (lc *HarvestCommand) saveRecordToDir(dirId int, res *RecordResult) error {
     // The filename to use.  If there's a filter, execute it and use the returned string
     // as the filename.  Otherwise, simply use the records URN
     var resId = res.Identifier()
+    var resKey = lc.manifestKey(res)
     var filename string = resId
 
     if lc.filenameFilterAst != nil {
@@ -82,70 +172,280 @@ func (lc *HarvestCommand) saveRecordToDir(dirId int, res *RecordResult) {
         }
     }
 
-    // Escape filenames to avoid invalid characters such as '/' causing
-    // potential file naming problems.
-    fileBaseName := EscapeIdForFilename(filename)
-    if fileBaseName == "" {
+    if filename == "" {
         log.Println("warn: using file basename '__empty__' for record with an empty identifier")
-        fileBaseName = "__empty__"
+        filename = "__empty__"
     }
 
-    outFile := filepath.Join(dir, fileBaseName + ".xml")
+    // The layout escapes the filename to avoid invalid characters such as '/' causing
+    // potential file naming problems.
+    layoutPath := lc.layout.Path(LayoutValues{ Dir: path.Base(lc.dirName(dirId)), Name: filename, Record: res })
+
+    hash := ContentHash(res.Content)
+    prevFile, hasPrev := lc.manifest.Path(resKey)
+
+    var relFile string
+    if lc.archiving() {
+        var err error
+        if relFile, err = lc.saveRecordToArchive(dirId, layoutPath, resKey, res) ; err != nil {
+            return err
+        }
+    } else {
+        relFile = filepath.FromSlash(layoutPath)
+        outFile := filepath.Join(lc.dirPrefix, relFile)
+
+        if err := lc.checkFileOwner(resKey, relFile) ; err != nil {
+            return err
+        }
+
+        // Records which have not changed since they were last harvested are not written again
+        if hasPrev && (prevFile == relFile) && (lc.manifest.Hash(resKey) == hash) && fileExists(outFile) {
+            lc.unchangedCount++
+            return nil
+        }
+
+        os.MkdirAll(filepath.Dir(outFile), 0755)
+
+        file, err := os.Create(outFile)
+        if err != nil {
+            panic(err)
+        }
+        defer file.Close()
+
+        file.WriteString(res.Content)
+    }
 
-    os.MkdirAll(dir, 0755)
+    if hasPrev {
+        lc.changedCount++
+        lc.addChange(ChangedChange, resId, relFile)
+    } else {
+        lc.newCount++
+        lc.addChange(NewChange, resId, relFile)
+    }
 
-    file, err := os.Create(outFile)
-    if err != nil {
-        panic(err)
+    // Record the file in the manifest, removing the previous file of the record if it has moved
+    if hasPrev && (prevFile != relFile) && !IsArchivedPath(prevFile) {
+        if err := lc.removeRecordFile(prevFile) ; err != nil {
+            log.Printf("%s: cannot remove %s: %s\n", resId, prevFile, err.Error())
+        }
+    }
+    if err := lc.manifest.Set(resKey, relFile, hash) ; err != nil {
+        log.Printf("ERROR: cannot write manifest: %s\n", err)
     }
-    defer file.Close()
+    return nil
+}
 
-    file.WriteString(res.Content)
+// Returns an error if the file is that of another record, as happens when the filename filter
+// returns the same name for different records.  The file of the other record is not replaced.
+func (lc *HarvestCommand) checkFileOwner(resKey string, relFile string) error {
+    if owner, hasOwner := lc.manifest.Owner(relFile) ; hasOwner && (owner != resKey) {
+        return fmt.Errorf("%s is already the file of %s", relFile, owner)
+    }
+    return nil
 }
 
-// Close the current directory before creating and writing to a new one
-func (lc *HarvestCommand) closeDir(dirId int) {
-    // Do nothing if this is a dry run
-    if *(lc.dryRun) {
+// Adds a change to the changeset, if one is being written
+func (lc *HarvestCommand) addChange(change string, resId string, relFile string) {
+    if (lc.changeset == nil) {
         return
     }
+    if err := lc.changeset.Add(change, resId, relFile) ; err != nil {
+        log.Printf("ERROR: cannot write changeset: %s\n", err)
+    }
+}
 
-    dir := lc.dirName(dirId)
-    if *(lc.compressDirs) {
-        base := path.Base(dir)
-        parent := path.Dir(dir)
+// Records the datestamp of a harvested or deleted record.
+func (lc *HarvestCommand) observeDatestamp(datestamp time.Time) {
+    if datestamp.After(lc.lastDatestamp) {
+        lc.lastDatestamp = datestamp
+    }
+    if (lc.state != nil) {
+        lc.state.Observe(datestamp)
+    }
+}
 
-        if (lc.Ctx.LogLevel >= TraceLogLevel) {
-            log.Printf("Compressing %s -> %s", base, dir + ".zip")
+// Applies the deletion of a record by removing the file previously written for it.  If a tombstone
+// directory is set, the file is moved there instead.
+func (lc *HarvestCommand) applyDeletion(res *RecordResult) {
+    resId := res.Identifier()
+    relFile, hasFile := lc.manifest.Path(lc.manifestKey(res))
+    if !hasFile {
+        if (lc.Ctx.LogLevel >= DebugLogLevel) {
+            log.Printf("%s: deleted, but was never harvested\n", resId)
         }
+        return
+    }
+
+    if (lc.Ctx.LogLevel >= DebugLogLevel) {
+        log.Printf("%s: deleted, removing %s\n", resId, relFile)
+    }
+    if err := lc.removeRecordFile(relFile) ; err != nil {
+        log.Printf("%s: cannot remove %s: %s\n", resId, relFile, err.Error())
+        return
+    }
+    if err := lc.manifest.Remove(lc.manifestKey(res)) ; err != nil {
+        log.Printf("ERROR: cannot write manifest: %s\n", err)
+    }
+    lc.addChange(DeletedChange, resId, relFile)
+}
+
+// Removes, or moves to the tombstone directory, a file written for a record.  Files moved to the
+// tombstone directory keep their path relative to the harvest directory.
+func (lc *HarvestCommand) removeRecordFile(relFile string) error {
+    if IsArchivedPath(relFile) {
+        return fmt.Errorf("the record is in an archive")
+    }
+
+    file := filepath.Join(lc.dirPrefix, relFile)
+    if *(lc.tombstoneDir) == "" {
+        return os.Remove(file)
+    }
+
+    tombstoneFile := filepath.Join(*(lc.tombstoneDir), relFile)
+    if err := os.MkdirAll(filepath.Dir(tombstoneFile), 0755) ; err != nil {
+        return err
+    }
+    return os.Rename(file, tombstoneFile)
+}
+
+// Returns true if the record has already been saved into the harvest directory with the same
+// content.  This is always false for single file outputs, which do not have a manifest.
+func (lc *HarvestCommand) harvestedBefore(res *RecordResult) bool {
+    if (lc.manifest == nil) || res.Deleted {
+        return false
+    }
+
+    resKey := lc.manifestKey(res)
+    relFile, hasFile := lc.manifest.Path(resKey)
+    if (! hasFile) || (lc.manifest.Hash(resKey) != ContentHash(res.Content)) {
+        return false
+    }
 
-        cmd := exec.Command("zip", "-m", "-r", base + ".zip", base)
-        cmd.Dir = parent
-        err := cmd.Start()
+    // Records in archives are kept if the archive was finalised, or is the archive recovered from
+    // the checkpoint
+    if IsArchivedPath(relFile) {
+        relArchive := strings.SplitN(filepath.ToSlash(relFile), "/", 2)[0]
+        return fileExists(filepath.Join(lc.dirPrefix, relArchive)) || ((lc.archive != nil) && (filepath.Base(lc.archive.Filename()) == relArchive))
+    }
+    return fileExists(filepath.Join(lc.dirPrefix, relFile))
+}
+
+// Returns true if records are to be written into archives instead of directories.  Incremental
+// harvests are never archived, as records are replaced in place.
+func (lc *HarvestCommand) archiving() bool {
+    return *(lc.compressDirs) && (lc.state == nil)
+}
+
+// Saves the record into the archive of the directory, creating the archive if necessary.  The name
+// is the path of the record within the archive.  Returns the path of the record within the archive,
+// relative to the harvest directory.
+func (lc *HarvestCommand) saveRecordToArchive(dirId int, name string, resKey string, res *RecordResult) (string, error) {
+    dir := lc.dirName(dirId)
+    if (lc.archive == nil) {
+        os.MkdirAll(lc.dirPrefix, 0755)
+
+        archive, err := NewRecordArchive(*(lc.archiveFormat), dir)
         if (err != nil) {
-            fmt.Fprintf(os.Stderr, "Cannot compress '%s'\n", dir)
+            log.Fatal("Cannot create archive: ", err)
+        }
+        lc.archive = archive
+
+        if (lc.Ctx.LogLevel >= TraceLogLevel) {
+            log.Printf("Archiving %s -> %s", path.Base(dir), archive.Filename())
         }
     }
+
+    relArchive, _ := filepath.Rel(lc.dirPrefix, lc.archive.Filename())
+    relFile := path.Join(filepath.ToSlash(relArchive), name)
+    if err := lc.checkFileOwner(resKey, relFile) ; err != nil {
+        return "", err
+    }
+
+    if err := lc.archive.Add(name, res.Header.DateStamp, res.Content) ; err != nil {
+        log.Fatal("Cannot write to archive: ", err)
+    }
+    return relFile, nil
 }
 
-func (lc *HarvestCommand) saveRecord(res *RecordResult) {
-    lc.recordCount++
-    dirId := (lc.recordCount / *(lc.maxDirSize)) + 1
-    if (dirId != lc.lastDirId) {
-        lc.closeDir(lc.lastDirId)
-        lc.lastDirId = dirId
+// Close the current directory before creating and writing to a new one.  If records are
+// being archived, this finalises the archive.
+func (lc *HarvestCommand) closeDir(dirId int) {
+    // Do nothing if this is a dry run or nothing was archived
+    if *(lc.dryRun) || (lc.archive == nil) {
+        return
     }
 
-    if (lc.Ctx.LogLevel >= DebugLogLevel) {
-        log.Printf("%8d  %s\n", lc.recordCount, res.Identifier())
+    if err := lc.archive.Close() ; err != nil {
+        fmt.Fprintf(os.Stderr, "Cannot finalise archive '%s': %s\n", lc.archive.Filename(), err.Error())
     }
-    if ((lc.recordCount % 1000) == 0) {
-        log.Printf("Harvested %d records\n", lc.recordCount)
+    lc.archive = nil
+}
+
+func (lc *HarvestCommand) saveRecord(res *RecordResult) {
+    // Records harvested before the checkpoint are listed again if the resumption token has expired
+    if lc.Ctx.Session.Relisted() && lc.harvestedBefore(res) {
+        return
+    }
+
+    if (res.Deleted) {
+        lc.deletedCount++
+    } else {
+        lc.recordCount++
+        if (lc.Ctx.LogLevel >= DebugLogLevel) {
+            log.Printf("%8d  %s\n", lc.recordCount, res.Identifier())
+        }
+        lc.progress.Update(lc.recordCount)
     }
 
+    lc.observeDatestamp(res.Header.DateStamp)
+
     if (! *(lc.dryRun)) {
-        lc.saveRecordToDir(dirId, res)
+        if err := lc.sink.Write(res) ; err != nil {
+            lc.OnError(fmt.Errorf("%s: cannot write record: %s", res.Identifier(), err.Error()))
+        }
+    }
+}
+
+// Opens the sink of the output format.  Single file outputs are written into the harvest
+// directory, and are named after the time the harvest was started.
+func (lc *HarvestCommand) openSink(started string) {
+    if (*(lc.outputFormat) == DirOutput) {
+        manifest, err := OpenManifest(lc.dirPrefix)
+        if (err != nil) {
+            log.Fatal("Cannot read manifest: ", err)
+        }
+        lc.manifest = manifest
+        lc.sink = dirRecordSink{lc}
+
+        if (*(lc.changesFile) != "") {
+            // A resumed harvest adds to the changeset of the interrupted harvest
+            createFn := CreateChangeset
+            if (*(lc.resumeDir) != "") {
+                createFn = AppendChangeset
+            }
+            changeset, err := createFn(*(lc.changesFile))
+            if (err != nil) {
+                log.Fatal("Cannot create changeset: ", err)
+            }
+            lc.changeset = changeset
+        }
+        return
+    }
+
+    if (lc.outputFile == "") {
+        ext, _ := OutputExtension(*(lc.outputFormat))
+        lc.outputFile = filepath.Join(lc.dirPrefix, started + ext)
     }
+
+    os.MkdirAll(lc.dirPrefix, 0755)
+    sink, err := NewFileRecordSink(*(lc.outputFormat), lc.outputFile)
+    if (err != nil) {
+        log.Fatal("Cannot open output: ", err)
+    }
+    if recorder, isRecorder := sink.(oaipmh.ResponseRecorder) ; isRecorder {
+        lc.Ctx.Session.SetRecorder(recorder)
+    }
+    lc.sink = sink
 }
 
 
@@ -156,16 +456,382 @@ func (lc *HarvestCommand) OnRecord(rr *RecordResult) {
 }
 
 func (lc *HarvestCommand) OnError(err error) {
+    if recErr, isRecErr := err.(RecordError) ; isRecErr {
+        // Records which are not available in one of the prefixes are reported, but are not errors
+        if recErr.Unavailable() {
+            lc.unavailableCount++
+            log.Printf("%s: not available in %s\n", recErr.Identifier, recErr.Prefix)
+            return
+        }
+
+        if (lc.failures != nil) {
+            if err2 := lc.failures.Add(recErr.Identifier, recErr.Err) ; err2 != nil {
+                log.Printf("ERROR: cannot write failures: %s\n", err2)
+            }
+        }
+    }
+
+    lc.errorCount++
     log.Printf("ERROR: %s\n", err)
 }
 
 func (lc *HarvestCommand) OnCompleted(harvested int, skipped int, errors int) {
+    if (lc.unavailableCount > 0) {
+        errors -= lc.unavailableCount
+        log.Printf("%d records were not available in all prefixes", lc.unavailableCount)
+    }
+    if *(lc.applyDeletions) {
+        log.Printf("Finished: %d records harvested, %d records deleted, %d records skipped, %d errors", harvested - lc.deletedCount, lc.deletedCount, skipped, errors)
+        return
+    }
     log.Printf("Finished: %d records harvested, %d records skipped, %d errors", harvested, skipped, errors)
 }
 
+// -----------------------------------------------------------------------------------------
+// The directory layout
+//      A record sink which writes each record to a file in numbered directories of the
+//      harvest directory, or into an archive of each directory.  The file of each record
+//      is kept in the manifest.
+
+type dirRecordSink struct {
+    lc      *HarvestCommand
+}
+
+func (ds dirRecordSink) Write(rr *RecordResult) error {
+    lc := ds.lc
+    if (rr.Deleted) {
+        lc.applyDeletion(rr)
+        return nil
+    }
+
+    dirId := (lc.recordCount / *(lc.maxDirSize)) + 1
+    if (dirId != lc.lastDirId) {
+        lc.closeDir(lc.lastDirId)
+        lc.lastDirId = dirId
+    }
+
+    return lc.saveRecordToDir(dirId, rr)
+}
+
+func (ds dirRecordSink) Flush() (int64, error) {
+    // The archive is recovered up to its size at the checkpoint if the harvest is interrupted
+    if (ds.lc.archive != nil) {
+        size, err := ds.lc.archive.Flush()
+        if (err != nil) {
+            return 0, err
+        }
+        ds.lc.archiveSize = size
+    }
+
+    if (ds.lc.changeset != nil) {
+        if err := ds.lc.changeset.Flush() ; err != nil {
+            return 0, err
+        }
+    }
+    return 0, ds.lc.manifest.Flush()
+}
+
+func (ds dirRecordSink) Close() error {
+    lc := ds.lc
+    lc.closeDir(lc.lastDirId)
+
+    log.Printf("Changes: %d new, %d changed, %d unchanged, %d deleted", lc.newCount, lc.changedCount, lc.unchangedCount, lc.deletedCount)
+    if (lc.changeset != nil) {
+        if err := lc.changeset.Close() ; err != nil {
+            log.Printf("ERROR: cannot write changeset: %s\n", err)
+        }
+    }
+
+    // The manifest is truncated to its size at the checkpoint when the harvest is resumed, so it
+    // is not rewritten if the harvest can be resumed
+    if ((lc.recordCount > 0) || (lc.deletedCount > 0)) && !((lc.checkpoint != nil) && lc.incomplete()) {
+        return lc.manifest.Save()
+    }
+    return lc.manifest.Close()
+}
+
+// -----------------------------------------------------------------------------------------
+
+// Prepares an incremental harvest into the target directory.  This reads the state of the last
+// harvest and the date granularity supported by the provider.
+func (lc *HarvestCommand) startIncrementalHarvest(dir string, set string) {
+    session := lc.Ctx.Session
+
+    lc.stateFile = HarvestStateFilename(dir, session.Url(), set, lc.prefixName())
+    state, err := ReadHarvestState(lc.stateFile, session.Url(), set, lc.prefixName())
+    if (err != nil) {
+        log.Fatal("Cannot read harvest state: ", err)
+    }
+
+    ident, err := session.Identify(lc.Ctx.RunContext)
+    if (err != nil) {
+        log.Fatal("Cannot determine the granularity of the provider: ", err)
+    }
+
+    lc.state = state
+    lc.granularity = ident.Granularity
+    lc.dirPrefix = dir
+
+    if from := state.From() ; from != nil {
+        log.Printf("Harvesting records changed since %s", from.UTC().Format(time.RFC3339))
+    } else {
+        log.Printf("No previous harvest found: harvesting all records")
+    }
+}
+
+// Saves the high-water mark of an incremental harvest.  The state is only saved if the harvest
+// was completed without errors, as records are not necessarily returned in datestamp order, and
+// if no listing was stopped at the maximum number of records.
+func (lc *HarvestCommand) finishIncrementalHarvest() {
+    if *(lc.dryRun) {
+        return
+    } else if lc.incomplete() {
+        log.Printf("Harvest incomplete: the harvest state was not updated")
+        return
+    } else if lc.Ctx.Session.Truncated() {
+        log.Printf("Harvest stopped at the maximum number of records: the harvest state was not updated.  Use -c -1 to harvest all records")
+        return
+    }
+
+    lc.state.LastHarvested = time.Now().UTC()
+    os.MkdirAll(lc.dirPrefix, 0755)
+    if err := lc.state.Save(lc.stateFile) ; err != nil {
+        log.Printf("ERROR: cannot save harvest state: %s\n", err)
+    }
+}
+
+// Restores the state of an interrupted harvest from the checkpoint in the harvest directory.
+func (lc *HarvestCommand) resumeHarvest(dir string) {
+    if (*(lc.fromFile) != "") || *(lc.listAndGet) {
+        log.Fatal("Only harvests using ListRecords can be resumed")
+    }
+
+    cp, err := ReadCheckpoint(CheckpointFile(dir))
+    if (err != nil) {
+        log.Fatal("Cannot read checkpoint: ", err)
+    } else if (cp.Url != lc.Ctx.Session.Url()) || (cp.Prefix != lc.Ctx.Session.Prefix()) {
+        log.Fatalf("Checkpoint is for a harvest of %s with prefix %s", cp.Url, cp.Prefix)
+    }
+
+    if (cp.Incremental) {
+        lc.startIncrementalHarvest(dir, cp.Set)
+    }
+
+    // The records after the checkpoint will be harvested again, so anything written for them is
+    // removed.  Partial archives other than the archive of the checkpoint only hold these records.
+    var archiveFile string
+    if (cp.ArchiveFile != "") {
+        archiveFile = filepath.Join(dir, cp.ArchiveFile)
+    }
+    if err := removeArchivesAfterCheckpoint(dir, cp, archiveFile) ; err != nil {
+        log.Fatal("Cannot remove archives: ", err)
+    }
+    if (archiveFile != "") {
+        archive, err := RecoverRecordArchive(cp.Archive, archiveFile, cp.ArchiveSize)
+        if (err != nil) {
+            log.Fatal("Cannot recover archive: ", err)
+        }
+        lc.archive = archive
+    }
+    for filename, size := range map[string]int64{
+        cp.OutputFile: cp.OutputSize,
+        filepath.Join(dir, ManifestFilename): cp.ManifestSize,
+        cp.ChangesFile: cp.ChangesSize,
+    } {
+        if err := TruncateToCheckpoint(filename, size) ; err != nil {
+            log.Fatal("Cannot truncate output: ", err)
+        }
+    }
+
+    lc.checkpoint = cp
+    lc.resumedResults = cp.Results
+    lc.dirPrefix = dir
+    lc.recordCount = cp.RecordCount
+    lc.lastDirId = cp.LastDirId
+    lc.observeDatestamp(cp.LastDatestamp)
+    if (cp.Output != "") {
+        *(lc.outputFormat) = cp.Output
+        lc.outputFile = cp.OutputFile
+    }
+    if (cp.Layout != "") {
+        *(lc.layoutTemplate) = cp.Layout
+    }
+    if (cp.MaxDirSize > 0) {
+        *(lc.maxDirSize) = cp.MaxDirSize
+    }
+    if (cp.Archive != "") {
+        *(lc.compressDirs) = true
+        *(lc.archiveFormat) = cp.Archive
+    }
+    if (cp.ChangesFile != "") {
+        *(lc.changesFile) = cp.ChangesFile
+    }
+    lc.newCount = cp.NewCount
+    lc.changedCount = cp.ChangedCount
+    lc.unchangedCount = cp.UnchangedCount
+
+    log.Printf("Resuming harvest in %s after %d records", dir, cp.RecordCount)
+}
+
+// Removes the archives written after the checkpoint, other than the archive of the checkpoint.  These
+// are the partial archives, and the archives of the directories from the last directory of the
+// checkpoint which were finalised when the harvest was stopped.
+func removeArchivesAfterCheckpoint(dir string, cp *Checkpoint, archiveFile string) error {
+    if err := RemovePartialArchives(dir, archiveFile) ; err != nil {
+        return err
+    } else if (cp.Archive == "") {
+        return nil
+    }
+
+    ext, err := ArchiveExtension(cp.Archive)
+    if (err != nil) {
+        return err
+    }
+    for dirId := cp.LastDirId ; ; dirId++ {
+        filename := filepath.Join(dir, fmt.Sprintf("%02d%s", dirId, ext))
+        if (filename == archiveFile) {
+            continue
+        } else if (! fileExists(filename)) {
+            return nil
+        } else if err := os.Remove(filename) ; err != nil {
+            return err
+        }
+    }
+}
+
+// Starts checkpointing a ListRecords harvest after each page.
+func (lc *HarvestCommand) startCheckpoints(args ListIdentifierArgs) {
+    if (lc.checkpoint == nil) {
+        var archive string
+        if lc.archiving() {
+            archive = *(lc.archiveFormat)
+        }
+
+        lc.checkpoint = &Checkpoint{
+            Url:            lc.Ctx.Session.Url(),
+            Prefix:         lc.Ctx.Session.Prefix(),
+            Set:            args.Set,
+            From:           args.From,
+            Until:          args.Until,
+            Granularity:    args.Granularity,
+            FirstResult:    *(lc.firstResult),
+            MaxResults:     *(lc.maxResults),
+            Incremental:    lc.state != nil,
+            Output:         *(lc.outputFormat),
+            OutputFile:     lc.outputFile,
+            Layout:         *(lc.layoutTemplate),
+            Archive:        archive,
+            MaxDirSize:     *(lc.maxDirSize),
+            ChangesFile:    *(lc.changesFile),
+            LastDirId:      lc.lastDirId,
+        }
+    }
+
+    lc.checkpoint.OutputFile = lc.outputFile
+    os.MkdirAll(lc.dirPrefix, 0755)
+    lc.saveCheckpoint()
+    lc.Ctx.Session.SetPageFn(func(token string, results int) {
+        // The results of a listing issued again are counted from the start of the original query
+        if lc.Ctx.Session.Relisted() {
+            lc.resumedResults = 0
+        }
+        lc.checkpoint.ResumptionToken = token
+        lc.checkpoint.Results = lc.resumedResults + results
+        lc.saveCheckpoint()
+    })
+}
+
+// Saves the checkpoint after flushing the output, so that both reflect the records saved so far.
+func (lc *HarvestCommand) saveCheckpoint() {
+    lc.checkpoint.RecordCount = lc.recordCount
+    lc.checkpoint.LastDirId = lc.lastDirId
+    lc.checkpoint.LastDatestamp = lc.lastDatestamp
+    lc.checkpoint.NewCount = lc.newCount
+    lc.checkpoint.ChangedCount = lc.changedCount
+    lc.checkpoint.UnchangedCount = lc.unchangedCount
+
+    outputSize, err := lc.sink.Flush()
+    if (err != nil) {
+        log.Printf("ERROR: cannot write output: %s\n", err)
+    }
+    lc.checkpoint.OutputSize = outputSize
+    if (lc.manifest != nil) {
+        lc.checkpoint.ManifestSize = FileSize(filepath.Join(lc.dirPrefix, ManifestFilename))
+        lc.checkpoint.ChangesSize = FileSize(*(lc.changesFile))
+        lc.checkpoint.ArchiveFile, lc.checkpoint.ArchiveSize = "", 0
+        if (lc.archive != nil) {
+            lc.checkpoint.ArchiveFile = filepath.Base(lc.archive.Filename())
+            lc.checkpoint.ArchiveSize = lc.archiveSize
+        }
+    }
+    if err := lc.checkpoint.Save(CheckpointFile(lc.dirPrefix)) ; err != nil {
+        log.Printf("ERROR: cannot save checkpoint: %s\n", err)
+    }
+}
+
+// Returns true if the harvest was stopped or had errors.
+func (lc *HarvestCommand) incomplete() bool {
+    return (lc.errorCount > 0) || (lc.Ctx.RunContext.Err() != nil)
+}
+
+// Removes the checkpoint once the harvest has been completed.  If the harvest is incomplete, the
+// checkpoint is kept so that it can be resumed.
+func (lc *HarvestCommand) finishCheckpoints() {
+    if lc.incomplete() {
+        log.Printf("Harvest incomplete: use 'harvest -resume %s' to resume", lc.dirPrefix)
+        return
+    }
+
+    os.Remove(CheckpointFile(lc.dirPrefix))
+}
+
+// Splits the listing into partitions for a partitioned harvest.  Date partitions start from the
+// earliest datestamp of the provider, with one partition for each download worker.
+func (lc *HarvestCommand) partitions(args ListIdentifierArgs) []ListIdentifierArgs {
+    ctx := lc.Ctx.RunContext
+
+    switch *(lc.partitionBy) {
+    case "date":
+        ident, err := lc.Ctx.Session.Identify(ctx)
+        if (err != nil) {
+            log.Fatal("Cannot determine the earliest datestamp of the provider: ", err)
+        }
+
+        earliest, err := time.Parse(time.RFC3339, ident.EarliestDatestamp)
+        if (err != nil) {
+            earliest, err = time.Parse("2006-01-02", ident.EarliestDatestamp)
+        }
+        if (err != nil) {
+            log.Fatalf("Cannot parse the earliest datestamp '%s' of the provider", ident.EarliestDatestamp)
+        }
+
+        args.Granularity = ident.Granularity
+        return DatePartitions(args, earliest, *(lc.downloadWorkers))
+    case "set":
+        if (args.Set != "") {
+            log.Fatal("Cannot partition by set when harvesting a single set")
+        }
+
+        sets := make([]string, 0)
+        err := lc.Ctx.Session.ListSets(ctx, 0, -1, func(set oaipmh.OaipmhSet) bool {
+            sets = append(sets, set.Spec)
+            return true
+        })
+        if (err != nil) {
+            log.Fatal("Cannot list the sets of the provider: ", err)
+        } else if (len(sets) == 0) {
+            log.Fatal("The provider has no sets to partition by")
+        }
+        return SetPartitions(args, sets)
+    default:
+        log.Fatalf("Unsupported partitioning '%s': use date or set", *(lc.partitionBy))
+        return nil
+    }
+}
+
 // Harvest the records using a specific harvester
 func (lc *HarvestCommand) harvestWithHarvester(harvester Harvester) {
-    harvester.Harvest(lc)
+    harvester.Harvest(lc.Ctx.RunContext, lc)
 }
 
 // List the identifiers from a provider
@@ -173,6 +839,14 @@ func (lc *HarvestCommand) harvest() {
     var harvester Harvester
     args := lc.genListIdentifierArgsFromCommandLine()
 
+    // Deleted records are only passed through when applying deletions
+    var headGuard HeaderPredicate = LiveRecordsHeaderPredicate
+    var guard RecordPredicate = LiveRecordsPredicate
+    if *(lc.applyDeletions) {
+        headGuard = AllRecordsHeaderPredicate
+        guard = AllRecordsPredicate
+    }
+
     if *(lc.fromFile) != "" {
         // Setup a map-reduce queue for fetching responses in parallel
         harvester = &FileHarvester{
@@ -181,26 +855,70 @@ func (lc *HarvestCommand) harvest() {
             FirstResult:    *(lc.firstResult),
             MaxResults:     *(lc.maxResults),
             Workers:        *(lc.downloadWorkers),
-            Guard:          LiveRecordsPredicate,
+            Prefixes:       lc.prefixes,
+            Guard:          guard,
         }
     } else if *(lc.listAndGet) {
-        // Get the list and pass it to the getters in parallel
+        // Get the list and pass it to the getters in parallel.  The identifiers are listed in
+        // the first prefix.
+        if (len(lc.prefixes) > 0) {
+            args.Prefix = lc.prefixes[0]
+        }
         harvester = &ListAndGetRecordHarvester{
             Session:        lc.Ctx.Session,
             ListArgs:       args,
             FirstResult:    *(lc.firstResult),
             MaxResults:     *(lc.maxResults),
             Workers:        *(lc.downloadWorkers),
-            HarvestGuard:   LiveRecordsHeaderPredicate,
-            Guard:          LiveRecordsPredicate,
+            Prefixes:       lc.prefixes,
+            HarvestGuard:   headGuard,
+            Guard:          guard,
+        }
+    } else if (*(lc.partitionBy) != "") || (len(lc.prefixes) > 0) {
+        partitions := []ListIdentifierArgs{ args }
+        if (*(lc.partitionBy) != "") {
+            partitions = lc.partitions(args)
+        }
+        partitions = PrefixPartitions(partitions, lc.prefixes)
+        log.Printf("Harvesting %d partitions using %d workers", len(partitions), *(lc.downloadWorkers))
+        if (lc.Ctx.LogLevel >= DebugLogLevel) {
+            for _, part := range partitions {
+                until := "now"
+                if (part.Until != nil) {
+                    until = describeDate(part.Until)
+                }
+                log.Printf("Partition: prefix '%s', set '%s', from %s until %s\n", part.Prefix, part.Set, describeDate(part.From), until)
+            }
+        }
+
+        // The list sizes of each partition cannot be combined into a total
+        lc.Ctx.Session.SetListSizeFn(nil)
+
+        harvester = &PartitionedListRecordHarvester{
+            Session:        lc.Ctx.Session,
+            Partitions:     partitions,
+            FirstResult:    *(lc.firstResult),
+            MaxResults:     *(lc.maxResults),
+            Workers:        *(lc.downloadWorkers),
+            Deduplicate:    *(lc.partitionBy) == "set",
+            Guard:          guard,
         }
     } else {
+        firstResult, maxResults := *(lc.firstResult), *(lc.maxResults)
+        if (lc.checkpoint != nil) {
+            args = lc.checkpoint.ListArgs()
+            firstResult, maxResults = lc.checkpoint.RemainingResults()
+        }
+        if (! *(lc.dryRun)) {
+            lc.startCheckpoints(args)
+        }
+
         harvester = &ListRecordHarvester{
             Session:        lc.Ctx.Session,
             ListArgs:       args,
-            FirstResult:    *(lc.firstResult),
-            MaxResults:     *(lc.maxResults),
-            Guard:          LiveRecordsPredicate,
+            FirstResult:    firstResult,
+            MaxResults:     maxResults,
+            Guard:          guard,
         }
     }
 
@@ -211,17 +929,29 @@ func (lc *HarvestCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
     lc.setName = fs.String("s", "", "Select records from this set")
     lc.dryRun = fs.Bool("n", false, "Dry run.  Do not save results.")
     lc.listAndGet = fs.Bool("L", false, "Use list and get instead of ListRecord")
+    lc.partitionBy = fs.String("P", "", "Harvest partitions of the listing in parallel using ListRecords: date or set.  -f and -c apply to each partition")
+    lc.prefixList = fs.String("M", "", "Harvest records in each of these metadata prefixes, separated by commas")
     lc.beforeDate = fs.String("B", "", "Select records that were updated before date (YYYY-MM-DD)")
     lc.afterDate = fs.String("A", "", "Select records that were updated after date (YYYY-MM-DD)")
     lc.firstResult = fs.Int("f", 0, "Index of first record to retrieve")
     lc.fromFile = fs.String("F", "", "Read identifiers from a file")
+    lc.incrementalDir = fs.String("I", "", "Incrementally harvest changed records into this directory")
+    lc.applyDeletions = fs.Bool("X", false, "Apply deletions by removing the files of deleted records")
+    lc.tombstoneDir = fs.String("T", "", "Move the files of deleted records into this directory (implies -X)")
+    lc.resumeDir = fs.String("resume", "", "Resume an interrupted harvest in this directory")
+    lc.failuresFile = fs.String("E", "", "Write the identifiers of records which could not be retrieved to this file (default: failures.txt in the harvest directory)")
     lc.maxResults = fs.Int("c", 100000, "Maximum number of records to retrieve")
     lc.maxDirSize = fs.Int("D", 10000, "Maximum number of files to store in each directory")
-    lc.compressDirs = fs.Bool("C", false, "Compress directories once they are full")
+    lc.compressDirs = fs.Bool("C", false, "Write records into an archive for each directory")
+    lc.archiveFormat = fs.String("Z", ZipArchive, "Archive format used with -C: zip or tar.gz")
+    lc.outputFormat = fs.String("O", DirOutput, "Output format: dir, jsonl, warc or xml")
+    lc.changesFile = fs.String("U", "", "Write the new, changed and deleted records to this changeset file")
     lc.downloadWorkers = fs.Int("W", 4, "Number of download workers running in parallel")
 
     // Advanded options
     lc.filenameFilter = fs.String("N", "", "Use rs-expression for filename")
+    lc.layoutTemplate = fs.String("layout", "", "Template of the path of each record, e.g. {set}/{year}/{name}.xml")
+    lc.outputDir = fs.String("dir", "", "Harvest into this directory instead of a timestamped directory")
 
     return fs
 }
@@ -230,15 +960,102 @@ func (lc *HarvestCommand) Run(args []string) {
     // Compile the filename filter if there is one
     if *lc.filenameFilter != "" {
         var err error
-        lc.filenameFilterAst, err = ParseRSExpr(*lc.filenameFilter)
+        lc.filenameFilterAst, err = ParseRSExprWithOptions(*lc.filenameFilter, lc.Ctx.RSExprOptions())
         if err != nil {
             log.Fatal("Error in filename filter: ", err)
         }
     }
 
+    if *(lc.compressDirs) {
+        if _, err := ArchiveExtension(*(lc.archiveFormat)) ; err != nil {
+            log.Fatal(err)
+        }
+    }
+    if (*(lc.outputFormat) != DirOutput) {
+        if _, err := OutputExtension(*(lc.outputFormat)) ; err != nil {
+            log.Fatal(err)
+        } else if (*(lc.changesFile) != "") {
+            log.Fatal("Changesets can only be written with the directory layout")
+        }
+    }
+
+    if (*(lc.partitionBy) != "") && ((*(lc.fromFile) != "") || *(lc.listAndGet) || (*(lc.resumeDir) != "")) {
+        log.Fatal("Partitions can only be used with new harvests using ListRecords")
+    }
+    if (*(lc.prefixList) != "") {
+        for _, prefix := range strings.Split(*(lc.prefixList), ",") {
+            if prefix = strings.TrimSpace(prefix) ; prefix != "" {
+                lc.prefixes = append(lc.prefixes, prefix)
+            }
+        }
+        if (*(lc.resumeDir) != "") {
+            log.Fatal("Harvests of more than one prefix cannot be resumed")
+        }
+    }
+
+    lc.progress = NewProgressReporter("Harvested", 1000)
+    lc.Ctx.Session.SetListSizeFn(lc.progress.SetTotal)
+
+    started := time.Now().Format("20060102T150405")
     lc.lastDirId = 1
-    lc.dirPrefix = time.Now().Format("20060102T150405")
+    lc.dirPrefix = started
+    if (*(lc.outputDir) != "") {
+        if (*(lc.resumeDir) != "") || (*(lc.incrementalDir) != "") {
+            log.Fatal("The harvest directory cannot be set when resuming or incrementally harvesting")
+        }
+        lc.dirPrefix = *(lc.outputDir)
+    }
+
+    if *(lc.resumeDir) != "" {
+        lc.resumeHarvest(*(lc.resumeDir))
+    } else if *(lc.incrementalDir) != "" {
+        lc.startIncrementalHarvest(*(lc.incrementalDir), lc.genListIdentifierArgsFromCommandLine().Set)
+    }
+    lc.layout = lc.outputLayout()
+    if *(lc.tombstoneDir) != "" {
+        *(lc.applyDeletions) = true
+    }
+
+    if (! *(lc.dryRun)) {
+        lc.openSink(started)
+
+        failuresFile := *(lc.failuresFile)
+        if (failuresFile == "") {
+            failuresFile = filepath.Join(lc.dirPrefix, FailuresFilename)
+        }
+        lc.failures = NewFailureLog(failuresFile)
+    }
+
     lc.harvest()
-    lc.closeDir(lc.lastDirId)
+
+    if (! *(lc.dryRun)) {
+        // The harvest is incomplete if the output cannot be finalised, so that the harvest state
+        // is not updated
+        if err := lc.sink.Close() ; err != nil {
+            lc.errorCount++
+            log.Printf("ERROR: cannot finalise output: %s\n", err)
+        }
+        if (lc.checkpoint != nil) {
+            lc.finishCheckpoints()
+        }
+
+        // The failures file is only replaced if there were failures.  A default file left by an
+        // earlier run into the same directory is removed, as those records have been retrieved.
+        if (lc.failures.Count() > 0) {
+            if err := lc.failures.Close() ; err != nil {
+                log.Printf("ERROR: cannot write failures: %s\n", err)
+            } else {
+                log.Printf("%d records could not be retrieved: use 'harvest -F %s' to retry", lc.failures.Count(), lc.failures.Filename())
+            }
+        } else if (*(lc.failuresFile) == "") {
+            if err := os.Remove(lc.failures.Filename()) ; (err != nil) && !os.IsNotExist(err) {
+                log.Printf("ERROR: cannot remove failures: %s\n", err)
+            }
+        }
+    }
+
+    if (lc.state != nil) {
+        lc.finishIncrementalHarvest()
+    }
 
 }
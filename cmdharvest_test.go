@@ -0,0 +1,233 @@
+package main
+
+import (
+    "archive/zip"
+    "context"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/lmika/oaipmh/client"
+)
+
+// Test that the archived records of a checkpoint can be read after the harvest is killed and resumed
+func TestArchivedHarvestKilledAndResumed(t *testing.T) {
+    dir, err := ioutil.TempDir("", "harvest")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    // Five records are saved before the checkpoint, and two after it when the harvest is killed
+    lc := newTestArchivingHarvest(t, dir)
+    lc.checkpoint = &Checkpoint{ Url: lc.Ctx.Session.Url(), Prefix: lc.Ctx.Session.Prefix(), Output: DirOutput, Archive: ZipArchive, MaxDirSize: 10 }
+    for i := 1 ; i <= 5 ; i++ {
+        lc.saveRecord(testHarvestRecord(i))
+    }
+    lc.saveCheckpoint()
+    for i := 6 ; i <= 7 ; i++ {
+        lc.saveRecord(testHarvestRecord(i))
+    }
+    lc.archive.Flush()
+
+    // The last line of the manifest is cut short by the kill
+    lc.manifest.Flush()
+    data, _ := ioutil.ReadFile(filepath.Join(dir, ManifestFilename))
+    ioutil.WriteFile(filepath.Join(dir, ManifestFilename), data[:len(data) - 10], 0644)
+
+    // Resume the harvest, which harvests the records after the checkpoint again
+    lc = newTestHarvestCommand(t, dir)
+    lc.resumeHarvest(dir)
+    lc.openSink("")
+    if (lc.manifest.Len() != 5) {
+        t.Errorf("Expected the 5 records of the checkpoint in the manifest, got %d", lc.manifest.Len())
+    }
+    for i := 6 ; i <= 7 ; i++ {
+        lc.saveRecord(testHarvestRecord(i))
+    }
+    if err := lc.sink.Close() ; err != nil {
+        t.Fatal(err)
+    }
+
+    checkTestArchivedHarvest(t, lc, 7)
+}
+
+// Test that the archived records of a checkpoint are kept when a stopped harvest is resumed
+func TestArchivedHarvestStoppedAndResumed(t *testing.T) {
+    dir, err := ioutil.TempDir("", "harvest")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    // Stopping the harvest finalises the archive and closes the manifest
+    lc := newTestArchivingHarvest(t, dir)
+    ctx, cancel := context.WithCancel(context.Background())
+    lc.Ctx.RunContext = ctx
+    lc.checkpoint = &Checkpoint{ Url: lc.Ctx.Session.Url(), Prefix: lc.Ctx.Session.Prefix(), Output: DirOutput, Archive: ZipArchive, MaxDirSize: 10 }
+    for i := 1 ; i <= 12 ; i++ {
+        lc.saveRecord(testHarvestRecord(i))
+        if (i == 5) {
+            lc.saveCheckpoint()
+        }
+    }
+    cancel()
+    if err := lc.sink.Close() ; err != nil {
+        t.Fatal(err)
+    }
+
+    lc = newTestHarvestCommand(t, dir)
+    lc.resumeHarvest(dir)
+    lc.openSink("")
+    for i := 6 ; i <= 7 ; i++ {
+        lc.saveRecord(testHarvestRecord(i))
+    }
+    if err := lc.sink.Close() ; err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := os.Stat(filepath.Join(dir, "02.zip")) ; err == nil {
+        t.Error("Expected the archive after the checkpoint to be removed")
+    }
+    checkTestArchivedHarvest(t, lc, 7)
+}
+
+// Checks that the records of a harvest are new, and can be read from the archive 01.zip
+func checkTestArchivedHarvest(t *testing.T, lc *HarvestCommand, count int) {
+    dir := lc.dirPrefix
+    if (lc.newCount != count) || (lc.changedCount != 0) {
+        t.Errorf("Expected %d new records, got %d new and %d changed", count, lc.newCount, lc.changedCount)
+    }
+    if archives, _ := filepath.Glob(filepath.Join(dir, "01*")) ; (len(archives) != 1) || (filepath.Base(archives[0]) != "01.zip") {
+        t.Errorf("Expected the one archive 01.zip, got %v", archives)
+    }
+
+    m, err := OpenManifest(dir)
+    if (err != nil) {
+        t.Fatal(err)
+    } else if (m.Len() != count) {
+        t.Errorf("Expected %d records in the manifest, got %d", count, m.Len())
+    }
+    for i := 1 ; i <= count ; i++ {
+        id := fmt.Sprintf("rec:%d", i)
+        path, hasPath := m.Path(id)
+        if (! hasPath) {
+            t.Errorf("Expected %s in the manifest", id)
+            continue
+        }
+        if content := readTestArchivedRecord(t, dir, path) ; content != testHarvestRecord(i).Content {
+            t.Errorf("Expected the content of %s in %s, got '%s'", id, path, content)
+        }
+    }
+}
+
+
+// Test that records do not replace the file of another record
+func TestHarvestRecordsWithTheSameFile(t *testing.T) {
+    dir, err := ioutil.TempDir("", "harvest")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    lc := newTestArchivingHarvest(t, dir)
+    *(lc.compressDirs) = false
+    lc.filenameFilterAst, _ = ParseRSExpr(`"same"`)
+
+    if err := lc.sink.Write(testHarvestRecord(1)) ; err != nil {
+        t.Fatal(err)
+    }
+    if err := lc.sink.Write(testHarvestRecord(2)) ; err == nil {
+        t.Error("Expected an error writing the file of another record")
+    }
+
+    if content, _ := ioutil.ReadFile(filepath.Join(dir, "01", "same.xml")) ; string(content) != testHarvestRecord(1).Content {
+        t.Errorf("Expected the file of rec:1, got '%s'", string(content))
+    }
+    if _, hasPath := lc.manifest.Path("rec:2") ; hasPath {
+        t.Error("Expected rec:2 to not be in the manifest")
+    }
+}
+
+
+// Test that records harvested before the checkpoint are skipped when the listing is issued again
+func TestHarvestRelistedRecords(t *testing.T) {
+    dir, err := ioutil.TempDir("", "harvest")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    lc := newTestArchivingHarvest(t, dir)
+    *(lc.compressDirs) = false
+    for i := 1 ; i <= 3 ; i++ {
+        lc.saveRecord(testHarvestRecord(i))
+    }
+
+    // The resumption token has expired, and the second record has changed since it was harvested
+    lc.Ctx.Session.relisted = 1
+    changed := testHarvestRecord(2)
+    changed.Content = "<rec>changed</rec>"
+    for _, res := range []*RecordResult{ testHarvestRecord(1), changed, testHarvestRecord(3), testHarvestRecord(4) } {
+        lc.saveRecord(res)
+    }
+
+    if (lc.recordCount != 5) || (lc.newCount != 4) || (lc.changedCount != 1) {
+        t.Errorf("Expected 5 records with 4 new and 1 changed, got %d records with %d new and %d changed", lc.recordCount, lc.newCount, lc.changedCount)
+    }
+}
+
+
+// Returns a harvest which archives records into the directory
+func newTestArchivingHarvest(t *testing.T, dir string) *HarvestCommand {
+    lc := newTestHarvestCommand(t, dir, "-C", "-D", "10")
+    lc.openSink("")
+    return lc
+}
+
+// Returns a harvest into the directory with the flags.  The output is not opened.
+func newTestHarvestCommand(t *testing.T, dir string, args ...string) *HarvestCommand {
+    lc := &HarvestCommand{ Ctx: &Context{ Session: NewOaipmhSession("http://localhost/", "oai_dc"), RunContext: context.Background() } }
+    fs := lc.Flags(flag.NewFlagSet("harvest", flag.ContinueOnError))
+    if err := fs.Parse(args) ; err != nil {
+        t.Fatal(err)
+    }
+
+    lc.dirPrefix = dir
+    lc.lastDirId = 1
+    lc.layout, _ = ParseOutputLayout(DefaultLayout)
+    lc.progress = NewProgressReporter("Harvested", 0)
+    return lc
+}
+
+func testHarvestRecord(i int) *RecordResult {
+    return &RecordResult{
+        Header: oaipmh.OaipmhHeader{ Identifier: fmt.Sprintf("rec:%d", i) },
+        Content: fmt.Sprintf("<rec>%d</rec>", i),
+    }
+}
+
+// Reads a record from the archive of a manifest path
+func readTestArchivedRecord(t *testing.T, dir string, path string) string {
+    parts := strings.SplitN(path, "/", 2)
+    zr, err := zip.OpenReader(filepath.Join(dir, parts[0]))
+    if (err != nil) {
+        t.Error(err)
+        return ""
+    }
+    defer zr.Close()
+
+    for _, f := range zr.File {
+        if (f.Name == parts[1]) {
+            r, _ := f.Open()
+            defer r.Close()
+            content, _ := ioutil.ReadAll(r)
+            return string(content)
+        }
+    }
+    return ""
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/lmika/oaipmh/client"
 
+	"context"
 	"flag"
 	"log"
 	"net/http"
@@ -13,10 +14,12 @@ import (
 //      Starts a HTTP OAI-PMH endpoint
 
 type HostCommand struct {
-	Ctx *Context
+	Ctx      *Context
+	tokenKey *string
 }
 
 func (gc *HostCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	gc.tokenKey = fs.String("k", "", "Issue stateless resumption tokens signed with this key")
 	return fs
 }
 
@@ -25,15 +28,24 @@ func (gc *HostCommand) Run(args []string) {
 
 	repo := oaipmh.NewFileRepository(".")
 	handler := oaipmh.NewHandler(repo)
+	if *(gc.tokenKey) != "" {
+		handler.TokenKey = []byte(*(gc.tokenKey))
+	}
 
 	server := &http.Server{
 		Addr:    bindUrl,
 		Handler: handler,
 	}
 
+	// Stop the server when the user interrupts the program
+	go func() {
+		<-gc.Ctx.RunContext.Done()
+		server.Shutdown(context.Background())
+	}()
+
 	log.Printf("OAI-PMH provider running at %s", bindUrl)
 	err := server.ListenAndServe()
-	if err != nil {
+	if (err != nil) && (err != http.ErrServerClosed) {
 		log.Fatal("ListenAndServe: ", err)
 	}
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ---------------------------------------------------------------------------------------------------
+// Identify command
+//      Displays information about the provider.
+
+type IdentifyCommand struct {
+	Ctx *Context
+}
+
+func (ic *IdentifyCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	return fs
+}
+
+func (ic *IdentifyCommand) Run(args []string) {
+	ident, err := ic.Ctx.Session.Identify(ic.Ctx.RunContext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "oaipmh: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Repository Name:     %s\n", ident.RepositoryName)
+	fmt.Printf("Base URL:            %s\n", ident.BaseURL)
+	fmt.Printf("Protocol Version:    %s\n", ident.ProtocolVer)
+	fmt.Printf("Admin Email:         %s\n", ident.AdminEmail)
+	fmt.Printf("Earliest Datestamp:  %s\n", ident.EarliestDatestamp)
+	fmt.Printf("Deleted Records:     %s\n", ident.DeletedRecord)
+	fmt.Printf("Granularity:         %s\n", ident.Granularity)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "fmt"
     "os"
     "flag"
@@ -22,10 +23,13 @@ type ListCommand struct {
     listRecords     *bool
     showDeleted     *bool
     onlyShowDeleted *bool
+    showProgress    *bool
+    progress        *ProgressReporter
+    listCount       int
 }
 
 
-type listingFn  func(listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(res *HeaderResult) bool) error
+type listingFn  func(ctx context.Context, listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(res *HeaderResult) bool) error
 
 
 // Attempt to parse a date string and return it as a heap allocated time.Time.
@@ -83,6 +87,14 @@ func (lc *ListCommand) getListingFn() listingFn {
     }
 }
 
+// Updates the progress of the listing, if it is being reported.
+func (lc *ListCommand) updateProgress() {
+    lc.listCount++
+    if (lc.progress != nil) {
+        lc.progress.Update(lc.listCount)
+    }
+}
+
 // Returns true if the specific header should be shown.  This uses the options specified
 // by the user.
 func (lc *ListCommand) configuredToShowRecord(header *HeaderResult) bool {
@@ -103,7 +115,8 @@ func (lc *ListCommand) listIdentifiers() {
     args := lc.genListIdentifierArgsFromCommandLine()
     listFn := lc.getListingFn()
 
-    err := listFn(args, *(lc.firstResult), *(lc.maxResults), func(res *HeaderResult) bool {
+    err := listFn(lc.Ctx.RunContext, args, *(lc.firstResult), *(lc.maxResults), func(res *HeaderResult) bool {
+        lc.updateProgress()
         if lc.configuredToShowRecord(res) {
             fmt.Printf("%s\n", res.Identifier())
         }
@@ -140,7 +153,8 @@ func (lc *ListCommand) listIdentifiersInDetail() {
     args := lc.genListIdentifierArgsFromCommandLine()
     listFn := lc.getListingFn()
 
-    listFn(args, *(lc.firstResult), *(lc.maxResults), func(res *HeaderResult) bool {
+    listFn(lc.Ctx.RunContext, args, *(lc.firstResult), *(lc.maxResults), func(res *HeaderResult) bool {
+        lc.updateProgress()
         if (res.Deleted) {
             deletedCount++
         } else {
@@ -174,11 +188,17 @@ func (lc *ListCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
     lc.firstResult = fs.Int("f", 0, "Index of first record to retrieve")
     lc.maxResults = fs.Int("c", 100000, "Maximum number of records to retrieve")
     lc.listRecords = fs.Bool("R", false, "Use ListRecord instead of ListIdentifier")
+    lc.showProgress = fs.Bool("v", false, "Report progress to stderr")
 
     return fs
 }
 
 func (lc *ListCommand) Run(args []string) {
+    if *(lc.showProgress) {
+        lc.progress = NewProgressReporter("Listed", 1000)
+        lc.Ctx.Session.SetListSizeFn(lc.progress.SetTotal)
+    }
+
     if *(lc.flagDetailed) {
         lc.listIdentifiersInDetail()
     } else {
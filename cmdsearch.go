@@ -26,10 +26,13 @@ type SearchCommand struct {
     urnOnly             *bool
     valueOnly           *bool
     downloadWorkers     *int
+    failuresFile        *string
+    includeDeleted      *bool
 
     matchNode           RecordSearcher
     hits                int
     misses              int
+    failures            *FailureLog
 }
 
 // Callbacks for the HarvesterObserver
@@ -64,6 +67,11 @@ func (sc *SearchCommand) OnRecord(recordResult *RecordResult) {
 }
 
 func (sc *SearchCommand) OnError(err error) {
+    if recErr, isRecErr := err.(RecordError) ; isRecErr {
+        if err2 := sc.failures.Add(recErr.Identifier, recErr.Err) ; err2 != nil {
+            log.Printf("Cannot write failures: %s\n", err2.Error())
+        }
+    }
     log.Printf("Harvesting Error: %s\n", err.Error())
 }
 
@@ -95,6 +103,13 @@ func (sc *SearchCommand) genListIdentifierArgsFromCommandLine() ListIdentifierAr
 func (sc *SearchCommand) makeHarvester() Harvester {
     la := sc.genListIdentifierArgsFromCommandLine()
 
+    var headGuard HeaderPredicate = LiveRecordsHeaderPredicate
+    var guard RecordPredicate = LiveRecordsPredicate
+    if *(sc.includeDeleted) {
+        headGuard = AllRecordsHeaderPredicate
+        guard = AllRecordsPredicate
+    }
+
     if *(sc.fromFile) != "" {
         return &FileHarvester{
             Session:        sc.Ctx.Session,
@@ -102,7 +117,7 @@ func (sc *SearchCommand) makeHarvester() Harvester {
             FirstResult:    *(sc.firstResult),
             MaxResults:     *(sc.maxResults),
             Workers:        *(sc.downloadWorkers),
-            Guard:          LiveRecordsPredicate,
+            Guard:          guard,
         }
     } else if  (sc.listAndGet != nil) && *(sc.listAndGet) {
         return &ListAndGetRecordHarvester{
@@ -111,8 +126,8 @@ func (sc *SearchCommand) makeHarvester() Harvester {
             FirstResult:    *(sc.firstResult),
             MaxResults:     *(sc.maxResults),
             Workers:        *(sc.downloadWorkers),
-            HarvestGuard:   LiveRecordsHeaderPredicate,
-            Guard:          LiveRecordsPredicate,
+            HarvestGuard:   headGuard,
+            Guard:          guard,
         }
 
     } else {
@@ -121,7 +136,7 @@ func (sc *SearchCommand) makeHarvester() Harvester {
             ListArgs:       la,
             FirstResult:    *(sc.firstResult),
             MaxResults:     *(sc.maxResults),
-            Guard:          LiveRecordsPredicate,
+            Guard:          guard,
         }
     }
 }
@@ -139,6 +154,8 @@ func (sc *SearchCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
     sc.urnOnly = fs.Bool("l", false, "Only show the URN")
     sc.valueOnly = fs.Bool("h", false, "Only show the value")
     sc.downloadWorkers = fs.Int("W", 4, "Number of download workers running in parallel")
+    sc.failuresFile = fs.String("E", "", "Write the identifiers of records which could not be retrieved to this file (default " + FailuresFilename + ")")
+    sc.includeDeleted = fs.Bool("X", false, "Include deleted records")
 
     return fs
 }
@@ -151,13 +168,29 @@ func (sc *SearchCommand) Run(args []string) {
     }
 
     // Attempt to parse the expression
-    matchNode, err := ParseRecordMatchExpr(args[0])
+    matchNode, err := ParseRecordMatchExprWithOptions(args[0], sc.Ctx.RSExprOptions())
     if (err != nil) {
         log.Fatal(err)
     }
 
     sc.matchNode = matchNode
 
+    failuresFile := *(sc.failuresFile)
+    if (failuresFile == "") {
+        failuresFile = FailuresFilename
+    }
+    sc.failures = NewFailureLog(failuresFile)
+
     harvester := sc.makeHarvester()
-    harvester.Harvest(sc)
+    harvester.Harvest(sc.Ctx.RunContext, sc)
+
+    // The default failures file is only replaced if there were failures
+    if (sc.failures.Count() == 0) && (*(sc.failuresFile) == "") {
+        return
+    }
+    if err := sc.failures.Close() ; err != nil {
+        log.Printf("Cannot write failures: %s\n", err.Error())
+    } else if (sc.failures.Count() > 0) {
+        log.Printf("%d records could not be retrieved: use 'search -F %s' to retry\n", sc.failures.Count(), sc.failures.Filename())
+    }
 }
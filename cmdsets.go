@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/lmika/oaipmh/client"
@@ -15,15 +16,19 @@ import (
 type SetsCommand struct {
 	Ctx          *Context
 	flagDetailed *bool
+	firstResult  *int
+	maxResults   *int
 }
 
 func (lc *SetsCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
 	lc.flagDetailed = fs.Bool("l", false, "Use detailed listing format")
+	lc.firstResult = fs.Int("f", 0, "Index of first set to retrieve")
+	lc.maxResults = fs.Int("c", -1, "Maximum number of sets to retrieve")
 	return fs
 }
 
 func (lc *SetsCommand) Run(args []string) {
-	lc.Ctx.Session.ListSets(0, -1, func(res oaipmh.OaipmhSet) bool {
+	err := lc.Ctx.Session.ListSets(lc.Ctx.RunContext, *(lc.firstResult), *(lc.maxResults), func(res oaipmh.OaipmhSet) bool {
 		if *(lc.flagDetailed) {
 			fmt.Printf("%s: %s\n", res.Spec, res.Name)
 			descrLines := strings.Split(res.Descr.OaiDC.Descr, "\n")
@@ -43,4 +48,8 @@ func (lc *SetsCommand) Run(args []string) {
 		}
 		return true
 	})
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "oaipmh: %s\n", err.Error())
+	}
 }
@@ -25,6 +25,100 @@ type Provider struct {
 
 	// The default set
 	Set string
+
+	// The maximum number of attempts made for each request
+	MaxAttempts int
+
+	// The backoff before the first retry and the maximum backoff between retries (e.g. "2s")
+	RetryBackoff    string
+	RetryMaxBackoff string
+
+	// The HTTP status codes which will be retried
+	RetryStatus []int
+
+	// Ignore the delay requested by the provider in the Retry-After header
+	IgnoreRetryAfter bool
+
+	// Additional headers sent with each request, in the form "Name: value"
+	Header []string
+
+	// The timeout of each request (e.g. "30s")
+	Timeout string
+
+	// The User-Agent sent with each request
+	UserAgent string
+}
+
+// Returns the client options for the provider
+func (p *Provider) ClientOptions() ([]oaipmh.ClientOption, error) {
+	opts := []oaipmh.ClientOption{oaipmh.WithUserAgent(APP_NAME + "/" + APP_VERSION)}
+
+	if p.UserAgent != "" {
+		opts = append(opts, oaipmh.WithUserAgent(p.UserAgent))
+	}
+	if p.Timeout != "" {
+		timeout, err := time.ParseDuration(p.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %s", err.Error())
+		}
+		opts = append(opts, oaipmh.WithTimeout(timeout))
+	}
+	for _, header := range p.Header {
+		nameAndValue := strings.SplitN(header, ":", 2)
+		if len(nameAndValue) != 2 {
+			return nil, fmt.Errorf("invalid header '%s': expected 'Name: value'", header)
+		}
+		opts = append(opts, oaipmh.WithHeader(strings.TrimSpace(nameAndValue[0]), strings.TrimSpace(nameAndValue[1])))
+	}
+
+	return opts, nil
+}
+
+// Creates a new session to the provider
+func (p *Provider) NewSession(prefix string) (*OaipmhSession, error) {
+	opts, err := p.ClientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	session := NewOaipmhSession(p.Url, prefix, opts...)
+
+	retryPolicy, err := p.RetryPolicy(oaipmh.DefaultRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	session.SetRetryPolicy(retryPolicy)
+
+	return session, nil
+}
+
+// Returns the retry policy for the provider.  Settings which are not configured are taken
+// from the base policy.
+func (p *Provider) RetryPolicy(base oaipmh.RetryPolicy) (oaipmh.RetryPolicy, error) {
+	var err error
+	policy := base
+
+	if p.MaxAttempts > 0 {
+		policy.MaxAttempts = p.MaxAttempts
+	}
+	if p.RetryBackoff != "" {
+		if policy.BaseBackoff, err = time.ParseDuration(p.RetryBackoff); err != nil {
+			return policy, fmt.Errorf("invalid retrybackoff: %s", err.Error())
+		}
+	}
+	if p.RetryMaxBackoff != "" {
+		if policy.MaxBackoff, err = time.ParseDuration(p.RetryMaxBackoff); err != nil {
+			return policy, fmt.Errorf("invalid retrymaxbackoff: %s", err.Error())
+		}
+	}
+	if len(p.RetryStatus) > 0 {
+		policy.RetryableStatuses = p.RetryStatus
+	}
+	if p.IgnoreRetryAfter {
+		policy.RespectRetryAfter = false
+	}
+
+	return policy, nil
 }
 
 // Baseline configuration
@@ -34,6 +128,37 @@ type Config struct {
 
 	// External processes
 	ExtProcess map[string]*ExtProcess
+
+	// Namespace prefixes which can be used in XPath expressions
+	Namespace map[string]*Namespace
+
+	// XPath settings
+	XPath XPathConfig
+}
+
+// A namespace prefix
+type Namespace struct {
+	// The URI of the namespace
+	Uri string
+}
+
+// The XPath settings
+type XPathConfig struct {
+	// Use the loose engine for xp(), which ignores namespaces
+	Loose bool
+}
+
+// Returns the settings of xp().  The configured namespaces are added to the default namespaces.
+func (cfg *Config) XPathOptions() XPathOptions {
+	namespaces := make(map[string]string)
+	for prefix, uri := range DefaultNamespaces {
+		namespaces[prefix] = uri
+	}
+	for prefix, ns := range cfg.Namespace {
+		namespaces[prefix] = ns.Uri
+	}
+
+	return XPathOptions{Namespaces: namespaces, Loose: cfg.XPath.Loose}
 }
 
 // Looks up a provider.  If one is not defined, creates a dummy provider.
@@ -51,7 +176,8 @@ func (cfg *Config) LookupProvider(endpoint string) *Provider {
 
 func ReadConfig() *Config {
 	c := &Config{
-		Provider: make(map[string]*Provider),
+		Provider:  make(map[string]*Provider),
+		Namespace: make(map[string]*Namespace),
 	}
 
 	u, err := user.Current()
@@ -1,5 +1,9 @@
 package main
 
+import (
+    "context"
+)
+
 // Const
 const DateFormat string = "2006-01-02"
 
@@ -20,4 +24,22 @@ type Context struct {
 
     // Set to the provider is one is used instead of a raw URL
     Provider        *Provider
+
+    // The provider as given on the command line.  Either the alias or the URL of the provider.
+    ProviderName    string
+
+    // The context of the running command.  This is cancelled when the user interrupts the program.
+    RunContext      context.Context
+}
+
+// Returns the settings used to parse RS expressions
+func (ctx *Context) RSExprOptions() RSExprOptions {
+    opts := RSExprOptions{
+        XPath:      ctx.Config.XPathOptions(),
+        Provider:   ctx.ProviderName,
+    }
+    if (ctx.Session != nil) {
+        opts.Prefix = ctx.Session.Prefix()
+    }
+    return opts
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The default name of the failure log of a harvest
+const FailuresFilename = "failures.txt"
+
+// ---------------------------------------------------------------------------------------------------
+// Failure log
+//      A file of the records which could not be retrieved.  Each identifier is written on a line
+//      of its own, preceded by a comment with the error, so that the file can be read with -F
+//      to retry the records.  The file is written to a temporary file which replaces the log
+//      when it is closed, so the log can be written over the file being retried.
+
+type FailureLog struct {
+	filename string
+	file     *os.File
+	seen     map[string]bool
+}
+
+// Creates a new failure log.  The temporary file is only created once the first failure is added.
+func NewFailureLog(filename string) *FailureLog {
+	return &FailureLog{filename: filename, seen: make(map[string]bool)}
+}
+
+// Returns the filename of the failure log
+func (fl *FailureLog) Filename() string {
+	return fl.filename
+}
+
+// Returns the number of records which have failed
+func (fl *FailureLog) Count() int {
+	return len(fl.seen)
+}
+
+// Adds a record which has failed.  Each identifier is only written once, along with the first error.
+func (fl *FailureLog) Add(id string, err error) error {
+	if fl.seen[id] {
+		return nil
+	}
+	fl.seen[id] = true
+
+	if err := fl.create(); err != nil {
+		return err
+	}
+
+	msg := strings.Join(strings.Fields(err.Error()), " ")
+	_, err = fmt.Fprintf(fl.file, "# %s\n%s\n", msg, id)
+	return err
+}
+
+// Closes the failure log, replacing the previous log.  The log is empty if there were no failures.
+func (fl *FailureLog) Close() error {
+	if err := fl.create(); err != nil {
+		return err
+	}
+	if err := fl.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fl.file.Name(), fl.filename)
+}
+
+// Creates the temporary file if it has not been created yet
+func (fl *FailureLog) create() error {
+	if fl.file != nil {
+		return nil
+	}
+
+	os.MkdirAll(filepath.Dir(fl.filename), 0755)
+	file, err := os.Create(fl.filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	fl.file = file
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "testing"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+func TestFailureLogCanBeRetried(t *testing.T) {
+    dir, err := ioutil.TempDir("", "failures")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, FailuresFilename)
+    fl := NewFailureLog(filename)
+    fl.Add("rec:1", errors.New("Service\nUnavailable"))
+    fl.Add("rec:2", errors.New("Timeout"))
+    fl.Add("rec:1", errors.New("Timeout"))
+    if err := fl.Close() ; err != nil {
+        t.Fatal(err)
+    }
+
+    if (fl.Count() != 2) {
+        t.Errorf("Expected 2 failures, got %d", fl.Count())
+    }
+
+    // The log can be read as a list of identifiers
+    ids := []string{}
+    err = LinesFromFile(filename, 0, -1, func(id string) bool {
+        ids = append(ids, id)
+        return true
+    })
+    if (err != nil) {
+        t.Fatal(err)
+    } else if (strings.Join(ids, ",") != "rec:1,rec:2") {
+        t.Errorf("Unexpected identifiers: %v", ids)
+    }
+
+    // An empty log replaces the previous log
+    if err := NewFailureLog(filename).Close() ; err != nil {
+        t.Fatal(err)
+    }
+    if content, _ := ioutil.ReadFile(filename) ; len(content) != 0 {
+        t.Errorf("Expected empty log, got %q", content)
+    }
+}
@@ -4,16 +4,20 @@ package main
 //
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/lmika/oaipmh/client"
 	"github.com/lmika/oaipmh/mapreduce"
 )
 
 // Base interface for an harvester.
 type Harvester interface {
 
-	// Starts a harvesting task.
-	Harvest(observer HarvesterObserver)
+	// Starts a harvesting task.  The task stops early if the context is cancelled.
+	Harvest(ctx context.Context, observer HarvesterObserver)
 }
 
 // Base interface for a recipient of harvested records.
@@ -119,14 +123,14 @@ type ListRecordHarvester struct {
 }
 
 // Starts the harvesting task.
-func (rh *ListRecordHarvester) Harvest(observer HarvesterObserver) {
+func (rh *ListRecordHarvester) Harvest(ctx context.Context, observer HarvesterObserver) {
 	pred := rh.Guard
 	if pred == nil {
 		pred = AllRecordsPredicate
 	}
 
 	var harvested, skipped, errors int = 0, 0, 0
-	err := rh.Session.ListRecords(rh.ListArgs, rh.FirstResult, rh.MaxResults, func(rr *RecordResult) bool {
+	err := rh.Session.ListRecords(ctx, rh.ListArgs, rh.FirstResult, rh.MaxResults, func(rr *RecordResult) bool {
 		if pred(rr) {
 			observer.OnRecord(rr)
 			harvested++
@@ -136,7 +140,8 @@ func (rh *ListRecordHarvester) Harvest(observer HarvesterObserver) {
 		return true
 	})
 
-	if err != nil {
+	// Cancellation is not reported as an error
+	if (err != nil) && (ctx.Err() == nil) {
 		observer.OnError(err)
 		errors++
 	}
@@ -156,6 +161,9 @@ type ListAndGetRecordHarvester struct {
 	MaxResults  int
 	Workers     int
 
+	// The metadata prefixes to retrieve each record in.  If empty, the prefix of the session is used.
+	Prefixes []string
+
 	// A guard which will only queue records for harvesting with headers that match
 	// this predicate.
 	HarvestGuard HeaderPredicate
@@ -164,7 +172,7 @@ type ListAndGetRecordHarvester struct {
 }
 
 // Starts the harvesting task.
-func (lgh *ListAndGetRecordHarvester) Harvest(observer HarvesterObserver) {
+func (lgh *ListAndGetRecordHarvester) Harvest(ctx context.Context, observer HarvesterObserver) {
 	pred := lgh.Guard
 	if pred == nil {
 		pred = AllRecordsPredicate
@@ -180,13 +188,13 @@ func (lgh *ListAndGetRecordHarvester) Harvest(observer HarvesterObserver) {
 	countingObserver := &CountingObserver{Predicate: pred}
 	observers := HarvesterObservers([]HarvesterObserver{observer, countingObserver})
 
-	mr := newGetRecordMapReducer(lgh.Session, observers, lgh.Workers, pred)
+	mr := newGetRecordMapReducer(ctx, lgh.Session, observers, lgh.Workers, pred)
 	mr.Start()
 
 	// Feed the data
-	err := lgh.Session.ListIdentifiers(lgh.ListArgs, lgh.FirstResult, lgh.MaxResults, func(res *HeaderResult) bool {
+	err := lgh.Session.ListIdentifiers(ctx, lgh.ListArgs, lgh.FirstResult, lgh.MaxResults, func(res *HeaderResult) bool {
 		if headPred(res) {
-			mr.Push(res.Identifier())
+			pushRecordRequests(mr, res.Identifier(), lgh.Prefixes)
 			return true
 		} else {
 			countingObserver.Skipped++
@@ -195,7 +203,7 @@ func (lgh *ListAndGetRecordHarvester) Harvest(observer HarvesterObserver) {
 	})
 	mr.Close()
 
-	if err != nil {
+	if (err != nil) && (ctx.Err() == nil) {
 		observers.OnError(err)
 	}
 
@@ -215,11 +223,14 @@ type FileHarvester struct {
 	MaxResults  int
 	Workers     int
 
+	// The metadata prefixes to retrieve each record in.  If empty, the prefix of the session is used.
+	Prefixes []string
+
 	Guard RecordPredicate
 }
 
 // Starts the harvesting task.
-func (fh *FileHarvester) Harvest(observer HarvesterObserver) {
+func (fh *FileHarvester) Harvest(ctx context.Context, observer HarvesterObserver) {
 
 	pred := fh.Guard
 	if pred == nil {
@@ -231,17 +242,20 @@ func (fh *FileHarvester) Harvest(observer HarvesterObserver) {
 	countingObserver := &CountingObserver{Predicate: pred}
 	observers := HarvesterObservers([]HarvesterObserver{observer, countingObserver})
 
-	mr := newGetRecordMapReducer(fh.Session, observers, fh.Workers, pred)
+	mr := newGetRecordMapReducer(ctx, fh.Session, observers, fh.Workers, pred)
 	mr.Start()
 
 	// Feed the data
 	err := LinesFromFile(fh.Filename, fh.FirstResult, fh.MaxResults, func(id string) bool {
-		mr.Push(id)
+		if ctx.Err() != nil {
+			return false
+		}
+		pushRecordRequests(mr, id, fh.Prefixes)
 		return true
 	})
 	mr.Close()
 
-	if err != nil {
+	if (err != nil) && (ctx.Err() == nil) {
 		observers.OnError(err)
 	}
 
@@ -249,24 +263,266 @@ func (fh *FileHarvester) Harvest(observer HarvesterObserver) {
 	observer.OnCompleted(countingObserver.Selected, countingObserver.Skipped, countingObserver.Errors)
 }
 
+// --------------------------------------------------------------------------
+// PartitionedListRecordHarvester
+//      A harvester which splits the listing into partitions, such as date ranges, sets or prefixes, and
+//      harvests each partition with its own ListRecords listing in parallel.  If the partitions
+//      can overlap, records which appear in more than one partition are only passed to the
+//      observer once.
+
+type PartitionedListRecordHarvester struct {
+	Session     *OaipmhSession
+	Partitions  []ListIdentifierArgs
+	FirstResult int
+	MaxResults  int
+	Workers     int
+
+	// If true, records which appear in more than one partition, such as a record in several sets,
+	// are only passed to the observer once.  This keeps the identifier of every record harvested,
+	// so is not used for partitions which cannot overlap.
+	Deduplicate bool
+
+	Guard RecordPredicate
+}
+
+// Starts the harvesting task.  The first result and maximum results apply to each partition.
+func (ph *PartitionedListRecordHarvester) Harvest(ctx context.Context, observer HarvesterObserver) {
+	pred := ph.Guard
+	if pred == nil {
+		pred = AllRecordsPredicate
+	}
+
+	po := &partitionObserver{observer: observer}
+	if ph.Deduplicate {
+		po.seen = make(map[string]time.Time)
+	}
+	partitions := make(chan ListIdentifierArgs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < ph.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for args := range partitions {
+				err := ph.Session.ListRecords(ctx, args, ph.FirstResult, ph.MaxResults, func(rr *RecordResult) bool {
+					if pred(rr) {
+						po.OnRecord(rr)
+					} else {
+						po.skip()
+					}
+					return true
+				})
+
+				// Cancellation is not reported as an error
+				if (err != nil) && (ctx.Err() == nil) {
+					po.OnError(err)
+				}
+			}
+		}()
+	}
+
+	for _, args := range ph.Partitions {
+		if ctx.Err() != nil {
+			break
+		}
+		partitions <- args
+	}
+	close(partitions)
+	wg.Wait()
+
+	observer.OnCompleted(po.harvested, po.skipped, po.errors)
+}
+
+// Splits the date range of the list arguments into n partitions of equal length.  The range
+// starts from the earliest datestamp if the arguments have no from date, and ends at the current
+// time if the arguments have no until date.  Partition boundaries are aligned to the granularity
+// of the arguments and do not overlap.  Fewer partitions are returned if the range is too short.
+func DatePartitions(args ListIdentifierArgs, earliest time.Time, n int) []ListIdentifierArgs {
+	unit := time.Second
+	if args.Granularity == oaipmh.DayGranularity {
+		unit = 24 * time.Hour
+	}
+
+	from, until := earliest, time.Now()
+	if args.From != nil {
+		from = *args.From
+	}
+	if args.Until != nil {
+		until = *args.Until
+	}
+	from, until = from.UTC().Truncate(unit), until.UTC().Truncate(unit)
+
+	// The boundaries between each partition
+	bounds := []time.Time{}
+	span := until.Sub(from) / time.Duration(n)
+	for i := 1; i < n; i++ {
+		bound := from.Add(span * time.Duration(i)).Truncate(unit)
+		if bound.After(from) && ((len(bounds) == 0) || bound.After(bounds[len(bounds)-1])) {
+			bounds = append(bounds, bound)
+		}
+	}
+
+	// The first and last partitions keep the original from and until dates, so that nothing
+	// outside the range of datestamps is missed
+	partitions := make([]ListIdentifierArgs, 0, len(bounds)+1)
+	partFrom := args.From
+	for _, bound := range bounds {
+		partUntil := bound.Add(-unit)
+
+		part := args
+		part.From, part.Until = partFrom, &partUntil
+		partitions = append(partitions, part)
+
+		nextFrom := bound
+		partFrom = &nextFrom
+	}
+
+	part := args
+	part.From = partFrom
+	return append(partitions, part)
+}
+
+// Returns a partition for each set.
+func SetPartitions(args ListIdentifierArgs, sets []string) []ListIdentifierArgs {
+	partitions := make([]ListIdentifierArgs, len(sets))
+	for i, set := range sets {
+		partitions[i] = args
+		partitions[i].Set = set
+	}
+	return partitions
+}
+
+// Returns a partition for each prefix of each of the partitions.  The partitions are returned as
+// is if there are no prefixes.
+func PrefixPartitions(partitions []ListIdentifierArgs, prefixes []string) []ListIdentifierArgs {
+	if len(prefixes) == 0 {
+		return partitions
+	}
+
+	prefixPartitions := make([]ListIdentifierArgs, 0, len(partitions)*len(prefixes))
+	for _, prefix := range prefixes {
+		for _, part := range partitions {
+			part.Prefix = prefix
+			prefixPartitions = append(prefixPartitions, part)
+		}
+	}
+	return prefixPartitions
+}
+
+// An observer which serialises the calls from each partition to the observer.  If seen is set,
+// records which have already been observed are skipped, unless the record has a later datestamp.
+type partitionObserver struct {
+	mutex    sync.Mutex
+	observer HarvesterObserver
+	seen     map[string]time.Time
+
+	harvested int
+	skipped   int
+	errors    int
+}
+
+func (po *partitionObserver) OnRecord(rr *RecordResult) {
+	po.mutex.Lock()
+	defer po.mutex.Unlock()
+
+	// Partitions may also be of different prefixes, which are not duplicates
+	if po.seen != nil {
+		key := rr.Identifier() + " " + rr.Prefix
+		if lastDatestamp, hasSeen := po.seen[key]; hasSeen && !rr.Header.DateStamp.After(lastDatestamp) {
+			po.skipped++
+			return
+		}
+		po.seen[key] = rr.Header.DateStamp
+	}
+
+	po.harvested++
+	po.observer.OnRecord(rr)
+}
+
+func (po *partitionObserver) OnError(err error) {
+	po.mutex.Lock()
+	defer po.mutex.Unlock()
+
+	po.errors++
+	po.observer.OnError(err)
+}
+
+func (po *partitionObserver) skip() {
+	po.mutex.Lock()
+	defer po.mutex.Unlock()
+
+	po.skipped++
+}
+
 // ------------------------------------------------------------------------
 
+// A request to retrieve a record in a metadata prefix.  An empty prefix is the prefix of the
+// session.
+type recordRequest struct {
+	id     string
+	prefix string
+}
+
+// An error retrieving a record.  The prefix is empty if the record was requested in the prefix
+// of the session.
+type RecordError struct {
+	Identifier string
+	Prefix     string
+	Err        error
+}
+
+func (e RecordError) Error() string {
+	if e.Prefix == "" {
+		return fmt.Sprintf("%s: %s", e.Identifier, e.Err.Error())
+	}
+	return fmt.Sprintf("%s (%s): %s", e.Identifier, e.Prefix, e.Err.Error())
+}
+
+// Returns true if the error is because the provider cannot disseminate the record in the prefix.
+func (e RecordError) Unavailable() bool {
+	oaiErr, isOaiErr := e.Err.(oaipmh.EOaipmhError)
+	return isOaiErr && (oaiErr.Code == "cannotDisseminateFormat")
+}
+
+// Pushes a request for the record in each prefix to the map/reducer.
+func pushRecordRequests(mr *mapreduce.SimpleMapReduce, id string, prefixes []string) {
+	if len(prefixes) == 0 {
+		mr.Push(recordRequest{id, ""})
+		return
+	}
+	for _, prefix := range prefixes {
+		mr.Push(recordRequest{id, prefix})
+	}
+}
+
 // Sets up a map/reducer with the following configuration.
 //
-//      Mapper:     URN -> downloaded record OR error
+//      Mapper:     URN and prefix -> downloaded record OR record error
 //      Reducer:    (record OR error)s -> calls to the observer
 //
-// The map/reduce expects URN to be pushed to the map queue.
+// The map/reduce expects record requests to be pushed to the map queue.  Once the context is
+// cancelled, any queued URNs are drained without being fetched.
 //
-func newGetRecordMapReducer(session *OaipmhSession, observer HarvesterObserver, downloadWorkers int, pred RecordPredicate) *mapreduce.SimpleMapReduce {
+func newGetRecordMapReducer(ctx context.Context, session *OaipmhSession, observer HarvesterObserver, downloadWorkers int, pred RecordPredicate) *mapreduce.SimpleMapReduce {
 	return mapreduce.NewSimpleMapReduce(downloadWorkers, 100, downloadWorkers*5).
-		Map(func(id interface{}) interface{} {
-			rec, err := session.GetRecord(id.(string))
-			if err == nil {
-				return RecordToRecordResult(rec)
-			} else {
-				return err
+		Map(func(req interface{}) interface{} {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+
+			rr := req.(recordRequest)
+			prefix := rr.prefix
+			if prefix == "" {
+				prefix = session.Prefix()
+			}
+
+			rec, err := session.GetRecordWithPrefix(ctx, rr.id, prefix)
+			if err != nil {
+				return RecordError{rr.id, rr.prefix, err}
+			}
+			res := RecordToRecordResult(rec)
+			res.Prefix = prefix
+			return res
 		}).
 		Reduce(func(recs chan interface{}) {
 			// Retrieves either a *RecordResult or an error
@@ -277,7 +533,9 @@ func newGetRecordMapReducer(session *OaipmhSession, observer HarvesterObserver,
 						observer.OnRecord(r)
 					}
 				case error:
-					observer.OnError(r)
+					if ctx.Err() == nil {
+						observer.OnError(r)
+					}
 				default:
 					panic(fmt.Sprintf("Expected either an recordResult or an error: got %v", rec))
 				}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/lmika/oaipmh/client"
+)
+
+func TestDatePartitions(t *testing.T) {
+    earliest := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+    until := time.Date(2017, 1, 11, 0, 0, 0, 0, time.UTC)
+    args := ListIdentifierArgs{ Set: "a", Until: &until, Granularity: oaipmh.DayGranularity }
+
+    parts := DatePartitions(args, earliest, 2)
+    if (len(parts) != 2) {
+        t.Fatalf("Expected 2 partitions, got %d", len(parts))
+    }
+
+    // The first partition keeps the open from date, and the partitions do not overlap
+    if (parts[0].From != nil) || !parts[0].Until.Equal(time.Date(2017, 1, 5, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("Unexpected first partition: %v - %v", parts[0].From, parts[0].Until)
+    }
+    if !parts[1].From.Equal(time.Date(2017, 1, 6, 0, 0, 0, 0, time.UTC)) || !parts[1].Until.Equal(until) {
+        t.Errorf("Unexpected second partition: %v - %v", parts[1].From, parts[1].Until)
+    }
+    if (parts[1].Set != "a") || (parts[1].Granularity != oaipmh.DayGranularity) {
+        t.Errorf("Expected partition to keep the other arguments, got %v", parts[1])
+    }
+
+    // Ranges which are too short are not split
+    parts = DatePartitions(args, until, 4)
+    if (len(parts) != 1) || (parts[0].From != nil) || (parts[0].Until != &until) {
+        t.Errorf("Expected a single partition, got %v", parts)
+    }
+}
+
+func TestPartitionObserverSkipsDuplicates(t *testing.T) {
+    t1 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+    t2 := t1.Add(time.Hour)
+
+    counter := &CountingObserver{ Predicate: AllRecordsPredicate }
+    po := &partitionObserver{ observer: counter, seen: make(map[string]time.Time) }
+
+    po.OnRecord(&RecordResult{ Header: oaipmh.OaipmhHeader{ Identifier: "a", DateStamp: t1 } })
+    po.OnRecord(&RecordResult{ Header: oaipmh.OaipmhHeader{ Identifier: "a", DateStamp: t1 } })
+    po.OnRecord(&RecordResult{ Header: oaipmh.OaipmhHeader{ Identifier: "b", DateStamp: t1 } })
+
+    // A later version of the record, or the record in another prefix, is passed through
+    po.OnRecord(&RecordResult{ Header: oaipmh.OaipmhHeader{ Identifier: "a", DateStamp: t2 } })
+    po.OnRecord(&RecordResult{ Header: oaipmh.OaipmhHeader{ Identifier: "a", DateStamp: t1 }, Prefix: "oai_dc" })
+
+    if (counter.Selected != 4) || (po.harvested != 4) || (po.skipped != 1) {
+        t.Errorf("Expected 4 records and 1 skipped, got %d, %d and %d", counter.Selected, po.harvested, po.skipped)
+    }
+}
+
+func TestPartitionObserverWithoutDeduplication(t *testing.T) {
+    t1 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+    counter := &CountingObserver{ Predicate: AllRecordsPredicate }
+    po := &partitionObserver{ observer: counter }
+
+    po.OnRecord(&RecordResult{ Header: oaipmh.OaipmhHeader{ Identifier: "a", DateStamp: t1 } })
+    po.OnRecord(&RecordResult{ Header: oaipmh.OaipmhHeader{ Identifier: "a", DateStamp: t1 } })
+
+    if (counter.Selected != 2) || (po.harvested != 2) || (po.skipped != 0) {
+        t.Errorf("Expected 2 records and none skipped, got %d, %d and %d", counter.Selected, po.harvested, po.skipped)
+    }
+}
+
+func TestPrefixPartitions(t *testing.T) {
+    parts := PrefixPartitions([]ListIdentifierArgs{ { Set: "a" }, { Set: "b" } }, []string{ "oai_dc", "iso19139" })
+    if (len(parts) != 4) {
+        t.Fatalf("Expected 4 partitions, got %d", len(parts))
+    }
+    if (parts[1].Set != "b") || (parts[1].Prefix != "oai_dc") || (parts[2].Set != "a") || (parts[2].Prefix != "iso19139") {
+        t.Errorf("Unexpected partitions: %v", parts)
+    }
+
+    if parts := PrefixPartitions([]ListIdentifierArgs{ { Set: "a" } }, nil) ; (len(parts) != 1) || (parts[0].Prefix != "") {
+        t.Errorf("Expected partitions to be unchanged, got %v", parts)
+    }
+}
+
+func TestRecordErrorUnavailable(t *testing.T) {
+    err := RecordError{ "a", "oai_dc", oaipmh.EOaipmhError{ Code: "cannotDisseminateFormat", Message: "Not supported" } }
+    if (! err.Unavailable()) {
+        t.Error("Expected record to be unavailable")
+    }
+
+    err = RecordError{ "a", "oai_dc", oaipmh.EOaipmhError{ Code: "idDoesNotExist", Message: "Not found" } }
+    if (err.Unavailable()) {
+        t.Error("Expected record not to be unavailable")
+    }
+}
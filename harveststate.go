@@ -0,0 +1,86 @@
+package main
+
+// Harvest state files.  These record how far an incremental harvest has progressed, so that
+// the next run only needs to ask the provider for records that have changed since.
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The state of an incremental harvest of a provider, set and prefix.
+type HarvestState struct {
+	Url    string `json:"url"`
+	Set    string `json:"set"`
+	Prefix string `json:"prefix"`
+
+	// The latest datestamp of the records seen so far (the high-water mark)
+	LastDatestamp time.Time `json:"lastDatestamp"`
+
+	// The time the last successful harvest was completed
+	LastHarvested time.Time `json:"lastHarvested"`
+}
+
+// Returns the filename of the state file for a provider, set and prefix.  State files are stored
+// in the target directory of the harvest.
+func HarvestStateFilename(dir string, url string, set string, prefix string) string {
+	key := md5.Sum([]byte(url + "\n" + set + "\n" + prefix))
+	return filepath.Join(dir, fmt.Sprintf(".oaipmh-%x.state", key))
+}
+
+// Reads the harvest state from a file.  If the file does not exist, returns a new state for the
+// provider, set and prefix with no high-water mark.
+func ReadHarvestState(filename string, url string, set string, prefix string) (*HarvestState, error) {
+	state := &HarvestState{Url: url, Set: set, Prefix: prefix}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return state, nil
+}
+
+// Writes the harvest state to a file.  The file is replaced atomically, so that an interrupted
+// write does not lose the previous state.
+func (hs *HarvestState) Save(filename string) error {
+	data, err := json.MarshalIndent(hs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// Returns the date to harvest from, or nil if nothing has been harvested yet.  Records with the
+// same datestamp as the high-water mark are harvested again, as the provider may have added
+// more records with that datestamp since.
+func (hs *HarvestState) From() *time.Time {
+	if hs.LastDatestamp.IsZero() {
+		return nil
+	}
+
+	from := hs.LastDatestamp
+	return &from
+}
+
+// Records the datestamp of a harvested record, raising the high-water mark if necessary.
+func (hs *HarvestState) Observe(datestamp time.Time) {
+	if datestamp.After(hs.LastDatestamp) {
+		hs.LastDatestamp = datestamp
+	}
+}
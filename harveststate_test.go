@@ -0,0 +1,43 @@
+package main
+
+import (
+    "testing"
+    "time"
+    "io/ioutil"
+    "os"
+)
+
+func TestHarvestStateRoundTrip(t *testing.T) {
+    dir, err := ioutil.TempDir("", "harveststate")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := HarvestStateFilename(dir, "http://example.com/oai", "a", "oai_dc")
+    if (filename == HarvestStateFilename(dir, "http://example.com/oai", "b", "oai_dc")) {
+        t.Error("Expected different state files for different sets")
+    }
+
+    state, err := ReadHarvestState(filename, "http://example.com/oai", "a", "oai_dc")
+    if (err != nil) {
+        t.Fatal(err)
+    } else if (state.From() != nil) {
+        t.Errorf("Expected no high-water mark but got %v", state.From())
+    }
+
+    t1 := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+    t2 := time.Date(2017, 3, 2, 10, 0, 0, 0, time.UTC)
+    state.Observe(t2)
+    state.Observe(t1)
+    if err := state.Save(filename) ; err != nil {
+        t.Fatal(err)
+    }
+
+    state, err = ReadHarvestState(filename, "http://example.com/oai", "a", "oai_dc")
+    if (err != nil) {
+        t.Fatal(err)
+    } else if from := state.From() ; (from == nil) || !from.Equal(t2) {
+        t.Errorf("Expected a high-water mark of %v but got %v", t2, from)
+    }
+}
@@ -0,0 +1,152 @@
+package main
+
+// Output layouts.  These determine the path of the file of each harvested record within the
+// harvest directory.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The default layouts.  Records are stored in numbered directories, except for incremental harvests
+// where all records are stored in the harvest directory.
+const (
+	DefaultLayout            string = "{dir}/{name}.xml"
+	DefaultIncrementalLayout string = "{name}.xml"
+)
+
+// The values of the placeholders of a record
+type LayoutValues struct {
+	// The name of the numbered directory
+	Dir string
+
+	// The name of the record.  This is the result of the filename filter, or the identifier.
+	Name string
+
+	Record *RecordResult
+}
+
+// A layout template.  The template is a path separated by slashes, which can include the
+// following placeholders:
+//
+//	{dir}       the numbered directory of the record, e.g. 01
+//	{name}      the result of the filename filter, or the identifier if there is none
+//	{id}        the identifier of the record
+//	{set}       the first set of the record, or _ if the record is not in a set
+//	{prefix}    the metadata prefix of the record
+//	{year}, {month}, {day}
+//	            the parts of the datestamp of the record, in UTC
+//	{shard}     the first two hex digits of the SHA-1 hash of the identifier
+//
+// Values are escaped so that they cannot introduce further directories.
+type OutputLayout struct {
+	template string
+	parts    []layoutPart
+}
+
+// A part of the template.  Either literal text, or a placeholder.
+type layoutPart struct {
+	text        string
+	placeholder bool
+}
+
+// The supported placeholders
+var layoutPlaceholders = map[string]func(lv LayoutValues) string{
+	"dir":  func(lv LayoutValues) string { return lv.Dir },
+	"name": func(lv LayoutValues) string { return lv.Name },
+	"id":   func(lv LayoutValues) string { return lv.Record.Identifier() },
+	"set": func(lv LayoutValues) string {
+		if len(lv.Record.Header.SetSpec) == 0 {
+			return "_"
+		}
+		return lv.Record.Header.SetSpec[0]
+	},
+	"prefix": func(lv LayoutValues) string { return lv.Record.Prefix },
+	"year":   func(lv LayoutValues) string { return lv.Record.Header.DateStamp.UTC().Format("2006") },
+	"month":  func(lv LayoutValues) string { return lv.Record.Header.DateStamp.UTC().Format("01") },
+	"day":    func(lv LayoutValues) string { return lv.Record.Header.DateStamp.UTC().Format("02") },
+	"shard": func(lv LayoutValues) string {
+		hash := sha1.Sum([]byte(lv.Record.Identifier()))
+		return hex.EncodeToString(hash[:1])
+	},
+}
+
+// Parses a layout template.  Returns an error if the template uses an unknown placeholder, if
+// the path would be outside the harvest directory, or if records would not have a file each.
+func ParseOutputLayout(template string) (*OutputLayout, error) {
+	if strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("layout '%s' must be relative to the harvest directory", template)
+	}
+	for _, elem := range strings.Split(template, "/") {
+		if (elem == "") || (elem == ".") || (elem == "..") {
+			return nil, fmt.Errorf("layout '%s' has an invalid path element '%s'", template, elem)
+		}
+	}
+
+	layout := &OutputLayout{template: template}
+	for rest := template; rest != ""; {
+		start := strings.Index(rest, "{")
+		if start == -1 {
+			layout.parts = append(layout.parts, layoutPart{rest, false})
+			break
+		}
+
+		end := strings.Index(rest[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("layout '%s' has an unclosed placeholder", template)
+		}
+		end += start
+
+		name := rest[start+1 : end]
+		if _, isPlaceholder := layoutPlaceholders[name]; !isPlaceholder {
+			return nil, fmt.Errorf("layout '%s' has an unknown placeholder '{%s}'", template, name)
+		}
+
+		if start > 0 {
+			layout.parts = append(layout.parts, layoutPart{rest[:start], false})
+		}
+		layout.parts = append(layout.parts, layoutPart{name, true})
+		rest = rest[end+1:]
+	}
+
+	if !layout.Has("name") && !layout.Has("id") {
+		return nil, fmt.Errorf("layout '%s' must include {name} or {id}, so that each record has its own file", template)
+	}
+	return layout, nil
+}
+
+// Returns the template of the layout
+func (ol *OutputLayout) String() string {
+	return ol.template
+}
+
+// Returns true if the layout uses a placeholder
+func (ol *OutputLayout) Has(placeholder string) bool {
+	for _, part := range ol.parts {
+		if part.placeholder && (part.text == placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the path of a record, separated by slashes.
+func (ol *OutputLayout) Path(lv LayoutValues) string {
+	var sb strings.Builder
+	for _, part := range ol.parts {
+		if !part.placeholder {
+			sb.WriteString(part.text)
+			continue
+		}
+
+		value := EscapeIdForFilename(layoutPlaceholders[part.text](lv))
+		if (value == "") || (value == ".") || (value == "..") {
+			value = "_"
+		}
+		sb.WriteString(value)
+	}
+	return path.Clean(sb.String())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/lmika/oaipmh/client"
+)
+
+func TestOutputLayoutPath(t *testing.T) {
+    rr := &RecordResult{
+        Header: oaipmh.OaipmhHeader{ Identifier: "oai:x/1", DateStamp: time.Date(2017, 3, 4, 23, 0, 0, 0, time.UTC), SetSpec: []string{"a:b", "c"} },
+        Prefix: "oai_dc",
+    }
+    lv := LayoutValues{ Dir: "01", Name: "oai:x/1", Record: rr }
+
+    for template, exp := range map[string]string{
+        DefaultLayout: "01/oai:x%2F1.xml",
+        DefaultIncrementalLayout: "oai:x%2F1.xml",
+        "{set}/{year}/{month}/{name}.{prefix}.xml": "a:b/2017/03/oai:x%2F1.oai_dc.xml",
+        "{year}-{month}-{day}/{id}": "2017-03-04/oai:x%2F1",
+    } {
+        layout, err := ParseOutputLayout(template)
+        if (err != nil) {
+            t.Errorf("%s: %s", template, err)
+        } else if path := layout.Path(lv) ; path != exp {
+            t.Errorf("%s: expected %s but got %s", template, exp, path)
+        }
+    }
+
+    // Records without a set, and shards
+    rr.Header.SetSpec = nil
+    layout, _ := ParseOutputLayout("{set}/{shard}/{name}.xml")
+    if path := layout.Path(lv) ; (len(path) != len("_/00/oai:x%2F1.xml")) || (path[:2] != "_/") {
+        t.Errorf("Unexpected path %s", path)
+    }
+}
+
+func TestParseOutputLayoutErrors(t *testing.T) {
+    for _, template := range []string{ "/{name}.xml", "../{name}.xml", "{dir}//{name}", "{nope}.xml", "{name.xml", "{set}/{year}.xml" } {
+        if _, err := ParseOutputLayout(template) ; err == nil {
+            t.Errorf("%s: expected error", template)
+        }
+    }
+
+    layout, _ := ParseOutputLayout("{set}/{name}.xml")
+    if !layout.Has("set") || layout.Has("prefix") {
+        t.Error("Unexpected placeholders")
+    }
+}
@@ -0,0 +1,222 @@
+package main
+
+// The harvest manifest.  This records the file each harvested record was written to, so that
+// the file can be found again when the record is changed or deleted, along with the hash of the
+// content of the record, so that unchanged records are not written again.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The filename of the manifest within the harvest directory
+const ManifestFilename string = "manifest.tsv"
+
+// An index of record identifiers to the paths of the harvested files.  Paths are relative to the
+// harvest directory.
+//
+// The manifest is stored as a tab separated file of identifiers, paths and content hashes.  The
+// hash may be missing from manifests written before hashes were recorded.  Changes are appended
+// to the file as they are made, with an empty path marking a removed record, and the file is
+// rewritten without the superseded lines when the manifest is saved.
+type Manifest struct {
+	filename string
+	entries  map[string]manifestEntry
+	owners   map[string]string
+	file     *os.File
+	w        *bufio.Writer
+}
+
+// The path and content hash of a record
+type manifestEntry struct {
+	path string
+	hash string
+}
+
+// Opens the manifest in the harvest directory.  If the manifest does not exist, returns an
+// empty manifest.  A last line without a newline was cut short when a harvest was interrupted,
+// and is dropped from the file so that changes can be appended after it.
+func OpenManifest(dir string) (*Manifest, error) {
+	m := &Manifest{
+		filename: filepath.Join(dir, ManifestFilename),
+		entries:  make(map[string]manifestEntry),
+		owners:   make(map[string]string),
+	}
+
+	file, err := os.OpenFile(m.filename, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var size int64
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				if err := file.Truncate(size); err != nil {
+					return nil, fmt.Errorf("%s: %s", m.filename, err.Error())
+				}
+			}
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", m.filename, err.Error())
+		}
+		size += int64(len(line))
+
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 3)
+		if len(fields) < 2 {
+			continue
+		} else if fields[1] == "" {
+			m.remove(fields[0])
+		} else if len(fields) == 2 {
+			m.set(fields[0], manifestEntry{fields[1], ""})
+		} else {
+			m.set(fields[0], manifestEntry{fields[1], fields[2]})
+		}
+	}
+	return m, nil
+}
+
+// Returns the path of the file of a record, if it has been harvested.
+func (m *Manifest) Path(id string) (string, bool) {
+	entry, hasEntry := m.entries[id]
+	return entry.path, hasEntry
+}
+
+// Returns the content hash of a record.  Returns an empty string if the record has not been
+// harvested, or if the hash was not recorded.
+func (m *Manifest) Hash(id string) string {
+	return m.entries[id].hash
+}
+
+// Returns the record whose file is at the path, if there is one.
+func (m *Manifest) Owner(path string) (string, bool) {
+	id, hasOwner := m.owners[path]
+	return id, hasOwner
+}
+
+// Records the path of the file of a record, along with the hash of its content.
+func (m *Manifest) Set(id string, path string, hash string) error {
+	m.set(id, manifestEntry{path, hash})
+	return m.append(id, m.entries[id])
+}
+
+// Removes a record from the manifest.
+func (m *Manifest) Remove(id string) error {
+	m.remove(id)
+	return m.append(id, manifestEntry{})
+}
+
+// Sets the entry of a record, keeping the owners of the paths up to date
+func (m *Manifest) set(id string, entry manifestEntry) {
+	m.remove(id)
+	m.entries[id] = entry
+	m.owners[entry.path] = id
+}
+
+// Removes the entry of a record, keeping the owners of the paths up to date
+func (m *Manifest) remove(id string) {
+	if entry, hasEntry := m.entries[id]; hasEntry {
+		if m.owners[entry.path] == id {
+			delete(m.owners, entry.path)
+		}
+		delete(m.entries, id)
+	}
+}
+
+// Returns the number of records in the manifest.
+func (m *Manifest) Len() int {
+	return len(m.entries)
+}
+
+// Writes any changes which have not been written to the file.
+func (m *Manifest) Flush() error {
+	if m.w == nil {
+		return nil
+	}
+	return m.w.Flush()
+}
+
+// Rewrites the manifest sorted by identifier, dropping the lines of changes which have been
+// superseded.  The file is replaced atomically.
+func (m *Manifest) Save() error {
+	if err := m.Close(); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(m.entries))
+	for id := range m.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tmpFilename := m.filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, id := range ids {
+		writeManifestEntry(w, id, m.entries[id])
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, m.filename)
+}
+
+// Writes any changes and closes the file.
+func (m *Manifest) Close() error {
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.w.Flush()
+	if err2 := m.file.Close(); err == nil {
+		err = err2
+	}
+	m.file, m.w = nil, nil
+	return err
+}
+
+// Appends a change to the file, opening it if necessary.
+func (m *Manifest) append(id string, entry manifestEntry) error {
+	if m.file == nil {
+		if err := os.MkdirAll(filepath.Dir(m.filename), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(m.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		m.file, m.w = file, bufio.NewWriter(file)
+	}
+
+	return writeManifestEntry(m.w, id, entry)
+}
+
+// Writes the line of a record.  The hash is left out if there is none.
+func writeManifestEntry(w io.Writer, id string, entry manifestEntry) error {
+	var err error
+	if entry.hash == "" {
+		_, err = fmt.Fprintf(w, "%s\t%s\n", id, entry.path)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\t%s\t%s\n", id, entry.path, entry.hash)
+	}
+	return err
+}
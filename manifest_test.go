@@ -0,0 +1,96 @@
+package main
+
+import (
+    "testing"
+    "io/ioutil"
+    "os"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+    dir, err := ioutil.TempDir("", "manifest")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    m, err := OpenManifest(dir)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    m.Set("urn:a", "01/urn:a.xml", "")
+    m.Set("urn:b", "01/urn:b.xml", "")
+    m.Set("urn:c", "02/c.xml", "abc123")
+    m.Remove("urn:b")
+    if err := m.Save() ; err != nil {
+        t.Fatal(err)
+    }
+
+    m, err = OpenManifest(dir)
+    if (err != nil) {
+        t.Fatal(err)
+    } else if (m.Len() != 2) {
+        t.Errorf("Expected 2 records but got %d", m.Len())
+    }
+
+    if path, hasPath := m.Path("urn:c") ; !hasPath || (path != "02/c.xml") {
+        t.Errorf("Expected path of urn:c to be 02/c.xml but got '%s'", path)
+    }
+    if (m.Hash("urn:c") != "abc123") || (m.Hash("urn:a") != "") {
+        t.Errorf("Expected hash of urn:c to be abc123 and urn:a to have no hash")
+    }
+    if _, hasPath := m.Path("urn:b") ; hasPath {
+        t.Errorf("Expected urn:b to be removed")
+    }
+}
+
+func TestManifestAppendsChanges(t *testing.T) {
+    dir, err := ioutil.TempDir("", "manifest")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    m, _ := OpenManifest(dir)
+    m.Set("urn:a", "a.xml", "")
+    m.Set("urn:b", "b.xml", "")
+    m.Set("urn:a", "a2.xml", "")
+    m.Remove("urn:b")
+    if err := m.Close() ; err != nil {
+        t.Fatal(err)
+    }
+
+    m, err = OpenManifest(dir)
+    if (err != nil) {
+        t.Fatal(err)
+    } else if path, _ := m.Path("urn:a") ; (m.Len() != 1) || (path != "a2.xml") {
+        t.Errorf("Expected only urn:a at a2.xml but got %d records, urn:a at '%s'", m.Len(), path)
+    }
+}
+
+func TestManifestOwners(t *testing.T) {
+    dir, err := ioutil.TempDir("", "manifest")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    m, _ := OpenManifest(dir)
+    m.Set("urn:a", "a.xml", "")
+    m.Set("urn:b", "b.xml", "")
+    m.Set("urn:a", "a2.xml", "")
+    m.Remove("urn:b")
+    m.Close()
+
+    for _, m := range []*Manifest{ m, func() *Manifest { m, _ := OpenManifest(dir) ; return m }() } {
+        if owner, hasOwner := m.Owner("a2.xml") ; !hasOwner || (owner != "urn:a") {
+            t.Errorf("Expected a2.xml to be the file of urn:a, got '%s'", owner)
+        }
+        if _, hasOwner := m.Owner("a.xml") ; hasOwner {
+            t.Error("Expected a.xml to have no owner once urn:a has moved")
+        }
+        if _, hasOwner := m.Owner("b.xml") ; hasOwner {
+            t.Error("Expected b.xml to have no owner once urn:b is removed")
+        }
+    }
+}
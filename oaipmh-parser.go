@@ -3,8 +3,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/lmika/oaipmh/client"
@@ -12,9 +16,18 @@ import (
 
 // The arguments to the list identifier string
 type ListIdentifierArgs struct {
-	Set   string     // The set to query
-	From  *time.Time // The from time (nil == no check)
-	Until *time.Time // The until time (nil == no check)
+	Set         string     // The set to query
+	From        *time.Time // The from time (nil == no check)
+	Until       *time.Time // The until time (nil == no check)
+	Granularity string     // The granularity supported by the provider (empty == seconds)
+	Prefix      string     // The metadata prefix (empty == the prefix of the session)
+
+	// Resume a ListRecords listing from this resumption token.  If the token has expired, the listing
+	// is issued again using the other arguments, with FallbackFirstResult and FallbackMaxResults used
+	// instead of the first and maximum number of results given to ListRecords.
+	ResumptionToken     string
+	FallbackFirstResult int
+	FallbackMaxResults  int
 }
 
 // The result from listing the identifiers
@@ -32,6 +45,12 @@ type RecordResult struct {
 	Header  oaipmh.OaipmhHeader
 	Content string
 	Deleted bool
+
+	// The metadata prefix of the content, if known
+	Prefix string
+
+	// The content parsed by rs-expressions
+	parsed *parsedContent
 }
 
 func (r *RecordResult) AsHeaderResult() *HeaderResult {
@@ -46,19 +65,50 @@ func (r *RecordResult) Identifier() string {
 // The Oaipmh Session
 
 type OaipmhSession struct {
-	client  *oaipmh.Client
-	url     string
-	prefix  string
-	traceFn func(string)
+	client     *oaipmh.Client
+	url        string
+	prefix     string
+	traceFn    func(string)
+	listSizeFn func(size int)
+	pageFn     func(token string, results int)
+	streaming  bool
+
+	// Set to 1 once a listing is stopped at the maximum number of results, or is issued again
+	// because its resumption token has expired.  Listings of partitions run in parallel, so these
+	// are set atomically.
+	truncated int32
+	relisted  int32
 }
 
 // Creates a new OaipmhSession
-func NewOaipmhSession(url, prefix string) *OaipmhSession {
-	c, err := oaipmh.NewClient(url)
+func NewOaipmhSession(url, prefix string, opts ...oaipmh.ClientOption) *OaipmhSession {
+	c, err := oaipmh.NewClient(url, opts...)
 	if err != nil {
 		panic(err)
 	}
-	return &OaipmhSession{c, url, prefix, func(string) {}}
+	return &OaipmhSession{client: c, url: url, prefix: prefix, traceFn: func(string) {}}
+}
+
+// Returns true if a listing of records or identifiers was stopped at the maximum number of
+// results, in which case there may be records which were not listed.
+func (op *OaipmhSession) Truncated() bool {
+	return atomic.LoadInt32(&op.truncated) != 0
+}
+
+// Returns true if a listing was issued again from the start because its resumption token has
+// expired, in which case records may be listed again.
+func (op *OaipmhSession) Relisted() bool {
+	return atomic.LoadInt32(&op.relisted) != 0
+}
+
+// Returns the URL of the provider
+func (op *OaipmhSession) Url() string {
+	return op.url
+}
+
+// Returns the metadata prefix of the records
+func (op *OaipmhSession) Prefix() string {
+	return op.prefix
 }
 
 // Sets the debugging level (0 = none, 1 = request, 2 = request/response)
@@ -77,6 +127,39 @@ func (op *OaipmhSession) SetUseGet(useGet bool) {
 	op.client.UseGet = useGet
 }
 
+// Returns the policy for retrying failed requests
+func (op *OaipmhSession) RetryPolicy() oaipmh.RetryPolicy {
+	return op.client.Retry
+}
+
+// Sets the policy for retrying failed requests
+func (op *OaipmhSession) SetRetryPolicy(policy oaipmh.RetryPolicy) {
+	op.client.Retry = policy
+}
+
+// Set whether ListRecords responses are decoded one record at a time as they are read.
+func (op *OaipmhSession) SetStreaming(streaming bool) {
+	op.streaming = streaming
+}
+
+// Sets the recorder which receives a copy of each response from the provider
+func (op *OaipmhSession) SetRecorder(recorder oaipmh.ResponseRecorder) {
+	op.client.Recorder = recorder
+}
+
+// Sets a function which is called with the number of results a listing is expected to return,
+// whenever the provider advertises the complete list size.
+func (op *OaipmhSession) SetListSizeFn(listSizeFn func(size int)) {
+	op.listSizeFn = listSizeFn
+}
+
+// Sets a function which is called whenever a listing moves on to a new page.  The function is
+// called with the resumption token of the new page and the number of results before it.  All
+// results before the new page will have been passed to the listing callback.
+func (op *OaipmhSession) SetPageFn(pageFn func(token string, results int)) {
+	op.pageFn = pageFn
+}
+
 // Stifle error messages which indicate no more results.  This is so that the user doesn't see them.
 func (op *OaipmhSession) stifleNoResultErrors(e error) error {
 	switch err := e.(type) {
@@ -94,11 +177,40 @@ func (op *OaipmhSession) stifleNoResultErrors(e error) error {
 }
 
 // Runs an iterator function only calling the stepFn between firstResult and maxResults.  If the stepFn returns false,
-// stops the iterator early.
-func (op *OaipmhSession) iteratorSubset(iterator oaipmh.RecordIterator, firstResult int, maxResults int, withIter func(i oaipmh.RecordIterator) error) error {
+// stops the iterator early.  Returns the context error if the context is cancelled.
+func (op *OaipmhSession) iteratorSubset(ctx context.Context, iterator oaipmh.RecordIterator, firstResult int, maxResults int, withIter func(i oaipmh.RecordIterator) error) error {
 	var resultCount int = 0
+	var listSize int = -1
+	var pageToken string
 	var err error
+
+	pagedIterator, isPaged := iterator.(oaipmh.PagedIterator)
+	if isPaged {
+		pageToken = pagedIterator.PageToken()
+	}
+
+	// Streaming iterators hold the response open until they are read to the end
+	if closer, isCloser := iterator.(io.Closer); isCloser {
+		defer closer.Close()
+	}
+
 	for err = iterator.Next(); err == nil; err = iterator.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if isPaged && (pagedIterator.PageToken() != pageToken) {
+			pageToken = pagedIterator.PageToken()
+			if op.pageFn != nil {
+				op.pageFn(pageToken, resultCount)
+			}
+		}
+
+		if size := iterator.CompleteListSize(); (size != listSize) && (op.listSizeFn != nil) {
+			listSize = size
+			op.listSizeFn(expectedResults(size, firstResult, maxResults))
+		}
+
 		if resultCount >= firstResult {
 			err2 := withIter(iterator)
 			if err2 != nil {
@@ -109,6 +221,7 @@ func (op *OaipmhSession) iteratorSubset(iterator oaipmh.RecordIterator, firstRes
 		resultCount++
 		if (resultCount >= firstResult+maxResults) && (maxResults != -1) {
 			fmt.Fprintf(os.Stderr, "Maximum number of results encountered (%d).  Use -c to change.\n", maxResults)
+			atomic.StoreInt32(&op.truncated, 1)
 			return nil
 		}
 	}
@@ -116,21 +229,39 @@ func (op *OaipmhSession) iteratorSubset(iterator oaipmh.RecordIterator, firstRes
 	return err
 }
 
+// Returns the number of results expected from a list of the given size, taking into account
+// the first and maximum number of results.  Returns -1 if the list size is not known.
+func expectedResults(listSize int, firstResult int, maxResults int) int {
+	if listSize < 0 {
+		return -1
+	}
+
+	expected := listSize - firstResult
+	if expected < 0 {
+		expected = 0
+	}
+	if (maxResults != -1) && (maxResults < expected) {
+		expected = maxResults
+	}
+	return expected
+}
+
 // Returns a list of identifiers
-func (op *OaipmhSession) ListIdentifiers(listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(res *HeaderResult) bool) error {
+func (op *OaipmhSession) ListIdentifiers(ctx context.Context, listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(res *HeaderResult) bool) error {
 	var err error
 
-	ri, err := op.client.ListIdentifiers(oaipmh.ListArgs{
-		Prefix: op.prefix,
-		From:   listArgs.From,
-		Until:  listArgs.Until,
-		Set:    listArgs.Set,
+	ri, err := op.client.ListIdentifiersContext(ctx, oaipmh.ListArgs{
+		Prefix:      op.listPrefix(listArgs),
+		From:        listArgs.From,
+		Until:       listArgs.Until,
+		Set:         listArgs.Set,
+		Granularity: listArgs.Granularity,
 	})
 	if err != nil {
 		return op.stifleNoResultErrors(err)
 	}
 
-	err = op.iteratorSubset(ri, firstResult, maxResults, func(i oaipmh.RecordIterator) error {
+	err = op.iteratorSubset(ctx, ri, firstResult, maxResults, func(i oaipmh.RecordIterator) error {
 		h, err2 := i.Header()
 		if err2 != nil {
 			return err2
@@ -146,21 +277,72 @@ func (op *OaipmhSession) ListIdentifiers(listArgs ListIdentifierArgs, firstResul
 	return op.stifleNoResultErrors(err)
 }
 
+// Returns the metadata prefix of a listing
+func (op *OaipmhSession) listPrefix(listArgs ListIdentifierArgs) string {
+	if listArgs.Prefix != "" {
+		return listArgs.Prefix
+	}
+	return op.prefix
+}
+
+// Starts a ListRecords request, either streaming the records or decoding each page in full.  Returns
+// true if the listing was issued again because the resumption token has expired.
+func (op *OaipmhSession) listRecords(ctx context.Context, listArgs ListIdentifierArgs) (oaipmh.RecordIterator, bool, error) {
+	args := oaipmh.ListArgs{
+		Prefix:      op.listPrefix(listArgs),
+		From:        listArgs.From,
+		Until:       listArgs.Until,
+		Set:         listArgs.Set,
+		Granularity: listArgs.Granularity,
+	}
+
+	if listArgs.ResumptionToken != "" {
+		ri, err := op.resumeRecords(ctx, listArgs.ResumptionToken)
+		if oaiErr, isOaiErr := err.(oaipmh.EOaipmhError); !isOaiErr || (oaiErr.Code != "badResumptionToken") {
+			return ri, false, err
+		}
+		log.Printf("Resumption token has expired, listing again from %s", describeDate(listArgs.From))
+		atomic.StoreInt32(&op.relisted, 1)
+	}
+
+	var ri oaipmh.RecordIterator
+	var err error
+	if op.streaming {
+		ri, err = op.client.StreamRecordsContext(ctx, args)
+	} else {
+		ri, err = op.client.ListRecordsContext(ctx, args)
+	}
+	return ri, listArgs.ResumptionToken != "", err
+}
+
+// Resumes a ListRecords request from a resumption token.
+func (op *OaipmhSession) resumeRecords(ctx context.Context, resToken string) (oaipmh.RecordIterator, error) {
+	if op.streaming {
+		return op.client.ResumeStreamRecordsContext(ctx, resToken)
+	}
+	return op.client.ResumeListRecordsContext(ctx, resToken)
+}
+
+// Describes a date argument for logging
+func describeDate(date *time.Time) string {
+	if date == nil {
+		return "the start"
+	}
+	return date.UTC().Format(time.RFC3339)
+}
+
 // Returns a list of identifiers using the ListRecord verb
-func (op *OaipmhSession) ListIdentifiersUsingListRecords(listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(res *HeaderResult) bool) error {
+func (op *OaipmhSession) ListIdentifiersUsingListRecords(ctx context.Context, listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(res *HeaderResult) bool) error {
 	var err error
 
-	ri, err := op.client.ListRecords(oaipmh.ListArgs{
-		Prefix: op.prefix,
-		From:   listArgs.From,
-		Until:  listArgs.Until,
-		Set:    listArgs.Set,
-	})
+	ri, relisted, err := op.listRecords(ctx, listArgs)
 	if err != nil {
 		return op.stifleNoResultErrors(err)
+	} else if relisted {
+		firstResult, maxResults = listArgs.FallbackFirstResult, listArgs.FallbackMaxResults
 	}
 
-	err = op.iteratorSubset(ri, firstResult, maxResults, func(i oaipmh.RecordIterator) error {
+	err = op.iteratorSubset(ctx, ri, firstResult, maxResults, func(i oaipmh.RecordIterator) error {
 		h, err2 := i.Record()
 		if err2 != nil {
 			return err2
@@ -179,25 +361,23 @@ func (op *OaipmhSession) ListIdentifiersUsingListRecords(listArgs ListIdentifier
 }
 
 // Returns a list of records
-func (op *OaipmhSession) ListRecords(listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(recordResult *RecordResult) bool) error {
+func (op *OaipmhSession) ListRecords(ctx context.Context, listArgs ListIdentifierArgs, firstResult int, maxResults int, callback func(recordResult *RecordResult) bool) error {
 	var err error
 
-	ri, err := op.client.ListRecords(oaipmh.ListArgs{
-		Prefix: op.prefix,
-		From:   listArgs.From,
-		Until:  listArgs.Until,
-		Set:    listArgs.Set,
-	})
+	ri, relisted, err := op.listRecords(ctx, listArgs)
 	if err != nil {
 		return op.stifleNoResultErrors(err)
+	} else if relisted {
+		firstResult, maxResults = listArgs.FallbackFirstResult, listArgs.FallbackMaxResults
 	}
 
-	err = op.iteratorSubset(ri, firstResult, maxResults, func(i oaipmh.RecordIterator) error {
+	err = op.iteratorSubset(ctx, ri, firstResult, maxResults, func(i oaipmh.RecordIterator) error {
 		h, err2 := i.Record()
 		if err2 != nil {
 			return err2
 		}
 		res := RecordToRecordResult(h)
+		res.Prefix = op.listPrefix(listArgs)
 		if !callback(res) {
 			return oaipmh.ENoMore{}
 		} else {
@@ -208,23 +388,59 @@ func (op *OaipmhSession) ListRecords(listArgs ListIdentifierArgs, firstResult in
 	return op.stifleNoResultErrors(err)
 }
 
-// Lists the sets provided by this provider
-func (op *OaipmhSession) ListSets(firstResult int, maxResults int, callback func(oaipmh.OaipmhSet) bool) error {
-	sets, err := op.client.ListSets()
+// Lists the sets provided by this provider.  Only calls the callback between firstResult and
+// maxResults.  If the callback returns false, stops listing early.
+func (op *OaipmhSession) ListSets(ctx context.Context, firstResult int, maxResults int, callback func(oaipmh.OaipmhSet) bool) error {
+	ls, err := op.client.IterateSetsContext(ctx)
 	if err != nil {
-		return err
+		return op.stifleNoResultErrors(err)
 	}
 
-	for _, set := range sets {
-		callback(set)
+	var resultCount int = 0
+	for err = ls.Next(); err == nil; err = ls.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if resultCount >= firstResult {
+			set, err2 := ls.Set()
+			if err2 != nil {
+				return err2
+			}
+			if !callback(*set) {
+				return nil
+			}
+		}
+
+		resultCount++
+		if (resultCount >= firstResult+maxResults) && (maxResults != -1) {
+			fmt.Fprintf(os.Stderr, "Maximum number of results encountered (%d).  Use -c to change.\n", maxResults)
+			return nil
+		}
 	}
 
-	return nil
+	return op.stifleNoResultErrors(err)
+}
+
+// Returns the identity of the provider
+func (op *OaipmhSession) Identify(ctx context.Context) (*oaipmh.OaipmhIdentify, error) {
+	return op.client.IdentifyContext(ctx)
+}
+
+// Returns the metadata formats supported by the provider.  If identifier is not empty, only
+// the formats available for that record are returned.
+func (op *OaipmhSession) ListMetadataFormats(ctx context.Context, identifier string) ([]oaipmh.Format, error) {
+	return op.client.ListMetadataFormatsContext(ctx, identifier)
 }
 
 // Returns a record by ID
-func (op *OaipmhSession) GetRecord(id string) (*oaipmh.OaipmhRecord, error) {
-	rec, err := op.client.GetRecord(op.prefix, id)
+func (op *OaipmhSession) GetRecord(ctx context.Context, id string) (*oaipmh.OaipmhRecord, error) {
+	return op.GetRecordWithPrefix(ctx, id, op.prefix)
+}
+
+// Returns a record by ID in a particular metadata prefix
+func (op *OaipmhSession) GetRecordWithPrefix(ctx context.Context, id string, prefix string) (*oaipmh.OaipmhRecord, error) {
+	rec, err := op.client.GetRecordContext(ctx, prefix, id)
 	if err != nil {
 		return nil, err
 	} else {
@@ -234,5 +450,5 @@ func (op *OaipmhSession) GetRecord(id string) (*oaipmh.OaipmhRecord, error) {
 
 // Converts an OaipmhRecord into a RecordResult
 func RecordToRecordResult(r *oaipmh.OaipmhRecord) *RecordResult {
-	return &RecordResult{r.Header, r.Content.Xml, r.Header.Status == "deleted"}
+	return &RecordResult{Header: r.Header, Content: r.Content.Xml, Deleted: r.Header.Status == "deleted"}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "testing"
+
+    "github.com/lmika/oaipmh/client"
+)
+
+// Test that a session is only truncated when a listing is stopped at the maximum number of results
+func TestSessionTruncated(t *testing.T) {
+    for _, test := range []struct {
+        maxResults  int
+        truncated   bool
+    } {
+        { -1, false },
+        { 10, false },
+        { 2, true },
+    } {
+        op := &OaipmhSession{}
+        iterator := &testRecordIterator{ count: 5 }
+        op.iteratorSubset(context.Background(), iterator, 0, test.maxResults, func(i oaipmh.RecordIterator) error {
+            return nil
+        })
+        if (op.Truncated() != test.truncated) {
+            t.Errorf("%d: expected truncated to be %v", test.maxResults, test.truncated)
+        }
+    }
+}
+
+// An iterator of a number of records
+type testRecordIterator struct {
+    count       int
+    pos         int
+}
+
+func (ti *testRecordIterator) Next() error {
+    if (ti.pos >= ti.count) {
+        return oaipmh.ENoMore{}
+    }
+    ti.pos++
+    return nil
+}
+
+func (ti *testRecordIterator) Header() (*oaipmh.OaipmhHeader, error) {
+    return &oaipmh.OaipmhHeader{ Identifier: fmt.Sprintf("rec:%d", ti.pos) }, nil
+}
+
+func (ti *testRecordIterator) Record() (*oaipmh.OaipmhRecord, error) {
+    header, _ := ti.Header()
+    return &oaipmh.OaipmhRecord{ Header: *header }, nil
+}
+
+func (ti *testRecordIterator) CompleteListSize() int {
+    return -1
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 
 	"sort"
+	"time"
 
 	"github.com/lmika/command"
 )
@@ -26,6 +27,9 @@ var debugLots *bool = flag.Bool("dd", false, "Show trace messages")
 var displayVersion *bool = flag.Bool("V", false, "Display version and exit")
 var listProvidersFlag *bool = flag.Bool("P", false, "List providers and exit")
 var useGetFlag *bool = flag.Bool("G", false, "Use HTTP GET instead of HTTP POST")
+var streamFlag *bool = flag.Bool("S", false, "Decode ListRecords responses one record at a time")
+var maxAttemptsFlag *int = flag.Int("r", 0, "Maximum number of attempts for each request")
+var retryBackoffFlag *time.Duration = flag.Duration("rb", 0, "Backoff before retrying a failed request")
 
 // Die with an error message
 func die(msg string) {
@@ -64,6 +68,8 @@ func main() {
 	command.OnHelpIgnorePreargs()
 
 	command.On("compare", "Compare providers", &CompareCommand{Ctx: ctx}).Arguments("otherProvider")
+	command.On("identify", "Display information about the provider", &IdentifyCommand{Ctx: ctx}).Arguments()
+	command.On("formats", "List metadata formats", &FormatsCommand{Ctx: ctx}).Arguments()
 	command.On("sets", "List sets", &SetsCommand{Ctx: ctx}).Arguments()
 	command.On("list", "List identifiers", &ListCommand{Ctx: ctx}).Arguments()
 	command.On("get", "Get records", &GetCommand{Ctx: ctx}).Arguments("record", "...")
@@ -98,8 +104,13 @@ func main() {
 
 	// Create the OAI-PMH session
 	ctx.Provider = ctx.Config.LookupProvider(*providerUrl)
+	ctx.ProviderName = *providerUrl
 	if ctx.Provider != nil {
-		ctx.Session = NewOaipmhSession(ctx.Provider.Url, *prefix)
+		session, err := ctx.Provider.NewSession(*prefix)
+		if err != nil {
+			die(fmt.Sprintf("provider %s: %s", *providerUrl, err.Error()))
+		}
+		ctx.Session = session
 	}
 
 	debugLevel := 0
@@ -114,7 +125,19 @@ func main() {
 		ctx.Session.SetDebug(debugLevel)
 	}
 	ctx.Session.SetUseGet(*useGetFlag)
+	ctx.Session.SetStreaming(*streamFlag)
+
+	// Flags override the retry policy of the provider configuration
+	retryPolicy := ctx.Session.RetryPolicy()
+	if *maxAttemptsFlag > 0 {
+		retryPolicy.MaxAttempts = *maxAttemptsFlag
+	}
+	if *retryBackoffFlag > 0 {
+		retryPolicy.BaseBackoff = *retryBackoffFlag
+	}
+	ctx.Session.SetRetryPolicy(retryPolicy)
 
-	// Run the command
+	// Run the command.  Commands are given the chance to stop cleanly when interrupted.
+	ctx.RunContext = InterruptibleContext()
 	command.Run()
 }
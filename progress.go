@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------------------
+// Progress reporter
+//      Logs the progress of long running listings and harvests, including an estimate of the
+//      time remaining when the provider advertises the complete list size.
+
+type ProgressReporter struct {
+	// The verb used in the progress message, e.g. "Harvested"
+	Verb string
+
+	// The number of records between each progress message
+	Interval int
+
+	started time.Time
+	total   int64
+}
+
+// Creates a new progress reporter.  The estimate of the time remaining is measured from when
+// the reporter was created.
+func NewProgressReporter(verb string, interval int) *ProgressReporter {
+	return &ProgressReporter{Verb: verb, Interval: interval, started: time.Now(), total: -1}
+}
+
+// Sets the total number of records expected.  This can be called from any goroutine.
+func (pr *ProgressReporter) SetTotal(total int) {
+	atomic.StoreInt64(&pr.total, int64(total))
+}
+
+// Called with the number of records processed so far.  Logs a progress message every Interval
+// records.
+func (pr *ProgressReporter) Update(count int) {
+	if (pr.Interval > 0) && (count%pr.Interval == 0) {
+		log.Println(pr.Message(count))
+	}
+}
+
+// Returns the progress message for the number of records processed so far
+func (pr *ProgressReporter) Message(count int) string {
+	total := int(atomic.LoadInt64(&pr.total))
+	if (total <= 0) || (count > total) {
+		return fmt.Sprintf("%s %s records", pr.Verb, FormatCount(count))
+	}
+
+	msg := fmt.Sprintf("%s %s of %s records (%d%%)", pr.Verb, FormatCount(count), FormatCount(total), count*100/total)
+	if (count > 0) && (count < total) {
+		elapsed := time.Since(pr.started)
+		remaining := time.Duration(float64(elapsed) / float64(count) * float64(total-count))
+		msg += fmt.Sprintf(", about %s remaining", remaining.Truncate(time.Second))
+	}
+	return msg
+}
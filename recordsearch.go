@@ -11,6 +11,8 @@ import (
     "strings"
     "bytes"
     "fmt"
+    "math"
+    "time"
 
     "launchpad.net/xmlpath"
 )
@@ -74,6 +76,111 @@ func (b RSBool) String() string {
     }
 }
 
+// A number value
+type RSNumber       float64
+
+func (n RSNumber) Bool() bool {
+    return (float64(n) != 0) && !math.IsNaN(float64(n))
+}
+
+func (n RSNumber) String() string {
+    return strconv.FormatFloat(float64(n), 'f', -1, 64)
+}
+
+
+// A date value.  Dates are displayed in UTC.
+type RSDate         time.Time
+
+func (d RSDate) Bool() bool {
+    return !time.Time(d).IsZero()
+}
+
+func (d RSDate) String() string {
+    return time.Time(d).UTC().Format(time.RFC3339)
+}
+
+
+// A list of values, such as the nodes matched by xp().  When used as a single value, the list
+// takes on the value of the first item, or the empty string if the list is empty.
+type RSList         []RSExprValue
+
+func (l RSList) Bool() bool {
+    return l.first().Bool()
+}
+
+func (l RSList) String() string {
+    return l.first().String()
+}
+
+func (l RSList) first() RSExprValue {
+    if (len(l) == 0) {
+        return RSString("")
+    }
+    return l[0]
+}
+
+
+// The layouts of dates accepted by date().  Dates without a timezone are in UTC.
+var rsDateLayouts = []string {
+    time.RFC3339Nano,
+    "2006-01-02T15:04:05",
+    "2006-01-02T15:04",
+    "2006-01-02",
+    "2006-01",
+    "2006",
+}
+
+// Returns the name of the type of a value, for use in error messages
+func rsTypeName(v RSExprValue) string {
+    switch v.(type) {
+    case RSString:
+        return "string"
+    case RSBool:
+        return "boolean"
+    case RSNumber:
+        return "number"
+    case RSDate:
+        return "date"
+    case RSList:
+        return "list"
+    default:
+        return fmt.Sprintf("%T", v)
+    }
+}
+
+// Converts a value to a number.  Strings are converted if they contain a number.
+func toRSNumber(v RSExprValue) (RSNumber, error) {
+    switch tv := v.(type) {
+    case RSNumber:
+        return tv, nil
+    case RSList:
+        return toRSNumber(tv.first())
+    case RSString:
+        if f, err := strconv.ParseFloat(strings.TrimSpace(string(tv)), 64) ; err == nil {
+            return RSNumber(f), nil
+        }
+    }
+    return 0, fmt.Errorf("%s '%s' is not a number", rsTypeName(v), v.String())
+}
+
+// Converts a value to a date.  Strings are converted if they are in one of the date layouts.
+func toRSDate(v RSExprValue) (RSDate, error) {
+    switch tv := v.(type) {
+    case RSDate:
+        return tv, nil
+    case RSList:
+        return toRSDate(tv.first())
+    case RSString:
+        str := strings.TrimSpace(string(tv))
+        for _, layout := range rsDateLayouts {
+            if t, err := time.Parse(layout, str) ; err == nil {
+                return RSDate(t), nil
+            }
+        }
+    }
+    return RSDate{}, fmt.Errorf("%s '%s' is not a date", rsTypeName(v), v.String())
+}
+
 // Native function types
 type RSNativeFunction   func(rr *RecordResult, args []RSExprValue) (RSExprValue, error)
 
@@ -112,7 +219,7 @@ func (fnCall *RSExprFnCall) Evaluate(rr *RecordResult) (RSExprValue, error) {
 }
 
 
-// A string literal
+// A string or number literal
 //
 type RSExprLiteral struct {
     val     RSExprValue
@@ -122,6 +229,221 @@ func (lt RSExprLiteral) Evaluate(rr *RecordResult) (RSExprValue, error) {
     return lt.val, nil
 }
 
+
+// A call to xp() or looseXp().  Literal paths are compiled when the expression is parsed, rather
+// than each time the expression is evaluated.
+//
+type RSExprXPath struct {
+    path        compiledXPath
+    pathExpr    RSExprAst
+    opts        XPathOptions
+}
+
+func (xp *RSExprXPath) Evaluate(rr *RecordResult) (RSExprValue, error) {
+    path := xp.path
+    if (path == nil) {
+        val, err := xp.pathExpr.Evaluate(rr)
+        if (err != nil) {
+            return nil, err
+        }
+        if path, err = compileXPath(val.String(), xp.opts) ; err != nil {
+            return nil, fmt.Errorf("invalid XPath '%s': %s", val.String(), err.Error())
+        }
+    }
+    return path.evaluate(rr)
+}
+
+// The parsed content of a record.  The content is parsed by the engines as they are needed.
+type parsedContent struct {
+    content     string
+    node        *xmlpath.Node
+    nodeErr     error
+    doc         *xmlNode
+    docErr      error
+}
+
+// Returns the parsed content of the record, clearing it if the content has changed.
+func (rr *RecordResult) parsedContent() *parsedContent {
+    if (rr.parsed == nil) || (rr.parsed.content != rr.Content) {
+        rr.parsed = &parsedContent{content: rr.Content}
+    }
+    return rr.parsed
+}
+
+// Returns the content of the record parsed for the loose engine.  The content is parsed once and
+// shared by every path evaluated over the record.
+func (rr *RecordResult) contentNode() (*xmlpath.Node, error) {
+    pc := rr.parsedContent()
+    if (pc.node == nil) && (pc.nodeErr == nil) {
+        pc.node, pc.nodeErr = xmlpath.Parse(strings.NewReader(rr.Content))
+    }
+    return pc.node, pc.nodeErr
+}
+
+// Returns the content of the record parsed for the namespace-aware engine.  The content is parsed
+// once and shared by every path evaluated over the record.
+func (rr *RecordResult) contentDoc() (*xmlNode, error) {
+    pc := rr.parsedContent()
+    if (pc.doc == nil) && (pc.docErr == nil) {
+        pc.doc, pc.docErr = parseXmlDoc(strings.NewReader(rr.Content))
+    }
+    return pc.doc, pc.docErr
+}
+
+
+// Logical and.  Returns the right value if the left value is true, otherwise returns the
+// left value.  The right expression is only evaluated if the left value is true.
+//
+type RSExprAnd struct {
+    Left        RSExprAst
+    Right       RSExprAst
+}
+
+func (and *RSExprAnd) Evaluate(rr *RecordResult) (RSExprValue, error) {
+    left, err := and.Left.Evaluate(rr)
+    if (err != nil) || !left.Bool() {
+        return left, err
+    }
+    return and.Right.Evaluate(rr)
+}
+
+
+// Logical or.  Returns the left value if it is true, otherwise returns the right value.  The
+// right expression is only evaluated if the left value is false.
+//
+type RSExprOr struct {
+    Left        RSExprAst
+    Right       RSExprAst
+}
+
+func (or *RSExprOr) Evaluate(rr *RecordResult) (RSExprValue, error) {
+    left, err := or.Left.Evaluate(rr)
+    if (err != nil) || left.Bool() {
+        return left, err
+    }
+    return or.Right.Evaluate(rr)
+}
+
+
+// Logical not.
+//
+type RSExprNot struct {
+    Expr        RSExprAst
+}
+
+func (not *RSExprNot) Evaluate(rr *RecordResult) (RSExprValue, error) {
+    val, err := not.Expr.Evaluate(rr)
+    if (err != nil) {
+        return nil, err
+    }
+    return RSBool(!val.Bool()), nil
+}
+
+
+// A comparison.  If either value is a date or a number, the other value is converted to the
+// same type and an error is returned if it cannot be converted.  Otherwise, values are compared
+// as numbers if they both look like numbers, or as strings if they don't.
+//
+type RSExprCompare struct {
+    Op          string
+    Left        RSExprAst
+    Right       RSExprAst
+}
+
+func (cmp *RSExprCompare) Evaluate(rr *RecordResult) (RSExprValue, error) {
+    left, err := cmp.Left.Evaluate(rr)
+    if (err != nil) {
+        return nil, err
+    }
+    right, err := cmp.Right.Evaluate(rr)
+    if (err != nil) {
+        return nil, err
+    }
+
+    c, err := compareValues(left, right)
+    if (err != nil) {
+        return nil, fmt.Errorf("cannot compare %s with %s: %s", rsTypeName(left), rsTypeName(right), err.Error())
+    }
+
+    switch cmp.Op {
+    case "==":
+        return RSBool(c == 0), nil
+    case "!=":
+        return RSBool(c != 0), nil
+    case "<":
+        return RSBool(c < 0), nil
+    case "<=":
+        return RSBool(c <= 0), nil
+    case ">":
+        return RSBool(c > 0), nil
+    case ">=":
+        return RSBool(c >= 0), nil
+    default:
+        return nil, fmt.Errorf("Unknown comparison: %s", cmp.Op)
+    }
+}
+
+// Compares two values, returning -1, 0 or 1 if the left value is less than, equal to or greater
+// than the right value.
+func compareValues(left RSExprValue, right RSExprValue) (int, error) {
+    if l, isList := left.(RSList) ; isList {
+        left = l.first()
+    }
+    if r, isList := right.(RSList) ; isList {
+        right = r.first()
+    }
+
+    _, leftIsDate := left.(RSDate)
+    _, rightIsDate := right.(RSDate)
+    _, leftIsNumber := left.(RSNumber)
+    _, rightIsNumber := right.(RSNumber)
+
+    if (leftIsDate || rightIsDate) {
+        ld, err := toRSDate(left)
+        if (err != nil) {
+            return 0, err
+        }
+        rd, err := toRSDate(right)
+        if (err != nil) {
+            return 0, err
+        }
+
+        if time.Time(ld).Before(time.Time(rd)) {
+            return -1, nil
+        } else if time.Time(ld).After(time.Time(rd)) {
+            return 1, nil
+        }
+        return 0, nil
+    } else if (leftIsNumber || rightIsNumber) {
+        ln, err := toRSNumber(left)
+        if (err != nil) {
+            return 0, err
+        }
+        rn, err := toRSNumber(right)
+        if (err != nil) {
+            return 0, err
+        }
+        return compareNumbers(ln, rn), nil
+    }
+
+    // Two untyped values
+    ln, lerr := toRSNumber(left)
+    rn, rerr := toRSNumber(right)
+    if (lerr == nil) && (rerr == nil) {
+        return compareNumbers(ln, rn), nil
+    }
+    return strings.Compare(left.String(), right.String()), nil
+}
+
+func compareNumbers(left RSNumber, right RSNumber) int {
+    if (left < right) {
+        return -1
+    } else if (left > right) {
+        return 1
+    }
+    return 0
+}
+
 // ------------------------------------------------------------------------------
 //
 
@@ -134,21 +456,85 @@ func (e *etoken) Error() string {
     return fmt.Sprintf("Expected %s but got %s", scanner.TokenString(e.Expected), scanner.TokenString(e.Actual))
 }
 
+// An error parsing an expression, along with the position of the token where the error was found
+type RSExprParseError struct {
+    Line        int
+    Column      int
+    Err         error
+}
+
+func (e *RSExprParseError) Error() string {
+    return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err.Error())
+}
+
+// The keywords of the logical operators
+const (
+    andKeyword  string  =   "and"
+    orKeyword   string  =   "or"
+    notKeyword  string  =   "not"
+)
+
+// The settings used when parsing an expression
+type RSExprOptions struct {
+    // The settings of xp()
+    XPath       XPathOptions
+
+    // The provider, as given on the command line
+    Provider    string
+
+    // The metadata prefix of records which do not have one, i.e. the prefix which was requested
+    Prefix      string
+}
+
+// Returns the default settings
+func DefaultRSExprOptions() RSExprOptions {
+    return RSExprOptions{XPath: DefaultXPathOptions()}
+}
+
+// The functions which evaluate paths, and whether they use the loose engine.  These are compiled by
+// the parser rather than being native functions.
+var XPATH_FUNCTIONS = map[string]bool {
+    "xp":       false,
+    "looseXp":  true,
+}
+
 // Record search parser
 type recordSearchParser struct {
+    opts        RSExprOptions
     scan        *scanner.Scanner
     tok         rune
     tokText     string
+    tokPos      scanner.Position
+    scanErr     error
 }
 
-// Gets the next token
+// Gets the next token.  The two character comparison operators are returned as a single token.
 func (rsp *recordSearchParser) nextToken() {
     if (rsp.tok != scanner.EOF) {
         rsp.tok = rsp.scan.Scan()
         rsp.tokText = rsp.scan.TokenText()
+        rsp.tokPos = rsp.scan.Position
+
+        if (strings.ContainsRune("=!<>", rsp.tok)) && (rsp.scan.Peek() == '=') {
+            rsp.scan.Next()
+            rsp.tokText += "="
+        }
     }
 }
 
+// Returns true if the next token is a keyword
+func (rsp *recordSearchParser) nextTokenIsKeyword(keyword string) bool {
+    return (rsp.tok == scanner.Ident) && (rsp.tokText == keyword)
+}
+
+// Returns the error with the position of the current token
+func (rsp *recordSearchParser) errorAtToken(err error) error {
+    if _, isParseErr := err.(*RSExprParseError) ; isParseErr {
+        return err
+    }
+    return &RSExprParseError{rsp.tokPos.Line, rsp.tokPos.Column, err}
+}
+
 // Returns true if the next token is a specific token
 func (rsp *recordSearchParser) nextTokenIs(tok rune) bool {
     return (rsp.tok == tok)
@@ -167,9 +553,91 @@ func (rsp *recordSearchParser) consume(tok rune) (txt string, err error) {
 }
 
 // Parses an expression
-//      <expr>  =   <fncall> | <atom>
+//      <expr>  =   <and> ("or" <and>)*
 func (rsp *recordSearchParser) parseExpr() (RSExprAst, error) {
-    if (rsp.tok == scanner.Ident) {
+    left, err := rsp.parseAnd()
+    for (err == nil) && rsp.nextTokenIsKeyword(orKeyword) {
+        rsp.nextToken()
+
+        var right RSExprAst
+        if right, err = rsp.parseAnd() ; err == nil {
+            left = &RSExprOr{left, right}
+        }
+    }
+    return left, err
+}
+
+// Parses a logical and
+//      <and>   =   <not> ("and" <not>)*
+func (rsp *recordSearchParser) parseAnd() (RSExprAst, error) {
+    left, err := rsp.parseNot()
+    for (err == nil) && rsp.nextTokenIsKeyword(andKeyword) {
+        rsp.nextToken()
+
+        var right RSExprAst
+        if right, err = rsp.parseNot() ; err == nil {
+            left = &RSExprAnd{left, right}
+        }
+    }
+    return left, err
+}
+
+// Parses a logical not
+//      <not>   =   "not" <not> | <cmp>
+func (rsp *recordSearchParser) parseNot() (RSExprAst, error) {
+    if rsp.nextTokenIsKeyword(notKeyword) {
+        rsp.nextToken()
+
+        expr, err := rsp.parseNot()
+        if (err != nil) {
+            return nil, err
+        }
+        return &RSExprNot{expr}, nil
+    }
+    return rsp.parseCompare()
+}
+
+// Parses a comparison
+//      <cmp>   =   <primary> [ ("==" | "!=" | "<" | "<=" | ">" | ">=") <primary> ]
+func (rsp *recordSearchParser) parseCompare() (RSExprAst, error) {
+    left, err := rsp.parsePrimary()
+    if (err != nil) {
+        return nil, err
+    }
+
+    switch rsp.tokText {
+    case "==", "!=", "<", "<=", ">", ">=":
+        op := rsp.tokText
+        rsp.nextToken()
+
+        right, err := rsp.parsePrimary()
+        if (err != nil) {
+            return nil, err
+        }
+        return &RSExprCompare{op, left, right}, nil
+    case "=", "!":
+        return nil, rsp.errorAtToken(fmt.Errorf("Unexpected '%s': use '==' or '!='", rsp.tokText))
+    }
+    return left, nil
+}
+
+// Parses a primary expression
+//      <primary>   =   "(" <expr> ")" | <fncall> | <atom>
+func (rsp *recordSearchParser) parsePrimary() (RSExprAst, error) {
+    if rsp.nextTokenIs('(') {
+        rsp.nextToken()
+
+        expr, err := rsp.parseExpr()
+        if (err != nil) {
+            return nil, err
+        }
+        if _, err := rsp.consume(')') ; err != nil {
+            return nil, rsp.errorAtToken(err)
+        }
+        return expr, nil
+    } else if rsp.nextTokenIsKeyword(andKeyword) || rsp.nextTokenIsKeyword(orKeyword) {
+        return nil, rsp.errorAtToken(fmt.Errorf("Unexpected '%s'", rsp.tokText))
+    } else if (rsp.tok == scanner.Ident) {
         return rsp.parseFn()
     } else {
         return rsp.parseAtom()
@@ -177,24 +645,44 @@ func (rsp *recordSearchParser) parseExpr() (RSExprAst, error) {
 }
 
 // Parses an atom
-//      <atom>  =   STRING
+//      <atom>  =   STRING | NUMBER
 func (rsp *recordSearchParser) parseAtom() (RSExprAst, error) {
+    if (rsp.tok == scanner.Int) || (rsp.tok == scanner.Float) || (rsp.tok == '-') {
+        num, err := rsp.readNumber()
+        if (err != nil) {
+            return nil, rsp.errorAtToken(err)
+        }
+        return RSExprLiteral{RSNumber(num)}, nil
+    }
+
     str, err := rsp.readString()
-    return RSExprLiteral{RSString(str)}, err
+    if (err != nil) {
+        return nil, rsp.errorAtToken(err)
+    }
+    return RSExprLiteral{RSString(str)}, nil
 }
 
 // Parses a function call
 //      <fncall>    =   <IDENT> [ "(" (<expr> ("," <expr>)*)? ")" ]
 func (rsp *recordSearchParser) parseFn() (RSExprAst, error) {
+    fnPos := rsp.tokPos
     fnName, err := rsp.consume(scanner.Ident)
     if (err != nil) {
-        return nil, err
+        return nil, rsp.errorAtToken(err)
     }
 
     // Look up the function
     fn, hasFn := NATIVE_FUNCTIONS[fnName]
-    if !hasFn {
-        return nil, fmt.Errorf("No such function: %s", fnName)
+    if ctxFn, isCtxFn := CONTEXT_FUNCTIONS[fnName] ; isCtxFn {
+        fn, hasFn = ctxFn(rsp.opts), true
+    }
+    loose, isXPathFn := XPATH_FUNCTIONS[fnName]
+    if !hasFn && !isXPathFn {
+        return nil, &RSExprParseError{fnPos.Line, fnPos.Column, fmt.Errorf("No such function: %s", fnName)}
+    }
+
+    if isXPathFn {
+        return rsp.parseXPathFn(fnName, fnPos, loose)
     }
 
     if rsp.nextTokenIs('(') {
@@ -205,7 +693,7 @@ func (rsp *recordSearchParser) parseFn() (RSExprAst, error) {
         for rsp.tok != ')' {
             if len(args) > 0 {
                 if _, err = rsp.consume(',') ; err != nil {
-                    return nil, err
+                    return nil, rsp.errorAtToken(err)
                 }
             }
 
@@ -217,7 +705,7 @@ func (rsp *recordSearchParser) parseFn() (RSExprAst, error) {
         }
 
         if _, err = rsp.consume(')') ; err != nil {
-            return nil, err
+            return nil, rsp.errorAtToken(err)
         }
 
         return &RSExprFnCall{fn, args}, nil
@@ -227,6 +715,35 @@ func (rsp *recordSearchParser) parseFn() (RSExprAst, error) {
     }
 }
 
+// Parses the argument of a path function.  Literal paths are compiled once.
+//      <xpcall>    =   ("xp" | "looseXp") "(" <expr> ")"
+func (rsp *recordSearchParser) parseXPathFn(fnName string, fnPos scanner.Position, loose bool) (RSExprAst, error) {
+    if _, err := rsp.consume('(') ; err != nil {
+        return nil, &RSExprParseError{fnPos.Line, fnPos.Column, fmt.Errorf("%s() expects exactly 1 argument", fnName)}
+    }
+
+    argPos := rsp.tokPos
+    pathExpr, err := rsp.parseExpr()
+    if (err != nil) {
+        return nil, err
+    }
+    if _, err := rsp.consume(')') ; err != nil {
+        return nil, rsp.errorAtToken(fmt.Errorf("%s() expects exactly 1 argument", fnName))
+    }
+
+    opts := rsp.opts.XPath
+    opts.Loose = opts.Loose || loose
+
+    if lit, isLit := pathExpr.(RSExprLiteral) ; isLit {
+        path, err := compileXPath(lit.val.String(), opts)
+        if (err != nil) {
+            return nil, &RSExprParseError{argPos.Line, argPos.Column, fmt.Errorf("Invalid XPath: %s", err.Error())}
+        }
+        return &RSExprXPath{path: path, opts: opts}, nil
+    }
+    return &RSExprXPath{pathExpr: pathExpr, opts: opts}, nil
+}
+
 // Reads a string value
 func (rsp *recordSearchParser) readString() (string, error) {
     if (rsp.tok == scanner.String) || (rsp.tok == scanner.RawString) {
@@ -238,13 +755,37 @@ func (rsp *recordSearchParser) readString() (string, error) {
             return s, nil
         }
     } else {
-        return "", fmt.Errorf("Expected string but got %s\n", scanner.TokenString(rsp.tok))
+        return "", fmt.Errorf("Expected string or number but got %s", scanner.TokenString(rsp.tok))
+    }
+}
+
+// Reads a number value, with an optional minus sign
+func (rsp *recordSearchParser) readNumber() (float64, error) {
+    sign := 1.0
+    if rsp.nextTokenIs('-') {
+        sign = -1.0
+        rsp.nextToken()
     }
+
+    if (rsp.tok != scanner.Int) && (rsp.tok != scanner.Float) {
+        return 0, fmt.Errorf("Expected number but got %s", scanner.TokenString(rsp.tok))
+    }
+    f, err := strconv.ParseFloat(rsp.tokText, 64)
+    if (err != nil) {
+        return 0, fmt.Errorf("Invalid number: %s", rsp.tokText)
+    }
+    rsp.consume(rsp.tok)
+    return sign * f, nil
 }
 
 // Parses a record match expression
 func ParseRecordMatchExpr(expr string) (*ExprRecordSearcher, error) {
-    ast, err := ParseRSExpr(expr)
+    return ParseRecordMatchExprWithOptions(expr, DefaultRSExprOptions())
+}
+
+// Parses a record match expression with the settings
+func ParseRecordMatchExprWithOptions(expr string, opts RSExprOptions) (*ExprRecordSearcher, error) {
+    ast, err := ParseRSExprWithOptions(expr, opts)
     if err == nil {
         return &ExprRecordSearcher{ast}, nil
     } else {
@@ -254,18 +795,38 @@ func ParseRecordMatchExpr(expr string) (*ExprRecordSearcher, error) {
 
 // Parses an RS expresison
 func ParseRSExpr(expr string) (RSExprAst, error) {
-    rsp := &recordSearchParser{}
+    return ParseRSExprWithOptions(expr, DefaultRSExprOptions())
+}
+
+// Parses an RS expression with the settings
+func ParseRSExprWithOptions(expr string, opts RSExprOptions) (RSExprAst, error) {
+    rsp := &recordSearchParser{opts: opts}
     rsp.scan = new(scanner.Scanner)
     rsp.scan.Init(strings.NewReader(expr))
-    rsp.scan.Mode = scanner.ScanIdents | scanner.ScanStrings | scanner.ScanRawStrings | scanner.SkipComments
+    rsp.scan.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings | scanner.ScanRawStrings | scanner.SkipComments
+    rsp.scan.Error = func(s *scanner.Scanner, msg string) {
+        if (rsp.scanErr == nil) {
+            pos := s.Position
+            if (! pos.IsValid()) {
+                pos = s.Pos()
+            }
+            rsp.scanErr = &RSExprParseError{pos.Line, pos.Column, fmt.Errorf("%s", msg)}
+        }
+    }
     rsp.nextToken()
 
     ast, err := rsp.parseExpr()
-    if err == nil {
-        return ast, nil
-    } else {
+    if (rsp.scanErr != nil) {
+        return nil, rsp.scanErr
+    } else if (err != nil) {
         return nil, err
     }
+
+    // The whole expression must be used
+    if (rsp.tok != scanner.EOF) {
+        return nil, rsp.errorAtToken(fmt.Errorf("Unexpected '%s' after the end of the expression", rsp.tokText))
+    }
+    return ast, nil
 }
 
 // -----------------------------------------------------------------------------
@@ -273,28 +834,6 @@ func ParseRSExpr(expr string) (RSExprAst, error) {
 
 var NATIVE_FUNCTIONS = map[string]RSNativeFunction {
 
-    // xp(<xpath>)
-    //      Returns the result of running the XPath expression over the record.  The resulting
-    //      string is trimmed.
-    "xp": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
-        if (len(args) != 1) {
-            return nil, fmt.Errorf("xp() expects exactly 1 argument")
-        }
-
-        path, err := xmlpath.Compile(args[0].String())
-        if (err != nil) {
-            return nil, err
-        }
-
-        n, err := xmlpath.Parse(strings.NewReader(rr.Content))
-        if (err != nil) {
-            return nil, err
-        }
-
-        val, _ := path.String(n)
-        return RSString(strings.TrimSpace(val)), nil
-    },
-
     // concat(<strs>...)
     //      Returns a string with all the other strings concatinated
     "concat": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
@@ -341,6 +880,48 @@ var NATIVE_FUNCTIONS = map[string]RSNativeFunction {
         return RSString(rr.Identifier()), nil
     },
 
+    // number(<val>)
+    //      Converts the value to a number.  Returns an error if the value is not a number.
+    "number": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        if (len(args) != 1) {
+            return nil, fmt.Errorf("number() expects exactly 1 argument")
+        }
+
+        num, err := toRSNumber(args[0])
+        if (err != nil) {
+            return nil, fmt.Errorf("number(): %s", err.Error())
+        }
+        return num, nil
+    },
+
+    // date(<val>)
+    //      Converts the value to a date.  Returns an error if the value is not a date.
+    "date": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        if (len(args) != 1) {
+            return nil, fmt.Errorf("date() expects exactly 1 argument")
+        }
+
+        date, err := toRSDate(args[0])
+        if (err != nil) {
+            return nil, fmt.Errorf("date(): %s", err.Error())
+        }
+        return date, nil
+    },
+
+    // count(<list>)
+    //      Returns the number of items in the list.
+    "count": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        if (len(args) != 1) {
+            return nil, fmt.Errorf("count() expects exactly 1 argument")
+        }
+
+        list, isList := args[0].(RSList)
+        if (! isList) {
+            return nil, fmt.Errorf("count() expects a list but got %s '%s'", rsTypeName(args[0]), args[0].String())
+        }
+        return RSNumber(len(list)), nil
+    },
+
     // replace(<str>, <substr>, <new>)
     //      Replaces all occurances of <substr> found in <str> with <new>
     "replace": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
@@ -350,4 +931,87 @@ var NATIVE_FUNCTIONS = map[string]RSNativeFunction {
 
         return RSString(strings.Replace(args[0].String(), args[1].String(), args[2].String(), -1)), nil
     },
+
+    // datestamp()
+    //      Returns the datestamp of the record
+    "datestamp": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        return RSDate(rr.Header.DateStamp), nil
+    },
+
+    // sets()
+    //      Returns the list of the set specs of the record
+    "sets": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        sets := RSList{}
+        for _, setSpec := range rr.Header.SetSpec {
+            sets = append(sets, RSString(setSpec))
+        }
+        return sets, nil
+    },
+
+    // inSet(<setSpec>)
+    //      Returns true if the record is in the set, or in one of the sets below it in the
+    //      set hierarchy.
+    "inSet": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        if (len(args) != 1) {
+            return nil, fmt.Errorf("inSet() expects exactly 1 argument")
+        }
+
+        set := args[0].String()
+        for _, setSpec := range rr.Header.SetSpec {
+            if (setSpec == set) || strings.HasPrefix(setSpec, set + ":") {
+                return RSBool(true), nil
+            }
+        }
+        return RSBool(false), nil
+    },
+
+    // deleted()
+    //      Returns true if the record is deleted
+    "deleted": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        return RSBool(rr.Deleted), nil
+    },
+
+    // now()
+    //      Returns the current time
+    "now": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        return RSDate(time.Now()), nil
+    },
+
+    // formatDate(<date>, <layout>)
+    //      Formats the date in UTC using the Go time layout, e.g. "2006-01-02".
+    "formatDate": func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+        if (len(args) != 2) {
+            return nil, fmt.Errorf("formatDate() expects exactly 2 arguments")
+        }
+
+        date, err := toRSDate(args[0])
+        if (err != nil) {
+            return nil, fmt.Errorf("formatDate(): %s", err.Error())
+        }
+        return RSString(time.Time(date).UTC().Format(args[1].String())), nil
+    },
+}
+
+// Functions which use the settings the expression was parsed with.  Each returns the native
+// function for the settings.
+var CONTEXT_FUNCTIONS = map[string]func(opts RSExprOptions) RSNativeFunction {
+
+    // prefix()
+    //      Returns the metadata prefix of the record
+    "prefix": func(opts RSExprOptions) RSNativeFunction {
+        return func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+            if (rr.Prefix != "") {
+                return RSString(rr.Prefix), nil
+            }
+            return RSString(opts.Prefix), nil
+        }
+    },
+
+    // provider()
+    //      Returns the provider alias, or the URL of the provider if an alias was not used
+    "provider": func(opts RSExprOptions) RSNativeFunction {
+        return func(rr *RecordResult, args []RSExprValue) (RSExprValue, error) {
+            return RSString(opts.Provider), nil
+        }
+    },
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/lmika/oaipmh/client"
+)
+
+// The number of records in the benchmark corpus
+const benchCorpusSize = 100
+
+// A cut down ISO 19139 record.  The arguments are the identifier, the date, the title and the
+// keywords.
+const benchIsoRecord = `<?xml version="1.0" encoding="UTF-8"?>
+<gmd:MD_Metadata xmlns:gmd="http://www.isotc211.org/2005/gmd" xmlns:gco="http://www.isotc211.org/2005/gco" xmlns:gml="http://www.opengis.net/gml/3.2">
+  <gmd:fileIdentifier><gco:CharacterString>%s</gco:CharacterString></gmd:fileIdentifier>
+  <gmd:language><gco:CharacterString>eng</gco:CharacterString></gmd:language>
+  <gmd:hierarchyLevel><gmd:MD_ScopeCode codeList="http://www.isotc211.org/2005/resources/codeList.xml#MD_ScopeCode" codeListValue="dataset">dataset</gmd:MD_ScopeCode></gmd:hierarchyLevel>
+  <gmd:contact>
+    <gmd:CI_ResponsibleParty>
+      <gmd:organisationName><gco:CharacterString>Example Agency</gco:CharacterString></gmd:organisationName>
+      <gmd:role><gmd:CI_RoleCode codeList="http://www.isotc211.org/2005/resources/codeList.xml#CI_RoleCode" codeListValue="pointOfContact">pointOfContact</gmd:CI_RoleCode></gmd:role>
+    </gmd:CI_ResponsibleParty>
+  </gmd:contact>
+  <gmd:dateStamp><gco:DateTime>%s</gco:DateTime></gmd:dateStamp>
+  <gmd:identificationInfo>
+    <gmd:MD_DataIdentification>
+      <gmd:citation>
+        <gmd:CI_Citation>
+          <gmd:title><gco:CharacterString>%s</gco:CharacterString></gmd:title>
+        </gmd:CI_Citation>
+      </gmd:citation>
+      <gmd:abstract><gco:CharacterString>An abstract describing the dataset in a sentence or two, as most records have.</gco:CharacterString></gmd:abstract>
+      <gmd:descriptiveKeywords>
+        <gmd:MD_Keywords>%s
+        </gmd:MD_Keywords>
+      </gmd:descriptiveKeywords>
+      <gmd:extent>
+        <gmd:EX_Extent>
+          <gmd:geographicElement>
+            <gmd:EX_GeographicBoundingBox>
+              <gmd:westBoundLongitude><gco:Decimal>112.0</gco:Decimal></gmd:westBoundLongitude>
+              <gmd:eastBoundLongitude><gco:Decimal>154.0</gco:Decimal></gmd:eastBoundLongitude>
+              <gmd:southBoundLatitude><gco:Decimal>-44.0</gco:Decimal></gmd:southBoundLatitude>
+              <gmd:northBoundLatitude><gco:Decimal>-10.0</gco:Decimal></gmd:northBoundLatitude>
+            </gmd:EX_GeographicBoundingBox>
+          </gmd:geographicElement>
+        </gmd:EX_Extent>
+      </gmd:extent>
+    </gmd:MD_DataIdentification>
+  </gmd:identificationInfo>
+</gmd:MD_Metadata>`
+
+// Returns a corpus of ISO 19139 records with varying identifiers, dates and keywords
+func benchCorpus() []*RecordResult {
+    corpus := make([]*RecordResult, benchCorpusSize)
+    start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+    for i := range corpus {
+        id := fmt.Sprintf("rec-%05d", i)
+        date := start.Add(time.Duration(i) * 24 * time.Hour)
+
+        keywords := new(bytes.Buffer)
+        for k := 0; k < i % 10; k++ {
+            fmt.Fprintf(keywords, "\n          <gmd:keyword><gco:CharacterString>Keyword %d</gco:CharacterString></gmd:keyword>", k)
+        }
+
+        corpus[i] = &RecordResult{
+            Header: oaipmh.OaipmhHeader{ Identifier: id, DateStamp: date },
+            Content: fmt.Sprintf(benchIsoRecord, id, date.Format("2006-01-02T15:04:05"), "Dataset " + id, keywords.String()),
+        }
+    }
+    return corpus
+}
+
+// Runs the search expression over the corpus.  Each search is over a fresh copy of the record,
+// as each record would only be searched once.
+func benchmarkSearch(b *testing.B, expr string) {
+    rs, err := ParseRecordMatchExpr(expr)
+    if (err != nil) {
+        b.Fatal(err)
+    }
+    corpus := benchCorpus()
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        rec := corpus[i % len(corpus)]
+        if _, _, err := rs.SearchRecord(&RecordResult{ Header: rec.Header, Content: rec.Content }) ; err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkParseRSExpr(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        if _, err := ParseRSExpr(`count(xp("//gmd:keyword")) > 5 and date(xp("//gmd:dateStamp/gco:DateTime")) > date("2016-01-01")`) ; err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkSearchOneXPath(b *testing.B) {
+    benchmarkSearch(b, `xp("/gmd:MD_Metadata/gmd:fileIdentifier/gco:CharacterString")`)
+}
+
+func BenchmarkSearchThreeXPaths(b *testing.B) {
+    benchmarkSearch(b, `xp("/gmd:MD_Metadata/gmd:language/gco:CharacterString") == "eng" and ` +
+        `count(xp("//gmd:keyword")) > 5 and date(xp("/gmd:MD_Metadata/gmd:dateStamp/gco:DateTime")) > date("2016-01-01")`)
+}
+
+func BenchmarkSearchLooseXPath(b *testing.B) {
+    benchmarkSearch(b, `looseXp("/MD_Metadata/fileIdentifier/CharacterString")`)
+}
+
+// An xp() call with a path which is not a literal, which is compiled for each record
+func BenchmarkSearchDynamicXPath(b *testing.B) {
+    benchmarkSearch(b, `xp(concat("/gmd:MD_Metadata/", "gmd:fileIdentifier/gco:CharacterString"))`)
+}
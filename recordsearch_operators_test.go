@@ -0,0 +1,118 @@
+package main
+
+import (
+    "testing"
+)
+
+const testOperatorsXml = "<rec><title>A title</title><count>10</count><status>draft</status></rec>"
+
+
+// Test the logical operators
+func TestLogicalOperators(t *testing.T) {
+    assertSearchExpr(t, `xp("/rec/title") and xp("/rec/status")`, testOperatorsXml, true, "draft")
+    assertSearchExpr(t, `xp("/rec/missing") and xp("/rec/status")`, testOperatorsXml, false, "")
+    assertSearchExpr(t, `xp("/rec/missing") or xp("/rec/status")`, testOperatorsXml, true, "draft")
+    assertSearchExpr(t, `xp("/rec/title") or xp("/rec/status")`, testOperatorsXml, true, "A title")
+    assertSearchExpr(t, `xp("/rec/missing") or ""`, testOperatorsXml, false, "")
+    assertSearchExpr(t, `not xp("/rec/missing")`, testOperatorsXml, true, "true")
+    assertSearchExpr(t, `not xp("/rec/title")`, testOperatorsXml, false, "false")
+    assertSearchExpr(t, `not not xp("/rec/title")`, testOperatorsXml, true, "true")
+}
+
+// Test the comparison operators
+func TestComparisonOperators(t *testing.T) {
+    assertSearchExpr(t, `xp("/rec/status") == "draft"`, testOperatorsXml, true, "true")
+    assertSearchExpr(t, `xp("/rec/status") != "draft"`, testOperatorsXml, false, "false")
+    assertSearchExpr(t, `xp("/rec/status") < "final"`, testOperatorsXml, true, "true")
+    assertSearchExpr(t, `xp("/rec/status") >= "final"`, testOperatorsXml, false, "false")
+
+    // Numbers are compared as numbers
+    assertSearchExpr(t, `xp("/rec/count") > "9"`, testOperatorsXml, true, "true")
+    assertSearchExpr(t, `xp("/rec/count") <= "9.5"`, testOperatorsXml, false, "false")
+    assertSearchExpr(t, `xp("/rec/count") == "10.0"`, testOperatorsXml, true, "true")
+    assertSearchExpr(t, `"10" < "9"`, testOperatorsXml, false, "false")
+    assertSearchExpr(t, `"10" < "9a"`, testOperatorsXml, true, "true")
+}
+
+// Test the precedence of the operators and parentheses
+func TestOperatorPrecedence(t *testing.T) {
+    // and binds tighter than or
+    assertSearchExpr(t, `"a" or "" and ""`, testOperatorsXml, true, "a")
+    assertSearchExpr(t, `("a" or "") and ""`, testOperatorsXml, false, "")
+
+    // not binds tighter than and, but looser than the comparisons
+    assertSearchExpr(t, `not "" and "b"`, testOperatorsXml, true, "b")
+    assertSearchExpr(t, `not ("" and "b")`, testOperatorsXml, true, "true")
+    assertSearchExpr(t, `not xp("/rec/status") == "draft"`, testOperatorsXml, false, "false")
+
+    assertSearchExpr(t, `xp("/rec/count") > "5" and (xp("/rec/status") == "final" or xp("/rec/status") == "draft")`,
+        testOperatorsXml, true, "true")
+    assertSearchExpr(t, `((xp("/rec/title")))`, testOperatorsXml, true, "A title")
+}
+
+// Test that the right operand is not evaluated when the result is known from the left
+func TestLogicalOperatorsShortCircuit(t *testing.T) {
+    assertSearchExpr(t, `"" and xp(concat("<not an xpath>"))`, testOperatorsXml, false, "")
+    assertSearchExpr(t, `"a" or xp(concat("<not an xpath>"))`, testOperatorsXml, true, "a")
+
+    rs, err := ParseRecordMatchExpr(`"a" and xp(concat("<not an xpath>"))`)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    if _, _, err := rs.SearchRecord(&RecordResult{ Content: testOperatorsXml }) ; err == nil {
+        t.Error("Expected the right operand to be evaluated")
+    }
+}
+
+// Test operators within filename expressions
+func TestOperatorsInFilenameExpr(t *testing.T) {
+    ast, err := ParseRSExpr(`(xp("/rec/status") == "draft" and concat("draft-", urn)) or urn`)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    rr := &RecordResult{ Content: testOperatorsXml }
+    rr.Header.Identifier = "rec1"
+    if val, err := ast.Evaluate(rr) ; (err != nil) || (val.String() != "draft-rec1") {
+        t.Errorf("Expected draft-rec1, got %v, %v", val, err)
+    }
+
+    rr.Content = "<rec><status>final</status></rec>"
+    if val, err := ast.Evaluate(rr) ; (err != nil) || (val.String() != "rec1") {
+        t.Errorf("Expected rec1, got %v, %v", val, err)
+    }
+}
+
+// Test that parse errors report the position of the error
+func TestParseErrorPositions(t *testing.T) {
+    assertParseError(t, `nope("x")`, 1, 1)
+    assertParseError(t, `urn and nope("x")`, 1, 9)
+    assertParseError(t, "urn and\n    nope(\"x\")", 2, 5)
+    assertParseError(t, `(urn == "x"`, 1, 12)
+    assertParseError(t, `urn = "x"`, 1, 5)
+    assertParseError(t, `urn ! "x"`, 1, 5)
+    assertParseError(t, `urn and or urn`, 1, 9)
+    assertParseError(t, `urn == `, 1, 8)
+    assertParseError(t, `urn == "unterminated`, 1, 8)
+    assertParseError(t, `urn == "x" && urn`, 1, 12)
+    assertParseError(t, `"a" == "b" == "c"`, 1, 12)
+    assertParseError(t, `urn urn`, 1, 5)
+}
+
+
+func assertParseError(t *testing.T, expr string, line int, column int) {
+    _, err := ParseRSExpr(expr)
+    if (err == nil) {
+        t.Errorf("Expected %q to fail to parse", expr)
+        return
+    }
+
+    perr, isParseErr := err.(*RSExprParseError)
+    if (! isParseErr) {
+        t.Errorf("Expected %q to return a parse error, got %v", expr, err)
+        return
+    }
+    if (perr.Line != line) || (perr.Column != column) {
+        t.Errorf("Expected error in %q at line %d, column %d, but got: %v", expr, line, column, err)
+    }
+}
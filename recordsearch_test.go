@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+    "testing"
+    "time"
+)
 
 
 // Test parsing of a search predicate
@@ -13,7 +16,7 @@ func TestParseXpath(t *testing.T) {
 
 // Test the search predicate.
 func TestXPMatch(t *testing.T) {
-    expr := `xp("/a/b/c")`
+    expr := `looseXp("/a/b/c")`
     rs, err := ParseRecordMatchExpr(expr)
     if err != nil {
         t.Error(err)
@@ -35,7 +38,7 @@ func TestXPMatch(t *testing.T) {
 
 // Test the start with predicate
 func TestStartWith(t *testing.T) {
-    expr := `startsWith(xp("/a/val"), "Some")`
+    expr := `startsWith(looseXp("/a/val"), "Some")`
     rs, err := ParseRecordMatchExpr(expr)
     if err != nil {
         t.Error(err)
@@ -57,7 +60,7 @@ func TestStartWith(t *testing.T) {
 
 // Test the contains predicate
 func TestContains(t *testing.T) {
-    expr := `contains(xp("/a/val"), "value")`
+    expr := `contains(looseXp("/a/val"), "value")`
     rs, err := ParseRecordMatchExpr(expr)
     if err != nil {
         t.Error(err)
@@ -105,7 +108,7 @@ func TestUrnPredicate(t *testing.T) {
 // Test the nonEmpty predicate
 func TestNonEmptyValues(t *testing.T) {
     assertSearchExpr(t, `"This is not empty"`, "<xml></xml>", true, "This is not empty")
-    assertSearchExpr(t, `"")`, "<xml></xml>", false, "")
+    assertSearchExpr(t, `""`, "<xml></xml>", false, "")
     assertSearchExpr(t, `xp("/xml/value")`, "<xml>This has<value>a value</value> set</xml>", true, "a value")
     assertSearchExpr(t, `xp("/xml/missing")`, "<xml>This has<value>a value</value> set</xml>", false, "")
     assertSearchExpr(t, `xp("/xml/value")`, "<xml>This has<value attr=\"some attribute\" /> set</xml>", false, "")
@@ -113,6 +116,50 @@ func TestNonEmptyValues(t *testing.T) {
 }
 
 
+// Test that literal paths to xp() are compiled when the expression is parsed
+func TestLiteralXPathCompiled(t *testing.T) {
+    ast, err := ParseRSExpr(`xp("/a/val")`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if xp, isXPath := ast.(*RSExprXPath) ; !isXPath || (xp.path == nil) {
+        t.Errorf("Expected a compiled path, got %T", ast)
+    }
+
+    if ast, _ := ParseRSExpr(`xp(concat("/a/", "val"))`) ; ast == nil {
+        t.Error("Expected a path which is not a literal to be parsed")
+    } else if xp, isXPath := ast.(*RSExprXPath) ; !isXPath || (xp.path != nil) {
+        t.Error("Expected a path which is not a literal not to be compiled")
+    }
+
+    assertParseError(t, `urn and xp("<not an xpath>")`, 1, 12)
+}
+
+// Test that the content of a record is only parsed once
+func TestContentParsedOnce(t *testing.T) {
+    rs, err := ParseRecordMatchExpr(`xp("/a/val") and xp(concat("/a/", "b"))`)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rec := &RecordResult{}
+    rec.Content = "<a><val>Some value</val><b>Something</b></a>"
+
+    if r, v, _ := rs.SearchRecord(rec) ; !(r && (v == "Something")) {
+        t.Error("rec must match")
+    }
+    parsed := rec.parsed
+    if r, _, _ := rs.SearchRecord(rec) ; !r || (rec.parsed != parsed) {
+        t.Error("Expected the parsed content to be reused")
+    }
+
+    // Changing the content parses it again
+    rec.Content = "<a><val>Another value</val></a>"
+    if r, _, _ := rs.SearchRecord(rec) ; r || (rec.parsed == parsed) {
+        t.Error("Expected the changed content to be parsed")
+    }
+}
+
 func assertSearchExpr(t *testing.T, expr string, xml string, expectedVal bool, expectedValue string) {
     rs, err := ParseRecordMatchExpr(expr)
     if err != nil {
@@ -134,3 +181,119 @@ func assertSearchExpr(t *testing.T, expr string, xml string, expectedVal bool, e
         return
     }
 }
+
+
+const testTypesXml = "<rec><kw>one</kw><kw>two</kw><kw>three</kw><size> 12.5 </size><date>2021-03-04T05:06:07</date><title>A title</title></rec>"
+
+// Test the typed values
+func TestTypedValues(t *testing.T) {
+    assertSearchExpr(t, `count(xp("/rec/kw"))`, testTypesXml, true, "3")
+    assertSearchExpr(t, `count(xp("/rec/missing"))`, testTypesXml, false, "0")
+    assertSearchExpr(t, `number(xp("/rec/size"))`, testTypesXml, true, "12.5")
+    assertSearchExpr(t, `date(xp("/rec/date"))`, testTypesXml, true, "2021-03-04T05:06:07Z")
+    assertSearchExpr(t, `date("2020-01-01")`, testTypesXml, true, "2020-01-01T00:00:00Z")
+    assertSearchExpr(t, `date("2020-01-01T10:00:00+10:00")`, testTypesXml, true, "2020-01-01T00:00:00Z")
+    assertSearchExpr(t, `-1.5`, testTypesXml, true, "-1.5")
+    assertSearchExpr(t, `0`, testTypesXml, false, "0")
+
+    // Lists take on the value of the first item
+    assertSearchExpr(t, `xp("/rec/kw")`, testTypesXml, true, "one")
+    assertSearchExpr(t, `concat(xp("/rec/kw"), "!")`, testTypesXml, true, "one!")
+}
+
+// Test comparisons of typed values
+func TestTypedComparisons(t *testing.T) {
+    assertSearchExpr(t, `count(xp("/rec/kw")) > 2`, testTypesXml, true, "true")
+    assertSearchExpr(t, `count(xp("/rec/kw")) > 5`, testTypesXml, false, "false")
+    assertSearchExpr(t, `number(xp("/rec/size")) == 12.5`, testTypesXml, true, "true")
+    assertSearchExpr(t, `xp("/rec/size") < 100`, testTypesXml, true, "true")
+    assertSearchExpr(t, `date(xp("/rec/date")) > date("2020-01-01")`, testTypesXml, true, "true")
+    assertSearchExpr(t, `date(xp("/rec/date")) < "2021-03"`, testTypesXml, false, "false")
+    assertSearchExpr(t, `date("2021") == date("2021-01-01T00:00:00Z")`, testTypesXml, true, "true")
+}
+
+// Test that type errors are reported
+func TestTypeErrors(t *testing.T) {
+    assertEvaluateError(t, `number(xp("/rec/title"))`, "number(): string 'A title' is not a number")
+    assertEvaluateError(t, `date("yesterday")`, "date(): string 'yesterday' is not a date")
+    assertEvaluateError(t, `count("abc")`, "count() expects a list but got string 'abc'")
+    assertEvaluateError(t, `xp("/rec/title") > 5`, "cannot compare list with number: string 'A title' is not a number")
+    assertEvaluateError(t, `date(xp("/rec/date")) > 5`, "cannot compare date with number: number '5' is not a date")
+}
+
+
+func assertEvaluateError(t *testing.T, expr string, expectedErr string) {
+    ast, err := ParseRSExpr(expr)
+    if err != nil {
+        t.Error(err)
+        return
+    }
+
+    if _, err := ast.Evaluate(&RecordResult{ Content: testTypesXml }) ; (err == nil) || (err.Error() != expectedErr) {
+        t.Errorf("Expected error '%s' from %s, but got: %v", expectedErr, expr, err)
+    }
+}
+
+
+// Returns a record with header information for the header functions
+func testHeaderRecord() *RecordResult {
+    rec := &RecordResult{}
+    rec.Header.Identifier = "oai:rec:1"
+    rec.Header.DateStamp = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+    rec.Header.SetSpec = []string{ "maps", "data:ocean" }
+    rec.Content = "<rec><title>Sea surface temperature</title></rec>"
+    return rec
+}
+
+// Test the functions over the header of the record
+func TestHeaderFunctions(t *testing.T) {
+    assertHeaderExpr(t, `datestamp`, DefaultRSExprOptions(), "2021-03-04T05:06:07Z")
+    assertHeaderExpr(t, `formatDate(datestamp, "2006/01")`, DefaultRSExprOptions(), "2021/03")
+    assertHeaderExpr(t, `datestamp > date("2021-01-01") and datestamp < "2022"`, DefaultRSExprOptions(), "true")
+    assertHeaderExpr(t, `count(sets)`, DefaultRSExprOptions(), "2")
+    assertHeaderExpr(t, `sets`, DefaultRSExprOptions(), "maps")
+    assertHeaderExpr(t, `inSet("maps")`, DefaultRSExprOptions(), "true")
+    assertHeaderExpr(t, `inSet("data")`, DefaultRSExprOptions(), "true")
+    assertHeaderExpr(t, `inSet("dat")`, DefaultRSExprOptions(), "false")
+    assertHeaderExpr(t, `deleted`, DefaultRSExprOptions(), "false")
+    assertHeaderExpr(t, `now > datestamp`, DefaultRSExprOptions(), "true")
+
+    assertHeaderExpr(t, `inSet("data:ocean") and datestamp >= date("2021") and contains(xp("/rec/title"), "temperature")`,
+        DefaultRSExprOptions(), "Sea surface temperature")
+}
+
+// Test the functions which use the settings of the expression
+func TestContextFunctions(t *testing.T) {
+    opts := DefaultRSExprOptions()
+    opts.Provider = "myprovider"
+    opts.Prefix = "iso19139"
+
+    assertHeaderExpr(t, `provider`, opts, "myprovider")
+    assertHeaderExpr(t, `concat(provider, "-", prefix, "-", urn)`, opts, "myprovider-iso19139-oai:rec:1")
+    assertHeaderExpr(t, `prefix`, DefaultRSExprOptions(), "")
+
+    // The prefix of the record takes precedence
+    rec := testHeaderRecord()
+    rec.Prefix = "oai_dc"
+    ast, err := ParseRSExprWithOptions(`prefix`, opts)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    if val, err := ast.Evaluate(rec) ; (err != nil) || (val.String() != "oai_dc") {
+        t.Errorf("Expected oai_dc, got %v, %v", val, err)
+    }
+}
+
+
+func assertHeaderExpr(t *testing.T, expr string, opts RSExprOptions, expectedValue string) {
+    ast, err := ParseRSExprWithOptions(expr, opts)
+    if err != nil {
+        t.Error(err)
+        return
+    }
+
+    val, err := ast.Evaluate(testHeaderRecord())
+    if (err != nil) || (val.String() != expectedValue) {
+        t.Errorf("Expected '%s' from %s, got %v, %v", expectedValue, expr, val, err)
+    }
+}
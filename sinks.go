@@ -0,0 +1,361 @@
+package main
+
+// Record sinks.  These are the destinations of harvested records.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// Supported output formats
+const (
+	DirOutput       string = "dir"
+	JsonLinesOutput string = "jsonl"
+	WarcOutput      string = "warc"
+	XmlOutput       string = "xml"
+)
+
+// A destination of harvested records.  Deleted records are only written when deletions are
+// being applied.
+type RecordSink interface {
+	// Writes a harvested record
+	Write(rr *RecordResult) error
+
+	// Writes any buffered records, and returns the size of the output file with the records saved
+	// so far.  The size is 0 for outputs which are not a single file.  This is called before a
+	// checkpoint is saved, and the file is truncated to the size when the harvest is resumed.
+	Flush() (int64, error)
+
+	// Finalises the output
+	Close() error
+}
+
+// Returns the filename extension of an output format which writes to a single file.  Returns an
+// error if the format is not supported.
+func OutputExtension(format string) (string, error) {
+	switch format {
+	case JsonLinesOutput:
+		return ".jsonl", nil
+	case WarcOutput:
+		return ".warc.gz", nil
+	case XmlOutput:
+		return ".xml", nil
+	default:
+		return "", fmt.Errorf("unsupported output format '%s': use %s, %s, %s or %s", format, DirOutput, JsonLinesOutput, WarcOutput, XmlOutput)
+	}
+}
+
+// Opens a sink which writes to a single file.  If the file exists, say from a harvest that is
+// being resumed, records are appended to it.
+func NewFileRecordSink(format string, filename string) (RecordSink, error) {
+	if _, err := OutputExtension(format); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case XmlOutput:
+		return newXmlCollectionSink(filename)
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case WarcOutput:
+		ws := &WarcRecordSink{file: file}
+		if err := ws.writeInfo(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return ws, nil
+	default:
+		return &jsonLinesRecordSink{file, bufio.NewWriter(file)}, nil
+	}
+}
+
+// Writes the buffered output to the file, and returns the size of the file
+func flushFile(w *bufio.Writer, file *os.File) (int64, error) {
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return fileSize(file)
+}
+
+// Returns the size of an open file
+func fileSize(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Pattern matching the XML declaration at the start of the metadata
+var xmlDeclRegExp *regexp.Regexp = regexp.MustCompile(`^\s*<\?xml[^?]*\?>`)
+
+// ---------------------------------------------------------------------------------------------
+// JSON Lines
+//      Writes each record as a JSON object on a single line.
+
+type jsonLinesRecord struct {
+	Identifier string    `json:"identifier"`
+	Datestamp  time.Time `json:"datestamp"`
+	SetSpec    []string  `json:"setSpec,omitempty"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	Prefix     string    `json:"prefix,omitempty"`
+	Metadata   string    `json:"metadata,omitempty"`
+}
+
+type jsonLinesRecordSink struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func (js *jsonLinesRecordSink) Write(rr *RecordResult) error {
+	enc := json.NewEncoder(js.w)
+	enc.SetEscapeHTML(false)
+
+	return enc.Encode(jsonLinesRecord{
+		Identifier: rr.Identifier(),
+		Datestamp:  rr.Header.DateStamp,
+		SetSpec:    rr.Header.SetSpec,
+		Deleted:    rr.Deleted,
+		Prefix:     rr.Prefix,
+		Metadata:   strings.TrimSpace(xmlDeclRegExp.ReplaceAllString(rr.Content, "")),
+	})
+}
+
+func (js *jsonLinesRecordSink) Flush() (int64, error) {
+	return flushFile(js.w, js.file)
+}
+
+func (js *jsonLinesRecordSink) Close() error {
+	err := js.w.Flush()
+	if err2 := js.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------
+// XML collection
+//      Writes the records into a single XML document, in the same form as the records of a
+//      ListRecords response.
+
+const xmlCollectionHeader string = `<?xml version="1.0" encoding="UTF-8"?>
+<records xmlns="http://www.openarchives.org/OAI/2.0/">
+`
+const xmlCollectionFooter string = "</records>\n"
+
+type xmlCollectionSink struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+// Opens the collection.  If the collection already exists, the closing tag is removed so that
+// records can be appended to it.
+func newXmlCollectionSink(filename string) (*xmlCollectionSink, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil && size == 0 {
+		_, err = file.WriteString(xmlCollectionHeader)
+	} else if err == nil && size >= int64(len(xmlCollectionFooter)) {
+		footer := make([]byte, len(xmlCollectionFooter))
+		if _, err = file.ReadAt(footer, size-int64(len(footer))); (err == nil) && (string(footer) == xmlCollectionFooter) {
+			err = file.Truncate(size - int64(len(footer)))
+			if err == nil {
+				_, err = file.Seek(0, io.SeekEnd)
+			}
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &xmlCollectionSink{file, bufio.NewWriter(file)}, nil
+}
+
+func (xs *xmlCollectionSink) Write(rr *RecordResult) error {
+	if rr.Deleted {
+		xs.w.WriteString(`<record><header status="deleted">`)
+	} else {
+		xs.w.WriteString("<record><header>")
+	}
+
+	xs.writeElement("identifier", rr.Identifier())
+	xs.writeElement("datestamp", rr.Header.DateStamp.UTC().Format(time.RFC3339))
+	for _, setSpec := range rr.Header.SetSpec {
+		xs.writeElement("setSpec", setSpec)
+	}
+	xs.w.WriteString("</header>")
+
+	if !rr.Deleted {
+		xs.w.WriteString("<metadata>")
+		xs.w.WriteString(strings.TrimSpace(xmlDeclRegExp.ReplaceAllString(rr.Content, "")))
+		xs.w.WriteString("</metadata>")
+	}
+	_, err := xs.w.WriteString("</record>\n")
+	return err
+}
+
+func (xs *xmlCollectionSink) writeElement(name string, value string) {
+	fmt.Fprintf(xs.w, "<%s>", name)
+	xml.EscapeText(xs.w, []byte(value))
+	fmt.Fprintf(xs.w, "</%s>", name)
+}
+
+func (xs *xmlCollectionSink) Flush() (int64, error) {
+	return flushFile(xs.w, xs.file)
+}
+
+func (xs *xmlCollectionSink) Close() error {
+	xs.w.WriteString(xmlCollectionFooter)
+	err := xs.w.Flush()
+	if err2 := xs.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------
+// WARC
+//      Writes each response from the provider as a WARC response record, along with the request
+//      that was made.  Each WARC record is a separate gzip member.  Records are written as the
+//      responses are received, so the sink must be set as the recorder of the session.
+
+type WarcRecordSink struct {
+	mutex sync.Mutex
+	file  *os.File
+
+	// The size of the file before the last response was written.  The records of a page are
+	// harvested after its response is received, so a checkpoint does not include the response.
+	checkpointSize int64
+}
+
+// Records are written as the responses are received
+func (ws *WarcRecordSink) Write(rr *RecordResult) error {
+	return nil
+}
+
+func (ws *WarcRecordSink) Flush() (int64, error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	return ws.checkpointSize, nil
+}
+
+func (ws *WarcRecordSink) Close() error {
+	return ws.file.Close()
+}
+
+// Writes the response as a response record, and the request as a request record.
+func (ws *WarcRecordSink) RecordResponse(req *http.Request, resp *http.Response, body []byte) error {
+	date := time.Now().UTC().Format(time.RFC3339)
+	respId := newWarcRecordId()
+
+	// The response block is the response as received
+	respBlock := new(bytes.Buffer)
+	fmt.Fprintf(respBlock, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.Write(respBlock)
+	respBlock.WriteString("\r\n")
+	respBlock.Write(body)
+
+	// The request block includes the form for POST requests
+	reqBlock := new(bytes.Buffer)
+	fmt.Fprintf(reqBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	req.Header.Write(reqBlock)
+	reqBlock.WriteString("\r\n")
+	if req.GetBody != nil {
+		if reqBody, err := req.GetBody(); err == nil {
+			io.Copy(reqBlock, reqBody)
+			reqBody.Close()
+		}
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	size, err := fileSize(ws.file)
+	if err != nil {
+		return err
+	}
+	ws.checkpointSize = size
+
+	err = ws.writeRecord([]string{
+		"WARC-Type: response",
+		"WARC-Record-ID: " + respId,
+		"WARC-Date: " + date,
+		"WARC-Target-URI: " + req.URL.String(),
+		"Content-Type: application/http; msgtype=response",
+	}, respBlock.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return ws.writeRecord([]string{
+		"WARC-Type: request",
+		"WARC-Record-ID: " + newWarcRecordId(),
+		"WARC-Date: " + date,
+		"WARC-Target-URI: " + req.URL.String(),
+		"WARC-Concurrent-To: " + respId,
+		"Content-Type: application/http; msgtype=request",
+	}, reqBlock.Bytes())
+}
+
+// Writes the warcinfo record at the start of each harvest
+func (ws *WarcRecordSink) writeInfo() error {
+	info := fmt.Sprintf("software: %s/%s\r\nformat: WARC File Format 1.0\r\n", APP_NAME, APP_VERSION)
+	err := ws.writeRecord([]string{
+		"WARC-Type: warcinfo",
+		"WARC-Record-ID: " + newWarcRecordId(),
+		"WARC-Date: " + time.Now().UTC().Format(time.RFC3339),
+		"Content-Type: application/warc-fields",
+	}, []byte(info))
+	if err != nil {
+		return err
+	}
+
+	ws.checkpointSize, err = fileSize(ws.file)
+	return err
+}
+
+// Writes a WARC record with the headers and block as a gzip member
+func (ws *WarcRecordSink) writeRecord(headers []string, block []byte) error {
+	gz := gzip.NewWriter(ws.file)
+
+	io.WriteString(gz, "WARC/1.0\r\n")
+	for _, header := range headers {
+		io.WriteString(gz, header+"\r\n")
+	}
+	fmt.Fprintf(gz, "Content-Length: %d\r\n\r\n", len(block))
+	gz.Write(block)
+	io.WriteString(gz, "\r\n\r\n")
+
+	return gz.Close()
+}
+
+// Returns a new WARC record ID
+func newWarcRecordId() string {
+	id, _ := uuid.NewV4()
+	return "<urn:uuid:" + id.String() + ">"
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+    "testing"
+    "time"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "bytes"
+    "bufio"
+    "encoding/json"
+    "encoding/xml"
+    "compress/gzip"
+    "net/http"
+    "net/url"
+
+    "github.com/lmika/oaipmh/client"
+)
+
+var testSinkRecords = []*RecordResult {
+    &RecordResult{
+        Header: oaipmh.OaipmhHeader{ Identifier: "rec:1", DateStamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), SetSpec: []string{"s1"} },
+        Content: `<?xml version="1.0"?><dc>One &amp; only</dc>`,
+    },
+    &RecordResult{
+        Header: oaipmh.OaipmhHeader{ Identifier: "rec:2", DateStamp: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC) },
+        Deleted: true,
+    },
+}
+
+// Writes the test records to a sink of the format
+func writeTestSink(t *testing.T, format string, filename string) {
+    sink, err := NewFileRecordSink(format, filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    for _, rr := range testSinkRecords {
+        if err := sink.Write(rr) ; err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := sink.Close() ; err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Writes the test records to a sink of the format as a harvest which is killed after a checkpoint
+// would, leaving a torn record after the first record.  The harvest is then resumed, writing the
+// second record again.
+func resumeTestSink(t *testing.T, format string, filename string) {
+    sink, err := NewFileRecordSink(format, filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    if err := sink.Write(testSinkRecords[0]) ; err != nil {
+        t.Fatal(err)
+    }
+    size, err := sink.Flush()
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    sink.Write(testSinkRecords[1])
+    sink.Flush()
+    killTestSink(t, filename, size)
+
+    sink, err = NewFileRecordSink(format, filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    if err := sink.Write(testSinkRecords[1]) ; err != nil {
+        t.Fatal(err)
+    }
+    if err := sink.Close() ; err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Tears the end of the file, as a harvest which is killed would, then truncates the file to the
+// size of the checkpoint as resuming the harvest does
+func killTestSink(t *testing.T, filename string, size int64) {
+    file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    file.WriteString("<torn")
+    file.Close()
+
+    if err := os.Truncate(filename, size) ; err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestJsonLinesRecordSink(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sinks")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "records.jsonl")
+    writeTestSink(t, JsonLinesOutput, filename)
+
+    content, err := ioutil.ReadFile(filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+    if (len(lines) != 2) {
+        t.Fatalf("Expected 2 lines, got %d", len(lines))
+    }
+
+    var rec jsonLinesRecord
+    if err := json.Unmarshal([]byte(lines[0]), &rec) ; err != nil {
+        t.Fatal(err)
+    }
+    if (rec.Identifier != "rec:1") || (rec.Metadata != "<dc>One &amp; only</dc>") || (rec.Deleted) {
+        t.Errorf("Unexpected first record: %v", rec)
+    }
+
+    if err := json.Unmarshal([]byte(lines[1]), &rec) ; err != nil {
+        t.Fatal(err)
+    }
+    if (rec.Identifier != "rec:2") || (! rec.Deleted) {
+        t.Errorf("Unexpected second record: %v", rec)
+    }
+}
+
+// Test that a resumed JSON lines file has each record once, without the torn record
+func TestJsonLinesRecordSinkResumed(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sinks")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "records.jsonl")
+    resumeTestSink(t, JsonLinesOutput, filename)
+
+    content, err := ioutil.ReadFile(filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    ids := []string{}
+    for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+        var rec jsonLinesRecord
+        if err := json.Unmarshal([]byte(line), &rec) ; err != nil {
+            t.Fatalf("%s: %s", line, err)
+        }
+        ids = append(ids, rec.Identifier)
+    }
+    if (strings.Join(ids, ",") != "rec:1,rec:2") {
+        t.Errorf("Expected rec:1 and rec:2, got %v", ids)
+    }
+}
+
+func TestXmlCollectionSink(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sinks")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    // Reopening the collection appends to it
+    filename := filepath.Join(dir, "records.xml")
+    writeTestSink(t, XmlOutput, filename)
+    writeTestSink(t, XmlOutput, filename)
+
+    file, err := os.Open(filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    var coll struct {
+        Records     []struct {
+            Header      oaipmh.OaipmhHeader     `xml:"header"`
+            Metadata    struct {
+                Inner       string              `xml:",innerxml"`
+            }                                   `xml:"metadata"`
+        }                                       `xml:"record"`
+    }
+    if err := xml.NewDecoder(file).Decode(&coll) ; err != nil {
+        t.Fatal(err)
+    }
+
+    if (len(coll.Records) != 4) {
+        t.Fatalf("Expected 4 records, got %d", len(coll.Records))
+    }
+    if (coll.Records[2].Header.Identifier != "rec:1") || (coll.Records[2].Metadata.Inner != "<dc>One &amp; only</dc>") {
+        t.Errorf("Unexpected record: %v", coll.Records[2])
+    }
+    if (coll.Records[3].Header.Status != "deleted") {
+        t.Errorf("Expected deleted record, got %v", coll.Records[3])
+    }
+}
+
+// Test that a resumed XML collection is a document with each record once
+func TestXmlCollectionSinkResumed(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sinks")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "records.xml")
+    resumeTestSink(t, XmlOutput, filename)
+
+    file, err := os.Open(filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    var coll struct {
+        Records     []struct {
+            Header      oaipmh.OaipmhHeader     `xml:"header"`
+        }                                       `xml:"record"`
+    }
+    if err := xml.NewDecoder(file).Decode(&coll) ; err != nil {
+        t.Fatal(err)
+    }
+
+    if (len(coll.Records) != 2) || (coll.Records[0].Header.Identifier != "rec:1") || (coll.Records[1].Header.Identifier != "rec:2") {
+        t.Errorf("Expected rec:1 and rec:2, got %v", coll.Records)
+    }
+}
+
+func TestWarcRecordSink(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sinks")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "records.warc.gz")
+    sink, err := NewFileRecordSink(WarcOutput, filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    reqUrl, _ := url.Parse("http://example.com/oai?verb=ListRecords&metadataPrefix=oai_dc")
+    req := &http.Request{ Method: "GET", URL: reqUrl, Header: http.Header{} }
+    resp := &http.Response{ Status: "200 OK", StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{ "Content-Type": {"text/xml"} } }
+
+    if err := sink.(oaipmh.ResponseRecorder).RecordResponse(req, resp, []byte("<OAI-PMH/>")) ; err != nil {
+        t.Fatal(err)
+    }
+    if err := sink.Close() ; err != nil {
+        t.Fatal(err)
+    }
+
+    types := []string{}
+    for _, block := range readTestWarcRecords(t, filename) {
+        if (! bytes.HasPrefix(block, []byte("WARC/1.0\r\n"))) {
+            t.Errorf("Expected WARC record, got %q", block)
+        }
+        types = append(types, testWarcType(block))
+        if (types[len(types) - 1] == "response") && (! bytes.Contains(block, []byte("HTTP/1.1 200 OK\r\n"))) {
+            t.Errorf("Expected HTTP response in block, got %q", block)
+        }
+    }
+
+    if (strings.Join(types, ",") != "warcinfo,response,request") {
+        t.Errorf("Unexpected WARC records: %v", types)
+    }
+}
+
+// Test that a resumed WARC file does not repeat the response of the page after the checkpoint
+func TestWarcRecordSinkResumed(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sinks")
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "records.warc.gz")
+    resp := &http.Response{ Status: "200 OK", StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{} }
+    recordPage := func(sink RecordSink, page string) {
+        reqUrl, _ := url.Parse("http://example.com/oai?verb=ListRecords&resumptionToken=" + page)
+        if err := sink.(oaipmh.ResponseRecorder).RecordResponse(&http.Request{ Method: "GET", URL: reqUrl, Header: http.Header{} }, resp, []byte("<OAI-PMH/>")) ; err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // The checkpoint is saved once the response of the second page is received
+    sink, err := NewFileRecordSink(WarcOutput, filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    recordPage(sink, "page1")
+    recordPage(sink, "page2")
+    size, err := sink.Flush()
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    killTestSink(t, filename, size)
+
+    sink, err = NewFileRecordSink(WarcOutput, filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    recordPage(sink, "page2")
+    if err := sink.Close() ; err != nil {
+        t.Fatal(err)
+    }
+
+    pages := []string{}
+    for _, block := range readTestWarcRecords(t, filename) {
+        if (testWarcType(block) == "response") {
+            pages = append(pages, string(block[bytes.Index(block, []byte("page")):][:5]))
+        }
+    }
+    if (strings.Join(pages, ",") != "page1,page2") {
+        t.Errorf("Expected the responses of page1 and page2, got %v", pages)
+    }
+}
+
+// Reads the blocks of the records of a WARC file.  Each record is a separate gzip member.
+func readTestWarcRecords(t *testing.T, filename string) [][]byte {
+    file, err := os.Open(filename)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    br := bufio.NewReader(file)
+    gz, err := gzip.NewReader(br)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    blocks := [][]byte{}
+    for {
+        gz.Multistream(false)
+        block, err := ioutil.ReadAll(gz)
+        if (err != nil) {
+            t.Fatal(err)
+        }
+        blocks = append(blocks, block)
+
+        if err := gz.Reset(br) ; err != nil {
+            break
+        }
+    }
+    return blocks
+}
+
+// Returns the WARC-Type of a WARC record
+func testWarcType(block []byte) string {
+    for _, line := range strings.Split(string(block), "\r\n") {
+        if (strings.HasPrefix(line, "WARC-Type: ")) {
+            return strings.TrimPrefix(line, "WARC-Type: ")
+        }
+    }
+    return ""
+}
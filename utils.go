@@ -4,13 +4,16 @@ import (
     "io"
     "os"
     "fmt"
+    "log"
     "bufio"
+    "context"
     "strings"
+    "os/signal"
 )
 
 
 // Read lines from a file.  Lines will start being sent to the callback function between first
-// and max
+// and max.  Blank lines and comments starting with '#' are skipped.
 func LinesFromFile(filename string, firstResult int, maxResults int, callback func(line string) bool) error {
     var err error
     var file *os.File = nil
@@ -29,8 +32,13 @@ func LinesFromFile(filename string, firstResult int, maxResults int, callback fu
     resultCount := 0
 
     for line, err := bufr.ReadString('\n') ; err == nil ; line, err = bufr.ReadString('\n') {
+        // Skip blank lines and comments
+        line = strings.TrimSpace(line)
+        if (line == "") || strings.HasPrefix(line, "#") {
+            continue
+        }
+
         if (resultCount >= firstResult) {
-            line = strings.TrimSpace(line)
             if (! callback(line)) {
                 return nil
             }
@@ -49,13 +57,51 @@ func LinesFromFile(filename string, firstResult int, maxResults int, callback fu
     }
 }
 
+// Returns a context which is cancelled when the user interrupts the program.  This gives
+// long running commands a chance to finish cleanly.  A second interrupt kills the program.
+func InterruptibleContext() context.Context {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt)
+    go func() {
+        <-sigs
+        log.Printf("Interrupted.  Stopping (interrupt again to quit immediately)")
+        cancel()
+
+        <-sigs
+        os.Exit(130)
+    }()
+
+    return ctx
+}
+
 // Displays an error message and kills the program.
 func Die(fmtstr string, args ...interface{}) {
-    fmt.Fprintf(os.Stderr, fmtstr, args)
+    fmt.Fprintf(os.Stderr, fmtstr, args...)
     os.Exit(1)
 }
 
 
+// Formats a count with thousands separators (e.g. 12,300)
+func FormatCount(n int) string {
+    if (n < 0) {
+        return "-" + FormatCount(-n)
+    }
+
+    digits := fmt.Sprintf("%d", n)
+    formatted := make([]byte, 0, len(digits) + len(digits) / 3)
+    for i := 0; i < len(digits); i++ {
+        if (i > 0) && ((len(digits) - i) % 3 == 0) {
+            formatted = append(formatted, ',')
+        }
+        formatted = append(formatted, digits[i])
+    }
+
+    return string(formatted)
+}
+
+
 // Escapes the characters of the passed in string so they can safely be used as a filename.
 // The characters allowed are all alphanumeric characters, ':', '-' and '.'.  Any other
 // characters will be escaped in a form similar to QueryEscape (spaces will be escaped to %20).
@@ -20,6 +20,22 @@ func TestEscapeIdForFilename(t *testing.T) {
         ("~`!@#$%^&*()_+-=[]{}\\|:;\"'<>,.?/"))
 }
 
+func TestFormatCount(t *testing.T) {
+    for n, exp := range map[int]string{
+        0: "0",
+        999: "999",
+        1000: "1,000",
+        12300: "12,300",
+        85000: "85,000",
+        1234567: "1,234,567",
+        -4500: "-4,500",
+    } {
+        if FormatCount(n) != exp {
+            t.Errorf("FormatCount(%d): expected '%s' but received '%s'", n, exp, FormatCount(n))
+        }
+    }
+}
+
 
 func assertEscapedIdIsEqual(t *testing.T, exp, actual string) {
     // Test escaping
@@ -0,0 +1,374 @@
+package main
+
+// XPath evaluation for rs-expressions.  Paths are evaluated by a namespace-aware XPath 1.0 engine,
+// or by the loose engine which matches elements by their local name and ignores namespaces.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/antchfx/xpath"
+	"launchpad.net/xmlpath"
+)
+
+// The namespace prefixes which can be used in paths without being configured
+var DefaultNamespaces = map[string]string{
+	"gmd":     "http://www.isotc211.org/2005/gmd",
+	"gco":     "http://www.isotc211.org/2005/gco",
+	"gml":     "http://www.opengis.net/gml/3.2",
+	"srv":     "http://www.isotc211.org/2005/srv",
+	"gmx":     "http://www.isotc211.org/2005/gmx",
+	"gts":     "http://www.isotc211.org/2005/gts",
+	"gsr":     "http://www.isotc211.org/2005/gsr",
+	"gss":     "http://www.isotc211.org/2005/gss",
+	"xlink":   "http://www.w3.org/1999/xlink",
+	"xsi":     "http://www.w3.org/2001/XMLSchema-instance",
+	"dc":      "http://purl.org/dc/elements/1.1/",
+	"dcterms": "http://purl.org/dc/terms/",
+	"oai":     "http://www.openarchives.org/OAI/2.0/",
+	"oai_dc":  "http://www.openarchives.org/OAI/2.0/oai_dc/",
+}
+
+// The settings of the xp() function
+type XPathOptions struct {
+	// The namespace prefixes which can be used in paths
+	Namespaces map[string]string
+
+	// If true, xp() uses the loose engine
+	Loose bool
+}
+
+// Returns the options with the default namespaces
+func DefaultXPathOptions() XPathOptions {
+	return XPathOptions{Namespaces: DefaultNamespaces}
+}
+
+// A compiled path
+type compiledXPath interface {
+	// Evaluates the path over the record
+	evaluate(rr *RecordResult) (RSExprValue, error)
+}
+
+// Compiles a path
+func compileXPath(path string, opts XPathOptions) (compiledXPath, error) {
+	if opts.Loose {
+		p, err := xmlpath.Compile(path)
+		if err != nil {
+			return nil, err
+		}
+		return looseXPath{p}, nil
+	}
+
+	expr, err := xpath.CompileWithNS(path, opts.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	return &nsXPath{expr: expr}, nil
+}
+
+// A path evaluated by the loose engine
+type looseXPath struct {
+	path *xmlpath.Path
+}
+
+func (lxp looseXPath) evaluate(rr *RecordResult) (RSExprValue, error) {
+	n, err := rr.contentNode()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := RSList{}
+	for iter := lxp.path.Iter(n); iter.Next(); {
+		nodes = append(nodes, RSString(strings.TrimSpace(iter.Node().String())))
+	}
+	return nodes, nil
+}
+
+// A path evaluated by the namespace-aware engine.  The compiled expression keeps state while it is
+// being evaluated, so evaluations are serialised.
+type nsXPath struct {
+	expr  *xpath.Expr
+	mutex sync.Mutex
+}
+
+func (nxp *nsXPath) evaluate(rr *RecordResult) (RSExprValue, error) {
+	doc, err := rr.contentDoc()
+	if err != nil {
+		return nil, err
+	}
+
+	nxp.mutex.Lock()
+	defer nxp.mutex.Unlock()
+
+	switch res := nxp.expr.Evaluate(newXmlNavigator(doc)).(type) {
+	case *xpath.NodeIterator:
+		nodes := RSList{}
+		for res.MoveNext() {
+			nodes = append(nodes, RSString(strings.TrimSpace(res.Current().Value())))
+		}
+		return nodes, nil
+	case float64:
+		return RSNumber(res), nil
+	case string:
+		return RSString(res), nil
+	case bool:
+		return RSBool(res), nil
+	default:
+		return nil, fmt.Errorf("unsupported result of XPath '%s': %T", nxp.expr.String(), res)
+	}
+}
+
+// ------------------------------------------------------------------------------
+// Documents
+
+// A node of a parsed document
+type xmlNode struct {
+	nodeType xpath.NodeType
+
+	// The name and prefix of elements and attributes.  The space of the name is the namespace URI.
+	name   xml.Name
+	prefix string
+
+	// The value of text nodes, comments and attributes
+	value string
+
+	attrs                         []*xmlNode
+	parent, firstChild, lastChild *xmlNode
+	prevSibling, nextSibling      *xmlNode
+}
+
+// Appends a child node
+func (n *xmlNode) appendChild(child *xmlNode) {
+	child.parent = n
+	if n.lastChild == nil {
+		n.firstChild = child
+	} else {
+		n.lastChild.nextSibling = child
+		child.prevSibling = n.lastChild
+	}
+	n.lastChild = child
+}
+
+// Writes the string value of the node, which for elements is the text of all the descendants.
+func (n *xmlNode) writeText(sb *strings.Builder) {
+	switch n.nodeType {
+	case xpath.TextNode:
+		sb.WriteString(n.value)
+	case xpath.RootNode, xpath.ElementNode:
+		for c := n.firstChild; c != nil; c = c.nextSibling {
+			if c.nodeType != xpath.CommentNode {
+				c.writeText(sb)
+			}
+		}
+	}
+}
+
+// Parses a document.  The prefixes of the document are resolved to namespace URIs.
+func parseXmlDoc(r io.Reader) (*xmlNode, error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+
+	root := &xmlNode{nodeType: xpath.RootNode}
+	curr := root
+
+	// The namespaces of each open element
+	scopes := []map[string]string{{"xml": "http://www.w3.org/XML/1998/namespace"}}
+	resolve := func(prefix string) string {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if uri, hasUri := scopes[i][prefix]; hasUri {
+				return uri
+			}
+		}
+		return ""
+	}
+
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			scope := make(map[string]string)
+			for _, attr := range t.Attr {
+				if (attr.Name.Space == "") && (attr.Name.Local == "xmlns") {
+					scope[""] = attr.Value
+				} else if attr.Name.Space == "xmlns" {
+					scope[attr.Name.Local] = attr.Value
+				}
+			}
+			scopes = append(scopes, scope)
+
+			elem := &xmlNode{
+				nodeType: xpath.ElementNode,
+				name:     xml.Name{Space: resolve(t.Name.Space), Local: t.Name.Local},
+				prefix:   t.Name.Space,
+			}
+			for _, attr := range t.Attr {
+				if ((attr.Name.Space == "") && (attr.Name.Local == "xmlns")) || (attr.Name.Space == "xmlns") {
+					continue
+				}
+
+				// Attributes without a prefix are not in a namespace
+				var uri string
+				if attr.Name.Space != "" {
+					uri = resolve(attr.Name.Space)
+				}
+				elem.attrs = append(elem.attrs, &xmlNode{
+					nodeType: xpath.AttributeNode,
+					name:     xml.Name{Space: uri, Local: attr.Name.Local},
+					prefix:   attr.Name.Space,
+					value:    attr.Value,
+					parent:   elem,
+				})
+			}
+
+			curr.appendChild(elem)
+			curr = elem
+		case xml.EndElement:
+			if curr.parent == nil {
+				return nil, fmt.Errorf("unexpected end element </%s>", t.Name.Local)
+			}
+			scopes = scopes[:len(scopes)-1]
+			curr = curr.parent
+		case xml.CharData:
+			if (curr.lastChild != nil) && (curr.lastChild.nodeType == xpath.TextNode) {
+				curr.lastChild.value += string(t)
+			} else {
+				curr.appendChild(&xmlNode{nodeType: xpath.TextNode, value: string(t)})
+			}
+		case xml.Comment:
+			curr.appendChild(&xmlNode{nodeType: xpath.CommentNode, value: string(t)})
+		}
+	}
+
+	if curr != root {
+		return nil, fmt.Errorf("unexpected end of document: <%s> is not closed", curr.name.Local)
+	}
+	return root, nil
+}
+
+// A navigator over a parsed document, used by the XPath engine
+type xmlNavigator struct {
+	root, curr *xmlNode
+
+	// The index of the current attribute of curr, or -1 if the navigator is on the node itself
+	attr int
+}
+
+func newXmlNavigator(root *xmlNode) *xmlNavigator {
+	return &xmlNavigator{root: root, curr: root, attr: -1}
+}
+
+// Returns the node or attribute the navigator is on
+func (nav *xmlNavigator) node() *xmlNode {
+	if nav.attr != -1 {
+		return nav.curr.attrs[nav.attr]
+	}
+	return nav.curr
+}
+
+func (nav *xmlNavigator) NodeType() xpath.NodeType {
+	return nav.node().nodeType
+}
+
+func (nav *xmlNavigator) LocalName() string {
+	return nav.node().name.Local
+}
+
+func (nav *xmlNavigator) Prefix() string {
+	return nav.node().prefix
+}
+
+func (nav *xmlNavigator) NamespaceURL() string {
+	return nav.node().name.Space
+}
+
+func (nav *xmlNavigator) Value() string {
+	n := nav.node()
+	switch n.nodeType {
+	case xpath.RootNode, xpath.ElementNode:
+		var sb strings.Builder
+		n.writeText(&sb)
+		return sb.String()
+	default:
+		return n.value
+	}
+}
+
+func (nav *xmlNavigator) Copy() xpath.NodeNavigator {
+	c := *nav
+	return &c
+}
+
+func (nav *xmlNavigator) MoveToRoot() {
+	nav.curr, nav.attr = nav.root, -1
+}
+
+func (nav *xmlNavigator) MoveToParent() bool {
+	if nav.attr != -1 {
+		nav.attr = -1
+		return true
+	} else if nav.curr.parent != nil {
+		nav.curr = nav.curr.parent
+		return true
+	}
+	return false
+}
+
+func (nav *xmlNavigator) MoveToNextAttribute() bool {
+	if nav.attr >= len(nav.curr.attrs)-1 {
+		return false
+	}
+	nav.attr++
+	return true
+}
+
+func (nav *xmlNavigator) MoveToChild() bool {
+	if (nav.attr != -1) || (nav.curr.firstChild == nil) {
+		return false
+	}
+	nav.curr = nav.curr.firstChild
+	return true
+}
+
+func (nav *xmlNavigator) MoveToFirst() bool {
+	if (nav.attr != -1) || (nav.curr.prevSibling == nil) {
+		return false
+	}
+	for nav.curr.prevSibling != nil {
+		nav.curr = nav.curr.prevSibling
+	}
+	return true
+}
+
+func (nav *xmlNavigator) MoveToNext() bool {
+	if (nav.attr != -1) || (nav.curr.nextSibling == nil) {
+		return false
+	}
+	nav.curr = nav.curr.nextSibling
+	return true
+}
+
+func (nav *xmlNavigator) MoveToPrevious() bool {
+	if (nav.attr != -1) || (nav.curr.prevSibling == nil) {
+		return false
+	}
+	nav.curr = nav.curr.prevSibling
+	return true
+}
+
+func (nav *xmlNavigator) MoveTo(other xpath.NodeNavigator) bool {
+	o, isXmlNav := other.(*xmlNavigator)
+	if !isXmlNav || (o.root != nav.root) {
+		return false
+	}
+	nav.curr, nav.attr = o.curr, o.attr
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "testing"
+)
+
+const testXPathXml = `<?xml version="1.0"?>
+<gmd:MD_Metadata xmlns:gmd="http://www.isotc211.org/2005/gmd" xmlns:gco="http://www.isotc211.org/2005/gco"
+        xmlns:foo="urn:foo" xmlns:xlink="http://www.w3.org/1999/xlink">
+    <gmd:title><gco:CharacterString>The title</gco:CharacterString></gmd:title>
+    <foo:title>Not the title</foo:title>
+    <gmd:keyword><gco:CharacterString>one</gco:CharacterString></gmd:keyword>
+    <gmd:keyword><gco:CharacterString>two</gco:CharacterString></gmd:keyword>
+    <gmd:keyword><gco:CharacterString>three</gco:CharacterString></gmd:keyword>
+    <gmd:onlineResource xlink:href="http://example.com/" type="link"/>
+    <gmd:abstract>Some <!-- not this --><b>bold</b> text</gmd:abstract>
+</gmd:MD_Metadata>`
+
+// Test that paths match elements by namespace
+func TestXPathNamespaces(t *testing.T) {
+    assertSearchExpr(t, `xp("/gmd:MD_Metadata/gmd:title")`, testXPathXml, true, "The title")
+    assertSearchExpr(t, `count(xp("//gmd:title"))`, testXPathXml, true, "1")
+    assertSearchExpr(t, `xp("/MD_Metadata")`, testXPathXml, false, "")
+    assertSearchExpr(t, `xp("//gmd:onlineResource/@xlink:href")`, testXPathXml, true, "http://example.com/")
+    assertSearchExpr(t, `xp("//gmd:onlineResource/@type")`, testXPathXml, true, "link")
+    assertSearchExpr(t, `xp("//gmd:abstract")`, testXPathXml, true, "Some bold text")
+
+    // The loose engine matches by local name
+    assertSearchExpr(t, `count(looseXp("//title"))`, testXPathXml, true, "2")
+
+    // Prefixes are matched by the namespace URI, rather than the prefix used in the document
+    assertSearchExpr(t, `xp("/gmd:a/gmd:b")`, `<a xmlns="http://www.isotc211.org/2005/gmd"><b>Default</b></a>`, true, "Default")
+    assertSearchExpr(t, `xp("/gmd:a/gmd:b")`, `<x:a xmlns:x="http://www.isotc211.org/2005/gmd"><x:b>Other</x:b></x:a>`, true, "Other")
+    assertSearchExpr(t, `xp("/gmd:a")`, `<gmd:a xmlns:gmd="urn:not-gmd">Wrong</gmd:a>`, false, "")
+}
+
+// Test XPath functions and predicates
+func TestXPathFunctions(t *testing.T) {
+    assertSearchExpr(t, `xp("//gmd:keyword[2]")`, testXPathXml, true, "two")
+    assertSearchExpr(t, `xp("//gmd:keyword[gco:CharacterString = 'three']")`, testXPathXml, true, "three")
+    assertSearchExpr(t, `xp("count(//gmd:keyword)")`, testXPathXml, true, "3")
+    assertSearchExpr(t, `xp("count(//gmd:keyword)") > 2`, testXPathXml, true, "true")
+    assertSearchExpr(t, `xp("concat(//gmd:title, '!')")`, testXPathXml, true, "The title!")
+    assertSearchExpr(t, `xp("boolean(//gmd:missing)")`, testXPathXml, false, "false")
+    assertSearchExpr(t, `xp("local-name(/*)")`, testXPathXml, true, "MD_Metadata")
+}
+
+// Test the namespaces and settings of the options
+func TestXPathOptions(t *testing.T) {
+    opts := DefaultXPathOptions()
+    opts.Namespaces = map[string]string{ "f": "urn:foo" }
+
+    assertXPathOpts(t, `xp("//f:title")`, opts, "Not the title")
+    if _, err := ParseRSExprWithOptions(`xp("//gmd:title")`, RSExprOptions{ XPath: opts }) ; err == nil {
+        t.Error("Expected an undefined prefix to fail to parse")
+    }
+
+    opts.Loose = true
+    assertXPathOpts(t, `xp("/MD_Metadata/title")`, opts, "The title")
+}
+
+// Test the options from the configuration
+func TestConfigXPathOptions(t *testing.T) {
+    cfg := &Config{
+        Namespace: map[string]*Namespace{ "f": &Namespace{ Uri: "urn:foo" }, "gco": &Namespace{ Uri: "urn:gco" } },
+    }
+
+    opts := cfg.XPathOptions()
+    if (opts.Namespaces["f"] != "urn:foo") || (opts.Namespaces["gco"] != "urn:gco") || (opts.Namespaces["gmd"] != DefaultNamespaces["gmd"]) {
+        t.Errorf("Unexpected namespaces: %v", opts.Namespaces)
+    }
+    if (opts.Loose) || (DefaultNamespaces["gco"] != "http://www.isotc211.org/2005/gco") {
+        t.Errorf("Expected the defaults to be unchanged")
+    }
+
+    cfg.XPath.Loose = true
+    if (! cfg.XPathOptions().Loose) {
+        t.Errorf("Expected loose option")
+    }
+}
+
+// Test that malformed records are reported
+func TestXPathMalformedRecord(t *testing.T) {
+    ast, err := ParseRSExpr(`xp("/a")`)
+    if (err != nil) {
+        t.Fatal(err)
+    }
+
+    for _, content := range []string{ "<a><b></a>", "<a>" } {
+        if _, err := ast.Evaluate(&RecordResult{ Content: content }) ; err == nil {
+            t.Errorf("Expected error from %q", content)
+        }
+    }
+}
+
+
+func assertXPathOpts(t *testing.T, expr string, opts XPathOptions, expectedValue string) {
+    ast, err := ParseRSExprWithOptions(expr, RSExprOptions{ XPath: opts })
+    if (err != nil) {
+        t.Error(err)
+        return
+    }
+
+    val, err := ast.Evaluate(&RecordResult{ Content: testXPathXml })
+    if (err != nil) || (val.String() != expectedValue) {
+        t.Errorf("Expected '%s' from %s, got %v, %v", expectedValue, expr, val, err)
+    }
+}